@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/shaneu/indahaus/internal/data/schema"
@@ -14,7 +16,7 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Fprint(os.Stderr, "usage: admin [command]")
+		fmt.Fprint(os.Stderr, "usage: admin migrate [up|down|to <version>|status]")
 		os.Exit(2)
 	}
 
@@ -58,7 +60,7 @@ func run(log *log.Logger) error {
 		dbCfg := database.Config{
 			Uri: cfg.DB.Uri,
 		}
-		err := migrate(dbCfg)
+		err := migrate(dbCfg, os.Args[2:])
 		if err != nil {
 			return err
 		}
@@ -69,15 +71,66 @@ func run(log *log.Logger) error {
 	return nil
 }
 
-func migrate(cfg database.Config) error {
+// migrate runs the migrate subcommands, up is the default so a bare migrate brings the db up to date
+//
+//	migrate up            applies every pending migration
+//	migrate down          undoes the last migration applied
+//	migrate to <version>  applies or undoes migrations until version is the last one applied, 0 undoes them all
+//	migrate status        lists the migrations and when each was applied
+func migrate(cfg database.Config, args []string) error {
 	db, err := database.Open(cfg)
 	if err != nil {
 		return errors.Wrap(err, "unable to open database")
 	}
+	defer db.Close()
 
-	if err := schema.Migrate(db); err != nil {
-		return errors.Wrap(err, "unable to migrate database")
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
 	}
 
+	switch cmd {
+	case "up":
+		if err := schema.Migrate(db); err != nil {
+			return errors.Wrap(err, "unable to migrate database")
+		}
+	case "down":
+		if err := schema.Rollback(db); err != nil {
+			return errors.Wrap(err, "unable to roll back database")
+		}
+	case "to":
+		if len(args) < 2 {
+			return errors.New("usage: admin migrate to <version>")
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.Wrapf(err, "parsing version %q", args[1])
+		}
+		if err := schema.MigrateTo(db, version); err != nil {
+			return errors.Wrapf(err, "unable to migrate database to %d", version)
+		}
+	case "status":
+		statuses, err := schema.Statuses(db)
+		if err != nil {
+			return errors.Wrap(err, "unable to read migrations")
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\n", s.Migration, applied)
+		}
+		return nil
+	default:
+		return errors.Errorf("unsupported migrate command %q, expected up, down, to or status", cmd)
+	}
+
+	version, err := schema.Version(db)
+	if err != nil {
+		return errors.Wrap(err, "unable to read version")
+	}
+	fmt.Printf("database is at version %d\n", version)
+
 	return nil
 }
@@ -5,22 +5,36 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/shaneu/indahaus/graph"
 	"github.com/shaneu/indahaus/graph/generated"
+	"github.com/shaneu/indahaus/internal/data/domainresult"
 	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/stats"
+	"github.com/shaneu/indahaus/internal/data/watch"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/internal/events"
 	"github.com/shaneu/indahaus/internal/mid"
+	"github.com/shaneu/indahaus/internal/processdomains"
 	"github.com/shaneu/indahaus/internal/processips"
 	"github.com/shaneu/indahaus/pkg/auth"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
 	"github.com/vektah/gqlparser/v2/gqlerror"
 )
 
 // API binds our HTTP routes and applies our middleware and returns our http.Handler interface
-func API(build string, a auth.Auth, db *sqlx.DB, log *log.Logger) http.Handler {
+func API(build string, a auth.Auth, db *sqlx.DB, providers dnsbl.Registry, domainProviders dnsbl.Registry, resolver dnsbl.Resolver,
+	ipResults ipresult.Store, processIPs processips.Store, bus *events.Bus, background context.Context, requestTimeout time.Duration,
+	log *log.Logger) http.Handler {
 	e := echo.New()
 
 	// global middlewares to be applied to each request
@@ -53,12 +67,47 @@ func API(build string, a auth.Auth, db *sqlx.DB, log *log.Logger) http.Handler {
 		return a.Authenticate(username, password), nil
 	})
 
-	ipResStore := ipresult.New(log, db)
+	domainResStore := domainresult.New(log, db)
 	gqlResolver := graph.Resolver{
-		IPResultStore:  ipResStore,
-		ProcessIPStore: processips.New(log, ipResStore),
+		Background:       background,
+		Log:              log,
+		IPResultStore:    ipResults,
+		ProcessIPStore:   processIPs,
+		ProviderRegistry: providers,
+		JobStore:         job.New(log, db),
+		WatchStore:       watch.New(log, db),
+		WebhookStore:     webhook.New(log, db),
+		StatsStore:       stats.New(log, db),
+		Events:           bus,
+
+		DomainResultStore:      domainResStore,
+		ProcessDomainStore:     processdomains.New(log, domainResStore, domainProviders, resolver),
+		DomainProviderRegistry: domainProviders,
 	}
-	srv := handler.NewDefaultServer(generated.NewExecutableSchema(generated.Config{Resolvers: &gqlResolver}))
+	srv := handler.New(generated.NewExecutableSchema(generated.Config{Resolvers: &gqlResolver}))
+
+	// The transports of handler.NewDefaultServer, less GET. Subscriptions are served over a websocket, which browsers
+	// can't add an authorization header to, so the websocket route skips basic auth and the credentials are checked
+	// when the connection is initialized instead. Without GET a plain request to that route has nothing to serve it
+	srv.AddTransport(transport.Websocket{
+		KeepAlivePingInterval: 10 * time.Second,
+		InitFunc: func(ctx context.Context, initPayload transport.InitPayload) (context.Context, error) {
+			if !websocketAuthenticate(a, initPayload) {
+				return nil, errors.New("unauthorized")
+			}
+			return ctx, nil
+		},
+	})
+	srv.AddTransport(transport.Options{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{})
+
+	srv.SetQueryCache(lru.New(1000))
+
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.AutomaticPersistedQuery{
+		Cache: lru.New(100),
+	})
 
 	// global graphql panic handling
 	srv.SetRecoverFunc(func(ctx context.Context, err interface{}) error {
@@ -78,7 +127,9 @@ func API(build string, a auth.Auth, db *sqlx.DB, log *log.Logger) http.Handler {
 		srv: srv,
 	}
 	e.GET("/", gqlGrp.playground, basicAuth)
-	e.POST("/graphql", gqlGrp.graphql, basicAuth)
+	// queries and mutations are bounded by requestTimeout, subscriptions are left to run for as long as they're open
+	e.POST("/graphql", gqlGrp.graphql, basicAuth, echo.WrapMiddleware(mid.Timeout(requestTimeout)))
+	e.GET("/graphql", gqlGrp.graphql)
 
 	checkGroup := checkGroup{
 		build: build,
@@ -89,3 +140,17 @@ func API(build string, a auth.Auth, db *sqlx.DB, log *log.Logger) http.Handler {
 
 	return e
 }
+
+// websocketAuthenticate checks the basic auth credentials sent in the authorization field of a websocket's
+// connection_init payload, ex {"Authorization": "Basic dXNlcjpwYXNz"}
+func websocketAuthenticate(a auth.Auth, initPayload transport.InitPayload) bool {
+	// borrow net/http's parsing of the header rather than roll our own
+	r := http.Request{Header: http.Header{"Authorization": []string{initPayload.Authorization()}}}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	return a.Authenticate(username, password)
+}
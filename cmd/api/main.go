@@ -14,8 +14,18 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/shaneu/indahaus/cmd/api/handlers"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/queue"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/internal/events"
+	"github.com/shaneu/indahaus/internal/processips"
+	"github.com/shaneu/indahaus/internal/scheduler"
+	"github.com/shaneu/indahaus/internal/webhooks"
 	"github.com/shaneu/indahaus/pkg/auth"
 	"github.com/shaneu/indahaus/pkg/database"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+	"github.com/shaneu/indahaus/pkg/spamhaus"
 
 	"github.com/spf13/viper"
 )
@@ -42,7 +52,10 @@ func run(log *log.Logger) error {
 		Port      string
 		DebugPort string
 		DB        struct {
-			Uri string
+			Uri             string
+			MaxOpenConns    int
+			MaxIdleConns    int
+			ConnMaxLifetime time.Duration
 		}
 		App struct {
 			ReadTimeout     time.Duration
@@ -53,6 +66,57 @@ func run(log *log.Logger) error {
 			Password string
 			Username string
 		}
+		DNSBL struct {
+			Resolver struct {
+				Nameserver string
+				Protocol   string
+				Timeout    time.Duration
+				Retries    int
+			}
+			Spamhaus struct {
+				DQSKey string
+				DBL    bool
+				ZRD    bool
+			}
+			RateLimit struct {
+				QPS      float64
+				Burst    int
+				Cooldown time.Duration
+			}
+			Providers []providerConfig
+		}
+		Queue struct {
+			Workers        int
+			PollInterval   time.Duration
+			MaxAttempts    int
+			RetryDelay     time.Duration
+			MaxRetryDelay  time.Duration
+			MaxRangeSize   int
+			WriteBatchSize int
+			WriteInterval  time.Duration
+			LookupTimeout  time.Duration
+		}
+		Cache struct {
+			Size      int
+			MemoryTTL time.Duration
+			MinTTL    time.Duration
+			MaxTTL    time.Duration
+		}
+		Scheduler struct {
+			Enabled     bool
+			Interval    time.Duration
+			BatchSize   int
+			MaxAge      time.Duration
+			WatchedOnly bool
+		}
+		Webhooks struct {
+			PollInterval  time.Duration
+			BatchSize     int
+			MaxAttempts   int
+			RetryDelay    time.Duration
+			MaxRetryDelay time.Duration
+			Timeout       time.Duration
+		}
 	}
 
 	viper.SetConfigName("config")
@@ -81,7 +145,10 @@ func run(log *log.Logger) error {
 	// Initialize database
 	log.Println("main: Initializing database support")
 	db, err := database.Open(database.Config{
-		Uri: cfg.DB.Uri,
+		Uri:             cfg.DB.Uri,
+		MaxOpenConns:    cfg.DB.MaxOpenConns,
+		MaxIdleConns:    cfg.DB.MaxIdleConns,
+		ConnMaxLifetime: cfg.DB.ConnMaxLifetime,
 	})
 	if err != nil {
 		return errors.Wrap(err, "connecting to db")
@@ -91,6 +158,146 @@ func run(log *log.Logger) error {
 		db.Close()
 	}()
 
+	// ===========================================================
+	// Initialize dnsbl providers
+	providers, err := newRegistry(cfg.DNSBL.Providers, cfg.DNSBL.Spamhaus.DQSKey)
+	if err != nil {
+		return errors.Wrap(err, "configuring dnsbl providers")
+	}
+
+	for _, p := range providers.Providers() {
+		log.Printf("main: DNSBL provider enabled : %s : %s", p.Name(), p.DisplayName())
+	}
+
+	domainProviders, err := newDomainRegistry(cfg.DNSBL.Spamhaus.DBL, cfg.DNSBL.Spamhaus.ZRD, cfg.DNSBL.Spamhaus.DQSKey)
+	if err != nil {
+		return errors.Wrap(err, "configuring domain providers")
+	}
+
+	for _, p := range domainProviders.Providers() {
+		log.Printf("main: Domain provider enabled : %s : %s", p.Name(), p.DisplayName())
+	}
+
+	// a single limiter is shared by every query the process makes so a provider's limit holds no matter how many
+	// lookups are enqueued at once
+	limiter := dnsbl.NewLimiter(dnsbl.LimiterConfig{
+		Default: dnsbl.Limit{
+			QPS:   cfg.DNSBL.RateLimit.QPS,
+			Burst: cfg.DNSBL.RateLimit.Burst,
+		},
+		Providers: providerLimits(cfg.DNSBL.Providers),
+		Cooldown:  cfg.DNSBL.RateLimit.Cooldown,
+	})
+
+	resolver, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+		Nameserver: cfg.DNSBL.Resolver.Nameserver,
+		Protocol:   cfg.DNSBL.Resolver.Protocol,
+		Timeout:    cfg.DNSBL.Resolver.Timeout,
+		Retries:    cfg.DNSBL.Resolver.Retries,
+		Limiter:    limiter,
+	})
+	if err != nil {
+		return errors.Wrap(err, "configuring dnsbl resolver")
+	}
+
+	// ===========================================================
+	// Initialize webhook deliveries
+	// Notifications of listing changes are sent by their own loop so a slow webhook never holds up a lookup. It's
+	// stopped after the lookup queue so the changes found by the last lookups are queued for delivery before it stops
+	hooks := webhooks.New(log, webhook.New(log, db), webhooks.Config{
+		PollInterval:  cfg.Webhooks.PollInterval,
+		BatchSize:     cfg.Webhooks.BatchSize,
+		MaxAttempts:   cfg.Webhooks.MaxAttempts,
+		RetryDelay:    cfg.Webhooks.RetryDelay,
+		MaxRetryDelay: cfg.Webhooks.MaxRetryDelay,
+		Timeout:       cfg.Webhooks.Timeout,
+	})
+
+	hooksCtx, stopHooks := context.WithCancel(context.Background())
+
+	hooksDone := make(chan struct{})
+	go func() {
+		log.Printf("main: Webhook deliveries started")
+		hooks.Run(hooksCtx)
+		close(hooksDone)
+	}()
+
+	// however run returns the loops using the db are stopped before it's closed, these run ahead of db.Close above
+	defer func() {
+		stopHooks()
+		<-hooksDone
+	}()
+
+	// ===========================================================
+	// Initialize the lookup queue
+	// The workers make the lookups queued by the enqueue mutation, including any left unfinished the last time the
+	// process stopped. They get a context of their own so they're stopped after the api, see shutdown below
+	// The workers and the api share one ipresult store so the results cached for the api are dropped as the workers
+	// write new ones
+	ipResults, err := ipresult.NewCached(log, db, cfg.Cache.Size, cfg.Cache.MemoryTTL)
+	if err != nil {
+		return errors.Wrap(err, "configuring ipresult cache")
+	}
+
+	bus := events.New()
+	processIPs := processips.New(log, ipResults, job.New(log, db), queue.New(log, db), bus, hooks, providers, resolver,
+		processips.Config{
+			Workers:        cfg.Queue.Workers,
+			PollInterval:   cfg.Queue.PollInterval,
+			MaxAttempts:    cfg.Queue.MaxAttempts,
+			RetryDelay:     cfg.Queue.RetryDelay,
+			MaxRetryDelay:  cfg.Queue.MaxRetryDelay,
+			MinTTL:         cfg.Cache.MinTTL,
+			MaxTTL:         cfg.Cache.MaxTTL,
+			MaxRangeSize:   cfg.Queue.MaxRangeSize,
+			WriteBatchSize: cfg.Queue.WriteBatchSize,
+			WriteInterval:  cfg.Queue.WriteInterval,
+			LookupTimeout:  cfg.Queue.LookupTimeout,
+		})
+
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+
+	queueDone := make(chan struct{})
+	go func() {
+		log.Printf("main: Lookup queue started")
+		processIPs.Run(queueCtx)
+		close(queueDone)
+	}()
+
+	defer func() {
+		stopQueue()
+		<-queueDone
+	}()
+
+	// ===========================================================
+	// Initialize the scheduler
+	// The scheduler queues stale and watched addresses to be checked again. It's stopped before the queue so nothing
+	// is queued while the queue drains
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+
+	schedulerDone := make(chan struct{})
+	if cfg.Scheduler.Enabled {
+		sched := scheduler.New(log, ipResults, job.New(log, db), processIPs, scheduler.Config{
+			Interval:    cfg.Scheduler.Interval,
+			BatchSize:   cfg.Scheduler.BatchSize,
+			MaxAge:      cfg.Scheduler.MaxAge,
+			WatchedOnly: cfg.Scheduler.WatchedOnly,
+		})
+
+		go func() {
+			log.Printf("main: Scheduler started")
+			sched.Run(schedulerCtx)
+			close(schedulerDone)
+		}()
+	} else {
+		close(schedulerDone)
+	}
+
+	defer func() {
+		stopScheduler()
+		<-schedulerDone
+	}()
+
 	// ===========================================================
 	// Initialize debug endpoint
 	// Not critical for application function so we do not abort startup or shutdown app if endpoints fails
@@ -110,11 +317,23 @@ func run(log *log.Logger) error {
 	// Initialize auth
 	a := auth.New(cfg.Auth.Username, cfg.Auth.Password)
 
+	// work a request leaves running once it's answered, such as domain lookups, is done under bgCtx so it's abandoned
+	// once the api has stopped rather than cut off when the process exits
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// requests are made under reqCtx, which is cancelled when the api can't shut down gracefully so the queries and
+	// lookups still running on their behalf are abandoned
+	reqCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
 	api := http.Server{
-		Addr:         net.JoinHostPort(cfg.Address, cfg.Port),
-		Handler:      handlers.API(build, a, db, log),
+		Addr: net.JoinHostPort(cfg.Address, cfg.Port),
+		Handler: handlers.API(build, a, db, providers, domainProviders, resolver, ipResults, processIPs, bus,
+			bgCtx, cfg.App.WriteTimeout, log),
 		ReadTimeout:  cfg.App.ReadTimeout,
 		WriteTimeout: cfg.App.WriteTimeout,
+		BaseContext:  func(net.Listener) context.Context { return reqCtx },
 	}
 
 	serverErrors := make(chan error, 1)
@@ -136,10 +355,129 @@ func run(log *log.Logger) error {
 		defer cancel()
 
 		if err := api.Shutdown(ctx); err != nil {
+			cancelRequests()
 			api.Close()
 			return errors.Wrap(err, "could not stop server gracefully")
 		}
+		stopBackground()
+
+		// with the api and scheduler stopped nothing more is enqueued. The lookups in flight are abandoned and handed
+		// back to the queue, they're made again when the process starts
+		stopScheduler()
+		select {
+		case <-schedulerDone:
+		case <-ctx.Done():
+			return errors.New("could not stop scheduler gracefully")
+		}
+
+		stopQueue()
+
+		select {
+		case <-queueDone:
+			log.Printf("main: Lookup queue drained")
+		case <-ctx.Done():
+			return errors.New("could not drain lookup queue gracefully")
+		}
+
+		// the requests in flight are abandoned and their deliveries sent when the process starts again
+		stopHooks()
+
+		select {
+		case <-hooksDone:
+			log.Printf("main: Webhook deliveries stopped")
+		case <-ctx.Done():
+			return errors.New("could not stop webhook deliveries gracefully")
+		}
 	}
 
 	return nil
 }
+
+// providerConfig describes a single dnsbl provider in config.yaml
+type providerConfig struct {
+	Name        string
+	DisplayName string
+	Zone        string
+	Enabled     bool
+	IPv6        bool
+	Codes       []dnsbl.Code
+	// QPS and Burst override dnsbl.rateLimit for the provider when QPS is set
+	QPS   float64
+	Burst int
+}
+
+// providerLimits returns the rate limits of the providers that override the default
+func providerLimits(cfgs []providerConfig) map[string]dnsbl.Limit {
+	limits := make(map[string]dnsbl.Limit)
+
+	for _, c := range cfgs {
+		if c.QPS > 0 {
+			limits[c.Name] = dnsbl.Limit{QPS: c.QPS, Burst: c.Burst}
+		}
+	}
+
+	return limits
+}
+
+// newRegistry builds the registry of enabled providers. Spamhaus is built in, it ships with its own code table
+// and is queried through the Data Query Service when dqsKey is set. When no providers are configured at all we fall
+// back to spamhaus alone, which was the only provider before they became configurable
+func newRegistry(cfgs []providerConfig, dqsKey string) (dnsbl.Registry, error) {
+	var providers []dnsbl.Provider
+
+	for _, c := range cfgs {
+		if !c.Enabled {
+			continue
+		}
+
+		if c.Name == spamhaus.Name {
+			providers = append(providers, newSpamhaus(dqsKey))
+			continue
+		}
+
+		if c.Zone == "" {
+			return dnsbl.Registry{}, errors.Errorf("provider %q has no zone", c.Name)
+		}
+
+		providers = append(providers, dnsbl.NewList(dnsbl.ListConfig{
+			Name:        c.Name,
+			DisplayName: c.DisplayName,
+			Zone:        c.Zone,
+			IPv6:        c.IPv6,
+			Codes:       c.Codes,
+		}))
+	}
+
+	if len(cfgs) == 0 {
+		providers = append(providers, newSpamhaus(dqsKey))
+	}
+
+	return dnsbl.NewRegistry(providers...)
+}
+
+func newSpamhaus(dqsKey string) dnsbl.Provider {
+	if dqsKey != "" {
+		return spamhaus.DQS(dqsKey)
+	}
+
+	return spamhaus.Zen()
+}
+
+// newDomainRegistry builds the registry of enabled domain providers, the spamhaus DBL and ZRD zones
+func newDomainRegistry(dbl, zrd bool, dqsKey string) (dnsbl.Registry, error) {
+	var providers []dnsbl.Provider
+
+	if dbl {
+		providers = append(providers, spamhaus.DBL(dqsKey))
+	}
+
+	if zrd {
+		p, err := spamhaus.ZRD(dqsKey)
+		if err != nil {
+			return dnsbl.Registry{}, err
+		}
+		providers = append(providers, p)
+	}
+
+	return dnsbl.NewRegistry(providers...)
+}
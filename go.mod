@@ -6,12 +6,16 @@ require (
 	github.com/99designs/gqlgen v0.13.0
 	github.com/google/go-cmp v0.3.0
 	github.com/google/uuid v1.2.0
+	github.com/hashicorp/golang-lru v0.5.1
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/labstack/echo/v4 v4.3.0
+	github.com/lib/pq v1.10.2
 	github.com/mattn/go-sqlite3 v1.14.7
 	github.com/pkg/errors v0.8.1
 	github.com/spf13/viper v1.7.1
 	github.com/vektah/gqlparser v1.3.1
 	// explicitly requiring v2.1.0, please see https://github.com/99designs/gqlgen/issues/1402 and https://stackoverflow.com/a/67187051/7571000
 	github.com/vektah/gqlparser/v2 v2.1.0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
 )
@@ -0,0 +1,197 @@
+package graph
+
+import (
+	"sort"
+	"time"
+
+	"github.com/shaneu/indahaus/graph/model"
+	"github.com/shaneu/indahaus/internal/data/domainresult"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/stats"
+	"github.com/shaneu/indahaus/internal/data/watch"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+)
+
+// toIPDetails maps a stored ip result onto its graphql representation
+func toIPDetails(result ipresult.IPResult) *model.IPDetails {
+	details := &model.IPDetails{
+		CreatedAt:     result.CreatedAt,
+		UUID:          result.ID,
+		IPAddress:     result.IPAddress,
+		Provider:      result.Provider,
+		UpdatedAt:     result.UpdatedAt,
+		ResponseCode:  result.ResponseCode,
+		Codes:         []*model.ListingCode{},
+		Status:        model.LookupStatus(result.Status),
+		LastError:     result.LastError,
+		LastAttemptAt: result.LastAttemptAt,
+		Attempts:      result.Attempts,
+		TTL:           result.TTL,
+		ExpiresAt:     result.ExpiresAt(),
+	}
+
+	for _, c := range result.Codes {
+		details.Codes = append(details.Codes, &model.ListingCode{
+			Code:          c.Code,
+			List:          c.List,
+			Description:   c.Description,
+			Category:      toListingCategory(dnsbl.Category(c.Category)),
+			FirstSeenAt:   timePtr(c.FirstSeenAt),
+			LastChangedAt: timePtr(c.LastChangedAt),
+		})
+	}
+
+	return details
+}
+
+// toListingCategory maps a category onto its graphql enum, the enum's values mirror dnsbl's categories
+func toListingCategory(c dnsbl.Category) model.ListingCategory {
+	category := model.ListingCategory(c)
+	if !category.IsValid() {
+		return model.ListingCategoryOther
+	}
+
+	return category
+}
+
+// toDomainDetails maps a stored domain result onto its graphql representation
+func toDomainDetails(result domainresult.DomainResult) *model.DomainDetails {
+	return &model.DomainDetails{
+		CreatedAt:    result.CreatedAt,
+		UUID:         result.ID,
+		Domain:       result.Domain,
+		Provider:     result.Provider,
+		UpdatedAt:    result.UpdatedAt,
+		ResponseCode: result.ResponseCode,
+	}
+}
+
+// toProviders maps every provider in a registry onto its graphql representation
+func toProviders(registry dnsbl.Registry) []*model.Provider {
+	var response []*model.Provider
+
+	for _, p := range registry.Providers() {
+		mp := model.Provider{
+			Name:        p.Name(),
+			DisplayName: p.DisplayName(),
+			Codes:       []*model.ListingCode{},
+		}
+
+		for _, c := range p.Codes() {
+			mp.Codes = append(mp.Codes, &model.ListingCode{
+				Code:        c.Code,
+				List:        c.List,
+				Description: c.Description,
+				Category:    toListingCategory(c.Category),
+			})
+		}
+
+		// Codes() is a map so we sort to give clients a stable order
+		sort.Slice(mp.Codes, func(i, j int) bool { return mp.Codes[i].Code < mp.Codes[j].Code })
+
+		response = append(response, &mp)
+	}
+
+	return response
+}
+
+// toJob maps a stored job onto its graphql representation
+func toJob(j job.Job) *model.Job {
+	return &model.Job{
+		ID:         j.ID,
+		Status:     model.JobStatus(j.Status),
+		Total:      j.Total,
+		Completed:  j.Completed,
+		Failed:     j.Failed,
+		CreatedAt:  j.CreatedAt,
+		UpdatedAt:  j.UpdatedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+// toWatchedIP maps a stored watch onto its graphql representation
+func toWatchedIP(w watch.Watch) *model.WatchedIP {
+	return &model.WatchedIP{
+		IPAddress: w.IPAddress,
+		CreatedAt: w.CreatedAt,
+	}
+}
+
+// toWebhook maps a stored webhook onto its graphql representation, leaving out its secret
+func toWebhook(w webhook.Webhook) *model.Webhook {
+	events := make([]model.WebhookEvent, 0, len(w.Events))
+	for _, e := range w.Events {
+		events = append(events, model.WebhookEvent(e))
+	}
+
+	return &model.Webhook{
+		ID:        w.ID,
+		URL:       w.URL,
+		Events:    events,
+		Cidrs:     w.CIDRs,
+		CreatedAt: w.CreatedAt,
+		UpdatedAt: w.UpdatedAt,
+	}
+}
+
+// toWebhookDelivery maps a stored delivery onto its graphql representation
+func toWebhookDelivery(d webhook.Delivery) *model.WebhookDelivery {
+	return &model.WebhookDelivery{
+		ID:          d.ID,
+		WebhookID:   d.WebhookID,
+		Event:       model.WebhookEvent(d.Event),
+		Payload:     d.Payload,
+		Status:      model.WebhookDeliveryStatus(d.Status),
+		Attempts:    d.Attempts,
+		LastError:   d.LastError,
+		CreatedAt:   d.CreatedAt,
+		UpdatedAt:   d.UpdatedAt,
+		DeliveredAt: d.DeliveredAt,
+	}
+}
+
+// toStats maps computed stats onto their graphql representation
+func toStats(st stats.Stats) *model.Stats {
+	response := &model.Stats{
+		Since:     st.Since,
+		Results:   st.Results,
+		Addresses: st.Addresses,
+		Listed:    st.Listed,
+		Failing:   st.Failing,
+		Codes:     make([]*model.RangeCodeCount, 0, len(st.Codes)),
+		Buckets:   make([]*model.StatsBucket, 0, len(st.Buckets)),
+	}
+
+	if st.Results > 0 {
+		response.ErrorRate = float64(st.Failing) / float64(st.Results)
+	}
+
+	for _, c := range st.Codes {
+		response.Codes = append(response.Codes, &model.RangeCodeCount{
+			Provider: c.Provider,
+			Code:     c.Code,
+			List:     c.List,
+			Count:    c.Count,
+		})
+	}
+
+	for _, b := range st.Buckets {
+		response.Buckets = append(response.Buckets, &model.StatsBucket{
+			Start:       b.Start,
+			NewlyListed: b.NewlyListed,
+			Delisted:    b.Delisted,
+			Lookups:     b.Lookups,
+			Failed:      b.Failed,
+			ErrorRate:   b.ErrorRate(),
+		})
+	}
+
+	return response
+}
+
+// timePtr returns a pointer to a copy of t, for the nullable times of our graphql models
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
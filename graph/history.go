@@ -0,0 +1,109 @@
+package graph
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/graph/model"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+)
+
+// the number of history entries returned when first isn't given, and the most returned at once
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// historyCursorPrefix marks a history cursor so one meant for another connection is rejected rather than misread
+const historyCursorPrefix = "history:"
+
+// history pages through the history of a result, newest first
+func (r *Resolver) history(ctx context.Context, resultID string, first *int, after *string) (*model.IPHistoryConnection, error) {
+	n := defaultHistoryLimit
+	if first != nil {
+		n = *first
+	}
+
+	if n < 1 || n > maxHistoryLimit {
+		return nil, fmt.Errorf("first must be between 1 and %d", maxHistoryLimit)
+	}
+
+	var seq int
+	if after != nil {
+		var err error
+		if seq, err = decodeHistoryCursor(*after); err != nil {
+			return nil, fmt.Errorf("invalid cursor : %s", *after)
+		}
+	}
+
+	// one more than asked for tells us whether there's another page
+	entries, err := r.IPResultStore.QueryHistory(ctx, resultID, seq, n+1)
+	if err != nil {
+		return nil, errors.New("unable to retrive history")
+	}
+
+	conn := &model.IPHistoryConnection{
+		Edges:    []*model.IPHistoryEdge{},
+		PageInfo: &model.PageInfo{HasNextPage: len(entries) > n},
+	}
+
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+
+	for _, e := range entries {
+		conn.Edges = append(conn.Edges, &model.IPHistoryEdge{
+			Cursor: encodeHistoryCursor(e.Seq),
+			Node:   toIPHistoryEntry(e),
+		})
+	}
+
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.EndCursor = &conn.Edges[len(conn.Edges)-1].Cursor
+	}
+
+	return conn, nil
+}
+
+// toIPHistoryEntry maps a stored history entry onto its graphql representation
+func toIPHistoryEntry(e ipresult.HistoryEntry) *model.IPHistoryEntry {
+	entry := &model.IPHistoryEntry{
+		Status:    model.LookupStatus(e.Status),
+		Codes:     []string{},
+		ChangedAt: e.ChangedAt,
+	}
+
+	if e.ResponseCode != nil {
+		entry.Codes = strings.Split(*e.ResponseCode, ",")
+	}
+
+	return entry
+}
+
+// cursors are opaque to clients, they're the entry's number with a prefix, base64 encoded
+func encodeHistoryCursor(seq int) string {
+	return base64.StdEncoding.EncodeToString([]byte(historyCursorPrefix + strconv.Itoa(seq)))
+}
+
+func decodeHistoryCursor(cursor string) (int, error) {
+	b, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	s := string(b)
+	if !strings.HasPrefix(s, historyCursorPrefix) {
+		return 0, errors.New("not a history cursor")
+	}
+
+	seq, err := strconv.Atoi(strings.TrimPrefix(s, historyCursorPrefix))
+	if err != nil || seq < 1 {
+		return 0, errors.New("not a history cursor")
+	}
+
+	return seq, nil
+}
@@ -0,0 +1,14 @@
+package model
+
+import (
+	"time"
+)
+
+type DomainDetails struct {
+	CreatedAt    time.Time `json:"created_at"`
+	UUID         string    `json:"uuid"`
+	Domain       string    `json:"domain"`
+	Provider     string    `json:"provider"`
+	ResponseCode *string   `json:"response_code"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
@@ -5,9 +5,17 @@ import (
 )
 
 type IPDetails struct {
-	CreatedAt    time.Time `json:"created_at"`
-	UUID         string    `json:"uuid"`
-	IPAddress    string    `json:"ip_address"`
-	ResponseCode *string   `json:"response_code"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UUID          string         `json:"uuid"`
+	IPAddress     string         `json:"ip_address"`
+	Provider      string         `json:"provider"`
+	ResponseCode  *string        `json:"response_code"`
+	Codes         []*ListingCode `json:"codes"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	Status        LookupStatus   `json:"status"`
+	LastError     *string        `json:"last_error"`
+	LastAttemptAt time.Time      `json:"last_attempt_at"`
+	Attempts      int            `json:"attempts"`
+	TTL           int            `json:"ttl"`
+	ExpiresAt     time.Time      `json:"expires_at"`
 }
@@ -0,0 +1,578 @@
+// Code generated by github.com/99designs/gqlgen, DO NOT EDIT.
+
+package model
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// IPDetailsBatch is the outcome of getIPDetailsBatch. Each address given ends up in exactly one of the lists, addresses
+// given more than once, in any form, only once
+type IPDetailsBatch struct {
+	// found is the result of each address that has one, in the order the addresses were given
+	Found []*IPDetails `json:"found"`
+	// not_found is each valid address without a result from the provider, in its canonical form
+	NotFound []string `json:"not_found"`
+	// invalid is each address that isn't an ip address, as it was given
+	Invalid []string `json:"invalid"`
+}
+
+type IPHistoryConnection struct {
+	Edges    []*IPHistoryEdge `json:"edges"`
+	PageInfo *PageInfo        `json:"pageInfo"`
+}
+
+type IPHistoryEdge struct {
+	Cursor string          `json:"cursor"`
+	Node   *IPHistoryEntry `json:"node"`
+}
+
+// IPHistoryEntry is the listing of an address from one change to the next
+type IPHistoryEntry struct {
+	// status is either LISTED or NOT_LISTED, failed lookups don't change the listing
+	Status    LookupStatus `json:"status"`
+	Codes     []string     `json:"codes"`
+	ChangedAt time.Time    `json:"changed_at"`
+}
+
+type IPResultConnection struct {
+	Edges    []*IPResultEdge `json:"edges"`
+	PageInfo *PageInfo       `json:"pageInfo"`
+}
+
+type IPResultEdge struct {
+	Cursor string     `json:"cursor"`
+	Node   *IPDetails `json:"node"`
+}
+
+// IPResultFilter narrows the results of ipResults, every field given has to match
+type IPResultFilter struct {
+	// listed matches results listed under at least one code when true, and those that aren't when false
+	Listed *bool `json:"listed"`
+	// code and list match results listed under the code, ex 127.0.0.2, or under a code of the list, ex SBL
+	Code     *string `json:"code"`
+	List     *string `json:"list"`
+	Provider *string `json:"provider"`
+	// updated_after and updated_before bound updated_at, the former inclusively
+	UpdatedAfter  *time.Time `json:"updated_after"`
+	UpdatedBefore *time.Time `json:"updated_before"`
+	// cidr matches addresses within the prefix, ex 192.0.2.0/24
+	Cidr *string `json:"cidr"`
+}
+
+type IPResultOrder struct {
+	Field     IPResultOrderField `json:"field"`
+	Direction *OrderDirection    `json:"direction"`
+}
+
+// Job tracks the lookups started by a single enqueue
+type Job struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	// total is the number of lookups, one for each address and provider pair
+	Total      int        `json:"total"`
+	Completed  int        `json:"completed"`
+	Failed     int        `json:"failed"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// ListingCode is a decoded response code, ex 127.0.0.4 is the XBL list
+type ListingCode struct {
+	Code string `json:"code"`
+	// list is the list within the provider's zone the code comes from, ex SBL, CSS, XBL, PBL or DROP for spamhaus
+	List        string          `json:"list"`
+	Description string          `json:"description"`
+	Category    ListingCategory `json:"category"`
+	// first_seen_at is when the address was first listed under the code and last_changed_at when it was last listed under
+	// it again or its details changed, both are null for the codes of a provider
+	FirstSeenAt   *time.Time `json:"first_seen_at"`
+	LastChangedAt *time.Time `json:"last_changed_at"`
+}
+
+type NewWebhook struct {
+	URL string `json:"url"`
+	// secret signs each delivery, it's never returned
+	Secret string         `json:"secret"`
+	Events []WebhookEvent `json:"events"`
+	Cidrs  []string       `json:"cidrs"`
+}
+
+type PageInfo struct {
+	HasNextPage bool    `json:"hasNextPage"`
+	EndCursor   *string `json:"endCursor"`
+}
+
+type Provider struct {
+	Name        string         `json:"name"`
+	DisplayName string         `json:"display_name"`
+	Codes       []*ListingCode `json:"codes"`
+}
+
+// RangeCodeCount is the number of addresses within a range a provider lists under a code
+type RangeCodeCount struct {
+	Provider string `json:"provider"`
+	Code     string `json:"code"`
+	List     string `json:"list"`
+	Count    int    `json:"count"`
+}
+
+// RangeDetails is a page of the stored results within a CIDR prefix, ordered by address, along with a summary of every
+// result within it
+type RangeDetails struct {
+	// cidr is the prefix in its canonical form, ex 192.0.2.7/24 is 192.0.2.0/24
+	Cidr     string        `json:"cidr"`
+	Results  []*IPDetails  `json:"results"`
+	PageInfo *PageInfo     `json:"pageInfo"`
+	Summary  *RangeSummary `json:"summary"`
+}
+
+type RangeSummary struct {
+	// addresses is the number of addresses within the range with a result
+	Addresses int `json:"addresses"`
+	// listed is the number of those addresses listed by at least one provider
+	Listed int               `json:"listed"`
+	Codes  []*RangeCodeCount `json:"codes"`
+}
+
+// Stats summarizes the stored results as they stand and how they changed since a point in time
+type Stats struct {
+	Since time.Time `json:"since"`
+	// results is the number of results, one per address and provider, and addresses the number of distinct addresses.
+	// listed is the number of those addresses listed under at least one code
+	Results   int `json:"results"`
+	Addresses int `json:"addresses"`
+	Listed    int `json:"listed"`
+	// failing is the number of results whose most recent lookup failed and error_rate its fraction of results
+	Failing   int     `json:"failing"`
+	ErrorRate float64 `json:"error_rate"`
+	// codes is the number of addresses each provider currently lists under each code, the most common first
+	Codes   []*RangeCodeCount `json:"codes"`
+	Buckets []*StatsBucket    `json:"buckets"`
+}
+
+// StatsBucket is what changed over a single period, in UTC
+type StatsBucket struct {
+	Start time.Time `json:"start"`
+	// newly_listed is the number of results that went from not listed, or never looked up, to listed and delisted the
+	// number that went from listed to not listed. Moving from one code to another is neither
+	NewlyListed int `json:"newly_listed"`
+	Delisted    int `json:"delisted"`
+	// lookups and failed are the lookups finished and failed by the jobs started in the period
+	Lookups   int     `json:"lookups"`
+	Failed    int     `json:"failed"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// WatchedIP is an address the scheduler keeps checking without anyone enqueueing it
+type WatchedIP struct {
+	IPAddress string    `json:"ip_address"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Webhook is an endpoint notified of changes to listings. Each delivery is a POST of a JSON body signed with the
+// webhook's secret, the X-Indahaus-Signature header is "sha256=" and the hex HMAC-SHA256 of the X-Indahaus-Timestamp
+// header, a dot and the body
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// events and cidrs limit what the webhook is notified of, either being empty matches everything
+	Events    []WebhookEvent `json:"events"`
+	Cidrs     []string       `json:"cidrs"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+type WebhookDelivery struct {
+	ID        string       `json:"id"`
+	WebhookID string       `json:"webhook_id"`
+	Event     WebhookEvent `json:"event"`
+	// payload is the JSON body sent to the webhook
+	Payload  string                `json:"payload"`
+	Status   WebhookDeliveryStatus `json:"status"`
+	Attempts int                   `json:"attempts"`
+	// last_error is the error of the last failed attempt
+	LastError   *string    `json:"last_error"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+}
+
+type IPResultOrderField string
+
+const (
+	IPResultOrderFieldCreatedAt IPResultOrderField = "CREATED_AT"
+	IPResultOrderFieldUpdatedAt IPResultOrderField = "UPDATED_AT"
+	// IP_ADDRESS orders addresses numerically, IPv4 addresses before IPv6
+	IPResultOrderFieldIPAddress IPResultOrderField = "IP_ADDRESS"
+)
+
+var AllIPResultOrderField = []IPResultOrderField{
+	IPResultOrderFieldCreatedAt,
+	IPResultOrderFieldUpdatedAt,
+	IPResultOrderFieldIPAddress,
+}
+
+func (e IPResultOrderField) IsValid() bool {
+	switch e {
+	case IPResultOrderFieldCreatedAt, IPResultOrderFieldUpdatedAt, IPResultOrderFieldIPAddress:
+		return true
+	}
+	return false
+}
+
+func (e IPResultOrderField) String() string {
+	return string(e)
+}
+
+func (e *IPResultOrderField) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = IPResultOrderField(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid IPResultOrderField", str)
+	}
+	return nil
+}
+
+func (e IPResultOrderField) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+// JobStatus is where a job is in its lifecycle, it's COMPLETED once every lookup has finished, whether it succeeded or failed
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "QUEUED"
+	JobStatusRunning   JobStatus = "RUNNING"
+	JobStatusCompleted JobStatus = "COMPLETED"
+)
+
+var AllJobStatus = []JobStatus{
+	JobStatusQueued,
+	JobStatusRunning,
+	JobStatusCompleted,
+}
+
+func (e JobStatus) IsValid() bool {
+	switch e {
+	case JobStatusQueued, JobStatusRunning, JobStatusCompleted:
+		return true
+	}
+	return false
+}
+
+func (e JobStatus) String() string {
+	return string(e)
+}
+
+func (e *JobStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = JobStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid JobStatus", str)
+	}
+	return nil
+}
+
+func (e JobStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+// ListingCategory is the broad kind of listing a code stands for
+type ListingCategory string
+
+const (
+	ListingCategorySpam      ListingCategory = "SPAM"
+	ListingCategoryExploited ListingCategory = "EXPLOITED"
+	ListingCategoryPolicy    ListingCategory = "POLICY"
+	ListingCategoryHijacked  ListingCategory = "HIJACKED"
+	ListingCategoryPhish     ListingCategory = "PHISH"
+	ListingCategoryMalware   ListingCategory = "MALWARE"
+	ListingCategoryBotnet    ListingCategory = "BOTNET"
+	ListingCategoryNewDomain ListingCategory = "NEW_DOMAIN"
+	ListingCategoryOther     ListingCategory = "OTHER"
+)
+
+var AllListingCategory = []ListingCategory{
+	ListingCategorySpam,
+	ListingCategoryExploited,
+	ListingCategoryPolicy,
+	ListingCategoryHijacked,
+	ListingCategoryPhish,
+	ListingCategoryMalware,
+	ListingCategoryBotnet,
+	ListingCategoryNewDomain,
+	ListingCategoryOther,
+}
+
+func (e ListingCategory) IsValid() bool {
+	switch e {
+	case ListingCategorySpam, ListingCategoryExploited, ListingCategoryPolicy, ListingCategoryHijacked, ListingCategoryPhish, ListingCategoryMalware, ListingCategoryBotnet, ListingCategoryNewDomain, ListingCategoryOther:
+		return true
+	}
+	return false
+}
+
+func (e ListingCategory) String() string {
+	return string(e)
+}
+
+func (e *ListingCategory) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ListingCategory(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ListingCategory", str)
+	}
+	return nil
+}
+
+func (e ListingCategory) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+// LookupStatus is the outcome of the most recent lookup of an address. Only LISTED and NOT_LISTED mean the codes are
+// current, any other status means the lookup failed and the codes are from the last lookup that succeeded
+type LookupStatus string
+
+const (
+	LookupStatusListed              LookupStatus = "LISTED"
+	LookupStatusNotListed           LookupStatus = "NOT_LISTED"
+	LookupStatusRateLimited         LookupStatus = "RATE_LIMITED"
+	LookupStatusOpenResolverBlocked LookupStatus = "OPEN_RESOLVER_BLOCKED"
+	LookupStatusInvalidKey          LookupStatus = "INVALID_KEY"
+	LookupStatusDNSTimeout          LookupStatus = "DNS_TIMEOUT"
+	LookupStatusDNSError            LookupStatus = "DNS_ERROR"
+	LookupStatusError               LookupStatus = "ERROR"
+)
+
+var AllLookupStatus = []LookupStatus{
+	LookupStatusListed,
+	LookupStatusNotListed,
+	LookupStatusRateLimited,
+	LookupStatusOpenResolverBlocked,
+	LookupStatusInvalidKey,
+	LookupStatusDNSTimeout,
+	LookupStatusDNSError,
+	LookupStatusError,
+}
+
+func (e LookupStatus) IsValid() bool {
+	switch e {
+	case LookupStatusListed, LookupStatusNotListed, LookupStatusRateLimited, LookupStatusOpenResolverBlocked, LookupStatusInvalidKey, LookupStatusDNSTimeout, LookupStatusDNSError, LookupStatusError:
+		return true
+	}
+	return false
+}
+
+func (e LookupStatus) String() string {
+	return string(e)
+}
+
+func (e *LookupStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = LookupStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid LookupStatus", str)
+	}
+	return nil
+}
+
+func (e LookupStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type OrderDirection string
+
+const (
+	OrderDirectionAsc  OrderDirection = "ASC"
+	OrderDirectionDesc OrderDirection = "DESC"
+)
+
+var AllOrderDirection = []OrderDirection{
+	OrderDirectionAsc,
+	OrderDirectionDesc,
+}
+
+func (e OrderDirection) IsValid() bool {
+	switch e {
+	case OrderDirectionAsc, OrderDirectionDesc:
+		return true
+	}
+	return false
+}
+
+func (e OrderDirection) String() string {
+	return string(e)
+}
+
+func (e *OrderDirection) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = OrderDirection(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid OrderDirection", str)
+	}
+	return nil
+}
+
+func (e OrderDirection) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type StatsGroupBy string
+
+const (
+	StatsGroupByDay StatsGroupBy = "DAY"
+	// WEEK periods start on Monday
+	StatsGroupByWeek StatsGroupBy = "WEEK"
+)
+
+var AllStatsGroupBy = []StatsGroupBy{
+	StatsGroupByDay,
+	StatsGroupByWeek,
+}
+
+func (e StatsGroupBy) IsValid() bool {
+	switch e {
+	case StatsGroupByDay, StatsGroupByWeek:
+		return true
+	}
+	return false
+}
+
+func (e StatsGroupBy) String() string {
+	return string(e)
+}
+
+func (e *StatsGroupBy) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = StatsGroupBy(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid StatsGroupBy", str)
+	}
+	return nil
+}
+
+func (e StatsGroupBy) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+// WebhookDeliveryStatus is where a delivery is in its lifecycle, a delivery that keeps failing is retried until it's
+// out of attempts and DEAD
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryStatusPending   WebhookDeliveryStatus = "PENDING"
+	WebhookDeliveryStatusClaimed   WebhookDeliveryStatus = "CLAIMED"
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "DELIVERED"
+	WebhookDeliveryStatusDead      WebhookDeliveryStatus = "DEAD"
+)
+
+var AllWebhookDeliveryStatus = []WebhookDeliveryStatus{
+	WebhookDeliveryStatusPending,
+	WebhookDeliveryStatusClaimed,
+	WebhookDeliveryStatusDelivered,
+	WebhookDeliveryStatusDead,
+}
+
+func (e WebhookDeliveryStatus) IsValid() bool {
+	switch e {
+	case WebhookDeliveryStatusPending, WebhookDeliveryStatusClaimed, WebhookDeliveryStatusDelivered, WebhookDeliveryStatusDead:
+		return true
+	}
+	return false
+}
+
+func (e WebhookDeliveryStatus) String() string {
+	return string(e)
+}
+
+func (e *WebhookDeliveryStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = WebhookDeliveryStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid WebhookDeliveryStatus", str)
+	}
+	return nil
+}
+
+func (e WebhookDeliveryStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+// WebhookEvent is a change to a listing a webhook can be notified of. LISTED is an address being listed after it
+// wasn't, DELISTED a listed address no longer being listed and CODE_CHANGED a listed address being listed under a
+// different set of codes
+type WebhookEvent string
+
+const (
+	WebhookEventListed      WebhookEvent = "LISTED"
+	WebhookEventDelisted    WebhookEvent = "DELISTED"
+	WebhookEventCodeChanged WebhookEvent = "CODE_CHANGED"
+)
+
+var AllWebhookEvent = []WebhookEvent{
+	WebhookEventListed,
+	WebhookEventDelisted,
+	WebhookEventCodeChanged,
+}
+
+func (e WebhookEvent) IsValid() bool {
+	switch e {
+	case WebhookEventListed, WebhookEventDelisted, WebhookEventCodeChanged:
+		return true
+	}
+	return false
+}
+
+func (e WebhookEvent) String() string {
+	return string(e)
+}
+
+func (e *WebhookEvent) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = WebhookEvent(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid WebhookEvent", str)
+	}
+	return nil
+}
+
+func (e WebhookEvent) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
@@ -0,0 +1,20 @@
+package graph
+
+import (
+	"github.com/shaneu/indahaus/graph/model"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+)
+
+// toRangeSummary maps the store's summary of a range onto the graphql one, the most common codes first
+func toRangeSummary(sum ipresult.RangeSummary) *model.RangeSummary {
+	codes := make([]*model.RangeCodeCount, 0, len(sum.Codes))
+	for _, c := range sum.Codes {
+		codes = append(codes, &model.RangeCodeCount{Provider: c.Provider, Code: c.Code, List: c.List, Count: c.Count})
+	}
+
+	return &model.RangeSummary{
+		Addresses: sum.Addresses,
+		Listed:    sum.Listed,
+		Codes:     codes,
+	}
+}
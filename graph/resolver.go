@@ -1,8 +1,20 @@
 package graph
 
 import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/shaneu/indahaus/internal/data/domainresult"
 	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/stats"
+	"github.com/shaneu/indahaus/internal/data/watch"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/internal/events"
+	"github.com/shaneu/indahaus/internal/processdomains"
 	"github.com/shaneu/indahaus/internal/processips"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
 )
 
 //go:generate go run github.com/99designs/gqlgen
@@ -11,7 +23,53 @@ import (
 //
 // It serves as dependency injection for your app, add any dependencies you require here.
 
+// the number of jobs returned by the jobs query when no limit is given, and the most it will return
+const (
+	defaultJobsLimit = 20
+	maxJobsLimit     = 100
+)
+
+// the most addresses getIPDetailsBatch reads in one request
+const maxBatchSize = 10000
+
+// how often jobProgress reads the job again in case an update was missed
+const jobProgressPoll = 5 * time.Second
+
+// how far back the stats query looks when since isn't given
+const defaultStatsPeriod = 30 * 24 * time.Hour
+
+// the number of deliveries returned by the webhookDeliveries query when no limit is given, and the most it will return
+const (
+	defaultDeliveriesLimit = 20
+	maxDeliveriesLimit     = 100
+)
+
 type Resolver struct {
-	IPResultStore  ipresult.Store
-	ProcessIPStore processips.Store
+	// Background is the context work a request leaves running once it's answered is done under, it's cancelled when
+	// the api shuts down
+	Background context.Context
+	// Log is for failures the client isn't told the details of
+	Log *log.Logger
+
+	IPResultStore    ipresult.Store
+	ProcessIPStore   processips.Store
+	ProviderRegistry dnsbl.Registry
+	JobStore         job.Store
+	WatchStore       watch.Store
+	WebhookStore     webhook.Store
+	StatsStore       stats.Store
+	Events           *events.Bus
+
+	DomainResultStore      domainresult.Store
+	ProcessDomainStore     processdomains.Store
+	DomainProviderRegistry dnsbl.Registry
+}
+
+// newerJob reports whether next is further along than j, more of its lookups have finished or it's since completed
+func newerJob(next job.Job, j job.Job) bool {
+	if done, prev := next.Completed+next.Failed, j.Completed+j.Failed; done != prev {
+		return done > prev
+	}
+
+	return next.Status == job.StatusCompleted && j.Status != job.StatusCompleted
 }
@@ -0,0 +1,176 @@
+package graph
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/graph/model"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+)
+
+// the number of results returned by ipResults when first isn't given, and the most returned at once
+const (
+	defaultResultsLimit = 20
+	maxResultsLimit     = 100
+)
+
+// resultsCursorPrefix marks an ipResults cursor so one meant for another connection is rejected rather than misread
+const resultsCursorPrefix = "results:"
+
+// orderFields maps the graphql order fields onto the columns results are ordered by
+var orderFields = map[model.IPResultOrderField]string{
+	model.IPResultOrderFieldCreatedAt: ipresult.OrderCreatedAt,
+	model.IPResultOrderFieldUpdatedAt: ipresult.OrderUpdatedAt,
+	model.IPResultOrderFieldIPAddress: ipresult.OrderIPAddress,
+}
+
+// ipResults pages through the stored results matching the filter
+func (r *Resolver) ipResults(ctx context.Context, filter *model.IPResultFilter, orderBy *model.IPResultOrder, first *int,
+	after *string) (*model.IPResultConnection, error) {
+	n := defaultResultsLimit
+	if first != nil {
+		n = *first
+	}
+
+	if n < 1 || n > maxResultsLimit {
+		return nil, fmt.Errorf("first must be between 1 and %d", maxResultsLimit)
+	}
+
+	// newest first unless asked otherwise
+	order := ipresult.Order{Field: ipresult.OrderCreatedAt, Desc: true}
+	if orderBy != nil {
+		order = ipresult.Order{
+			Field: orderFields[orderBy.Field],
+			Desc:  orderBy.Direction != nil && *orderBy.Direction == model.OrderDirectionDesc,
+		}
+	}
+
+	f, err := toFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor *ipresult.Cursor
+	if after != nil {
+		c, err := decodeResultsCursor(*after, order)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor : %s", *after)
+		}
+		cursor = &c
+	}
+
+	// one more than asked for tells us whether there's another page
+	results, err := r.IPResultStore.QueryPage(ctx, f, order, cursor, n+1)
+	if err != nil {
+		return nil, errors.New("unable to retrive results")
+	}
+
+	conn := &model.IPResultConnection{
+		Edges:    []*model.IPResultEdge{},
+		PageInfo: &model.PageInfo{HasNextPage: len(results) > n},
+	}
+
+	if len(results) > n {
+		results = results[:n]
+	}
+
+	for _, res := range results {
+		conn.Edges = append(conn.Edges, &model.IPResultEdge{
+			Cursor: encodeResultsCursor(order, order.Cursor(res)),
+			Node:   toIPDetails(res),
+		})
+	}
+
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.EndCursor = &conn.Edges[len(conn.Edges)-1].Cursor
+	}
+
+	return conn, nil
+}
+
+// toFilter maps the graphql filter onto the store's
+func toFilter(filter *model.IPResultFilter) (ipresult.Filter, error) {
+	var f ipresult.Filter
+	if filter == nil {
+		return f, nil
+	}
+
+	f.Listed = filter.Listed
+	f.UpdatedAfter = filter.UpdatedAfter
+	f.UpdatedBefore = filter.UpdatedBefore
+
+	if filter.Code != nil {
+		f.Code = *filter.Code
+	}
+	if filter.List != nil {
+		f.List = *filter.List
+	}
+	if filter.Provider != nil {
+		f.Provider = *filter.Provider
+	}
+	if filter.Cidr != nil {
+		_, n, err := net.ParseCIDR(*filter.Cidr)
+		if err != nil {
+			return f, fmt.Errorf("invalid cidr : %s", *filter.Cidr)
+		}
+		f.CIDR = n
+	}
+
+	return f, nil
+}
+
+// cursors are opaque to clients, they're the order along with the result's id and its value of the field ordered by,
+// base64 encoded. The order is kept so a cursor can't be used with an order it doesn't belong to
+func encodeResultsCursor(o ipresult.Order, c ipresult.Cursor) string {
+	value := c.Time.UTC().Format(time.RFC3339Nano)
+	if o.Field == ipresult.OrderIPAddress {
+		value = hex.EncodeToString(c.IPKey)
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(resultsCursorPrefix + orderKey(o) + ":" + c.ID + ":" + value))
+}
+
+func decodeResultsCursor(cursor string, o ipresult.Order) (ipresult.Cursor, error) {
+	b, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return ipresult.Cursor{}, err
+	}
+
+	prefix := resultsCursorPrefix + orderKey(o) + ":"
+	s := string(b)
+	if !strings.HasPrefix(s, prefix) {
+		return ipresult.Cursor{}, errors.New("not a cursor of the order")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, prefix), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return ipresult.Cursor{}, errors.New("not a results cursor")
+	}
+
+	c := ipresult.Cursor{ID: parts[0]}
+	if o.Field == ipresult.OrderIPAddress {
+		c.IPKey, err = hex.DecodeString(parts[1])
+	} else {
+		c.Time, err = time.Parse(time.RFC3339Nano, parts[1])
+	}
+	if err != nil {
+		return ipresult.Cursor{}, err
+	}
+
+	return c, nil
+}
+
+// orderKey names an order within a cursor, ex created_at:desc
+func orderKey(o ipresult.Order) string {
+	if o.Desc {
+		return o.Field + ":desc"
+	}
+
+	return o.Field + ":asc"
+}
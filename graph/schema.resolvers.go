@@ -6,37 +6,366 @@ package graph
 import (
 	"context"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/shaneu/indahaus/graph/generated"
 	"github.com/shaneu/indahaus/graph/model"
+	"github.com/shaneu/indahaus/internal/data/domainresult"
 	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/stats"
+	"github.com/shaneu/indahaus/internal/data/webhook"
 	"github.com/shaneu/indahaus/internal/mid"
+	"github.com/shaneu/indahaus/internal/processips"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
 )
 
-func (r *mutationResolver) Enqueue(ctx context.Context, ip []string) ([]string, error) {
+func (r *iPDetailsResolver) History(ctx context.Context, obj *model.IPDetails, first *int, after *string) (*model.IPHistoryConnection, error) {
+	return r.history(ctx, obj.UUID, first, after)
+}
+
+func (r *mutationResolver) Enqueue(ctx context.Context, ip []string, force *bool) (*model.Job, error) {
 	v := ctx.Value(mid.RequestValueKey).(*mid.RequestValues)
 
+	// prefixes are expanded to their addresses, bounded together so a typo like /8 for /28, or many prefixes each
+	// under the limit, is rejected rather than queueing millions of lookups
+	ips := make([]string, 0, len(ip))
+	var expandedTotal int
 	for _, a := range ip {
+		if r.ProcessIPStore.IsCIDR(a) {
+			expanded, err := r.ProcessIPStore.ExpandCIDR(a)
+			if err != nil {
+				switch errors.Cause(err) {
+				case processips.ErrInvalidCIDR:
+					return nil, fmt.Errorf("invalid cidr : %s", a)
+				case processips.ErrRangeTooLarge:
+					return nil, fmt.Errorf("cidr covers too many addresses : %s", a)
+				}
+
+				return nil, errors.New("unable to expand cidr")
+			}
+
+			if expandedTotal += len(expanded); expandedTotal > r.ProcessIPStore.MaxRangeSize() {
+				return nil, fmt.Errorf("cidrs cover too many addresses, at most %d", r.ProcessIPStore.MaxRangeSize())
+			}
+
+			ips = append(ips, expanded...)
+			continue
+		}
+
+		if !r.ProcessIPStore.IsValid(a) {
+			return nil, fmt.Errorf("invalid ip : %s", a)
+		}
+
+		// the canonical form of each address is the form results are stored and looked up under
+		ips = append(ips, net.ParseIP(a).String())
+	}
+
+	j, err := r.JobStore.Create(ctx, job.NewJob{Total: r.ProcessIPStore.Lookups(ips)}, time.Now())
+	if err != nil {
+		return nil, errors.New("unable to create job")
+	}
+
+	// The lookups are queued and made in the background by the processips workers. They're queued in a single
+	// transaction so when that fails there's nothing queued against the job and it's removed
+	if err := r.ProcessIPStore.Enqueue(ctx, j.ID, ips, force != nil && *force); err != nil {
+		// removed even when the enqueue failed because the request was cancelled
+		if err := r.JobStore.Delete(trace.WithID(r.Background, v.TraceID), j.ID); err != nil {
+			r.Log.Printf("%s : ERROR    : job.Delete %s %v", v.TraceID, j.ID, err)
+		}
+		return nil, errors.New("unable to enqueue lookups")
+	}
+
+	return toJob(j), nil
+}
+
+func (r *mutationResolver) EnqueueDomains(ctx context.Context, domains []string) ([]string, error) {
+	// respond with the canonical form of each domain, the form results are stored and looked up under. Domains that
+	// are the same once canonical, ex Example.com and example.com, are only looked up once
+	canonical := make([]string, 0, len(domains))
+	seen := make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		c, err := dnsbl.CanonicalDomain(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain : %s", d)
+		}
+
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		canonical = append(canonical, c)
+	}
+	domains = canonical
+
+	// Fire and forget ProcessDomains to let it run in the background. The request's context is cancelled as soon as
+	// we respond so the lookups carry its trace under the api's background context instead
+	go r.ProcessDomainStore.ProcessDomains(trace.WithID(r.Background, trace.ID(ctx)), domains)
+
+	return domains, nil
+}
+
+func (r *mutationResolver) Watch(ctx context.Context, ip []string) ([]string, error) {
+	for i, a := range ip {
+		if !r.ProcessIPStore.IsValid(a) {
+			return nil, fmt.Errorf("invalid ip : %s", a)
+		}
+
+		// an address no provider checks, ex an IPv6 address when none are enabled for IPv6, would be scheduled forever
+		// without ever getting a result
+		if r.ProcessIPStore.Lookups([]string{a}) == 0 {
+			return nil, fmt.Errorf("no provider checks ip : %s", a)
+		}
+
+		ip[i] = net.ParseIP(a).String()
+	}
+
+	if err := r.WatchStore.Add(ctx, ip, time.Now()); err != nil {
+		return nil, errors.New("unable to watch ips")
+	}
+
+	return ip, nil
+}
+
+func (r *mutationResolver) Unwatch(ctx context.Context, ip []string) ([]string, error) {
+	for i, a := range ip {
 		if !r.ProcessIPStore.IsValid(a) {
 			return nil, fmt.Errorf("invalid ip : %s", a)
 		}
+
+		ip[i] = net.ParseIP(a).String()
 	}
 
-	// Fire and forget ProcessIPs to let it run in the background
-	go r.ProcessIPStore.ProcessIPs(ip, v.TraceID)
+	if err := r.WatchStore.Remove(ctx, ip); err != nil {
+		return nil, errors.New("unable to unwatch ips")
+	}
 
 	return ip, nil
 }
 
-func (r *queryResolver) GetIPDetails(ctx context.Context, ip string) (*model.IPDetails, error) {
+func (r *mutationResolver) CreateWebhook(ctx context.Context, input model.NewWebhook) (*model.Webhook, error) {
+	v := ctx.Value(mid.RequestValueKey).(*mid.RequestValues)
+
+	nw := webhook.NewWebhook{
+		URL:    input.URL,
+		Secret: input.Secret,
+		Events: make([]string, 0, len(input.Events)),
+		CIDRs:  input.Cidrs,
+	}
+	for _, e := range input.Events {
+		nw.Events = append(nw.Events, string(e))
+	}
+
+	w, err := r.WebhookStore.Create(v.TraceID, nw, time.Now())
+	if err != nil {
+		switch errors.Cause(err) {
+		case webhook.ErrInvalidURL, webhook.ErrInvalidCIDR, webhook.ErrInvalidEvent, webhook.ErrNoSecret:
+			return nil, fmt.Errorf("invalid webhook : %v", err)
+		}
+
+		return nil, errors.New("unable to create webhook")
+	}
+
+	return toWebhook(w), nil
+}
+
+func (r *mutationResolver) DeleteWebhook(ctx context.Context, id string) (string, error) {
 	v := ctx.Value(mid.RequestValueKey).(*mid.RequestValues)
 
+	if err := r.WebhookStore.Delete(v.TraceID, id); err != nil {
+		switch errors.Cause(err) {
+		case webhook.ErrNotFound:
+			return "", fmt.Errorf("webhook not found : %s", id)
+		case webhook.ErrInvalidID:
+			return "", fmt.Errorf("invalid webhook id : %s", id)
+		}
+
+		return "", errors.New("unable to delete webhook")
+	}
+
+	return id, nil
+}
+
+func (r *mutationResolver) RedeliverWebhookDelivery(ctx context.Context, id string) (*model.WebhookDelivery, error) {
+	v := ctx.Value(mid.RequestValueKey).(*mid.RequestValues)
+
+	d, err := r.WebhookStore.Redeliver(v.TraceID, id, time.Now())
+	if err != nil {
+		switch errors.Cause(err) {
+		case webhook.ErrNotFound:
+			return nil, fmt.Errorf("no dead delivery found : %s", id)
+		case webhook.ErrInvalidID:
+			return nil, fmt.Errorf("invalid delivery id : %s", id)
+		}
+
+		return nil, errors.New("unable to redeliver delivery")
+	}
+
+	return toWebhookDelivery(d), nil
+}
+
+func (r *queryResolver) GetIPDetails(ctx context.Context, ip string, provider *string) (*model.IPDetails, error) {
+	if !r.ProcessIPStore.IsValid(ip) {
+		return nil, fmt.Errorf("invalid ip : %s", ip)
+	}
+
+	p := r.ProviderRegistry.Default()
+	if provider != nil {
+		var ok bool
+		if p, ok = r.ProviderRegistry.Provider(*provider); !ok {
+			return nil, fmt.Errorf("unknown provider : %s", *provider)
+		}
+	}
+
+	result, err := r.IPResultStore.QueryByIP(ctx, ip, p.Name())
+	if err != nil {
+		if errors.Cause(err) == ipresult.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, errors.New("unable to retrive details")
+	}
+
+	return toIPDetails(result), nil
+}
+
+func (r *queryResolver) GetAllIPDetails(ctx context.Context, ip string) ([]*model.IPDetails, error) {
+	if !r.ProcessIPStore.IsValid(ip) {
+		return nil, fmt.Errorf("invalid ip : %s", ip)
+	}
+
+	results, err := r.IPResultStore.QueryAllByIP(ctx, ip)
+	if err != nil {
+		return nil, errors.New("unable to retrive details")
+	}
+
+	response := make([]*model.IPDetails, 0, len(results))
+	for _, result := range results {
+		response = append(response, toIPDetails(result))
+	}
+
+	return response, nil
+}
+
+func (r *queryResolver) GetIPDetailsBatch(ctx context.Context, ips []string, provider *string) (*model.IPDetailsBatch, error) {
+	if len(ips) > maxBatchSize {
+		return nil, fmt.Errorf("at most %d ips can be read at once", maxBatchSize)
+	}
+
+	p := r.ProviderRegistry.Default()
+	if provider != nil {
+		var ok bool
+		if p, ok = r.ProviderRegistry.Provider(*provider); !ok {
+			return nil, fmt.Errorf("unknown provider : %s", *provider)
+		}
+	}
+
+	response := &model.IPDetailsBatch{
+		Found:    []*model.IPDetails{},
+		NotFound: []string{},
+		Invalid:  []string{},
+	}
+
+	// split out the invalid addresses so one typo doesn't fail the batch, and read each address once however many
+	// times and in whatever form it was given
+	var valid []string
+	seen := make(map[string]struct{}, len(ips))
+	for _, a := range ips {
+		key := a
+		if addr := net.ParseIP(a); addr != nil {
+			key = addr.String()
+		}
+
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		if !r.ProcessIPStore.IsValid(a) {
+			response.Invalid = append(response.Invalid, a)
+			continue
+		}
+		valid = append(valid, key)
+	}
+
+	results, err := r.IPResultStore.QueryByIPs(ctx, valid, p.Name())
+	if err != nil {
+		return nil, errors.New("unable to retrive details")
+	}
+
+	for _, ip := range valid {
+		result, ok := results[ip]
+		if !ok {
+			response.NotFound = append(response.NotFound, ip)
+			continue
+		}
+		response.Found = append(response.Found, toIPDetails(result))
+	}
+
+	return response, nil
+}
+
+func (r *queryResolver) GetRangeDetails(ctx context.Context, cidr string, provider *string, first *int, after *string) (*model.RangeDetails, error) {
+	if provider != nil {
+		if _, ok := r.ProviderRegistry.Provider(*provider); !ok {
+			return nil, fmt.Errorf("unknown provider : %s", *provider)
+		}
+	}
+
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr : %s", cidr)
+	}
+
+	// the results are read a page at a time by address, the ip_key range of the prefix, rather than expanding the
+	// prefix into its addresses so a prefix of any size can be read
+	filter := &model.IPResultFilter{Cidr: &cidr, Provider: provider}
+	order := &model.IPResultOrder{Field: model.IPResultOrderFieldIPAddress}
+	conn, err := r.ipResults(ctx, filter, order, first, after)
+	if err != nil {
+		return nil, err
+	}
+
+	var p string
+	if provider != nil {
+		p = *provider
+	}
+
+	sum, err := r.IPResultStore.SummarizeRange(ctx, n, p)
+	if err != nil {
+		return nil, errors.New("unable to retrive details")
+	}
+
+	response := &model.RangeDetails{
+		Cidr:     n.String(),
+		Results:  make([]*model.IPDetails, 0, len(conn.Edges)),
+		PageInfo: conn.PageInfo,
+		Summary:  toRangeSummary(sum),
+	}
+	for _, edge := range conn.Edges {
+		response.Results = append(response.Results, edge.Node)
+	}
+
+	return response, nil
+}
+
+func (r *queryResolver) GetIPHistory(ctx context.Context, ip string, provider *string, first *int, after *string) (*model.IPHistoryConnection, error) {
 	if !r.ProcessIPStore.IsValid(ip) {
 		return nil, fmt.Errorf("invalid ip : %s", ip)
 	}
 
-	result, err := r.IPResultStore.QueryByIP(v.TraceID, ip)
+	p := r.ProviderRegistry.Default()
+	if provider != nil {
+		var ok bool
+		if p, ok = r.ProviderRegistry.Provider(*provider); !ok {
+			return nil, fmt.Errorf("unknown provider : %s", *provider)
+		}
+	}
+
+	result, err := r.IPResultStore.QueryByIP(ctx, ip, p.Name())
 	if err != nil {
 		if errors.Cause(err) == ipresult.ErrNotFound {
 			return nil, nil
@@ -45,22 +374,307 @@ func (r *queryResolver) GetIPDetails(ctx context.Context, ip string) (*model.IPD
 		return nil, errors.New("unable to retrive details")
 	}
 
-	response := model.IPDetails{
-		CreatedAt:    result.CreatedAt,
-		UUID:         result.ID,
-		IPAddress:    result.IPAddress,
-		UpdatedAt:    result.UpdatedAt,
-		ResponseCode: result.ResponseCode,
+	return r.history(ctx, result.ID, first, after)
+}
+
+func (r *queryResolver) IPResults(ctx context.Context, filter *model.IPResultFilter, orderBy *model.IPResultOrder, first *int, after *string) (*model.IPResultConnection, error) {
+	return r.ipResults(ctx, filter, orderBy, first, after)
+}
+
+func (r *queryResolver) Providers(ctx context.Context) ([]*model.Provider, error) {
+	return toProviders(r.ProviderRegistry), nil
+}
+
+func (r *queryResolver) GetDomainDetails(ctx context.Context, domain string, provider *string) (*model.DomainDetails, error) {
+	if !r.ProcessDomainStore.IsValid(domain) {
+		return nil, fmt.Errorf("invalid domain : %s", domain)
+	}
+
+	p := r.DomainProviderRegistry.Default()
+	if provider != nil {
+		var ok bool
+		if p, ok = r.DomainProviderRegistry.Provider(*provider); !ok {
+			return nil, fmt.Errorf("unknown provider : %s", *provider)
+		}
+	}
+
+	result, err := r.DomainResultStore.QueryByDomain(ctx, domain, p.Name())
+	if err != nil {
+		if errors.Cause(err) == domainresult.ErrNotFound {
+			return nil, nil
+		}
+
+		return nil, errors.New("unable to retrive details")
+	}
+
+	return toDomainDetails(result), nil
+}
+
+func (r *queryResolver) GetAllDomainDetails(ctx context.Context, domain string) ([]*model.DomainDetails, error) {
+	if !r.ProcessDomainStore.IsValid(domain) {
+		return nil, fmt.Errorf("invalid domain : %s", domain)
+	}
+
+	results, err := r.DomainResultStore.QueryAllByDomain(ctx, domain)
+	if err != nil {
+		return nil, errors.New("unable to retrive details")
+	}
+
+	response := make([]*model.DomainDetails, 0, len(results))
+	for _, result := range results {
+		response = append(response, toDomainDetails(result))
+	}
+
+	return response, nil
+}
+
+func (r *queryResolver) DomainProviders(ctx context.Context) ([]*model.Provider, error) {
+	return toProviders(r.DomainProviderRegistry), nil
+}
+
+func (r *queryResolver) Job(ctx context.Context, id string) (*model.Job, error) {
+	j, err := r.JobStore.QueryByID(ctx, id)
+	if err != nil {
+		switch errors.Cause(err) {
+		case job.ErrNotFound:
+			return nil, nil
+		case job.ErrInvalidID:
+			return nil, fmt.Errorf("invalid job id : %s", id)
+		}
+
+		return nil, errors.New("unable to retrive job")
+	}
+
+	return toJob(j), nil
+}
+
+func (r *queryResolver) Jobs(ctx context.Context, limit *int) ([]*model.Job, error) {
+	n := defaultJobsLimit
+	if limit != nil {
+		n = *limit
+	}
+
+	if n < 1 || n > maxJobsLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxJobsLimit)
+	}
+
+	jobs, err := r.JobStore.Query(ctx, n)
+	if err != nil {
+		return nil, errors.New("unable to retrive jobs")
+	}
+
+	response := make([]*model.Job, 0, len(jobs))
+	for _, j := range jobs {
+		response = append(response, toJob(j))
+	}
+
+	return response, nil
+}
+
+func (r *queryResolver) WatchedIPs(ctx context.Context) ([]*model.WatchedIP, error) {
+	watches, err := r.WatchStore.Query(ctx)
+	if err != nil {
+		return nil, errors.New("unable to retrive watched ips")
+	}
+
+	response := make([]*model.WatchedIP, 0, len(watches))
+	for _, w := range watches {
+		response = append(response, toWatchedIP(w))
+	}
+
+	return response, nil
+}
+
+func (r *queryResolver) Stats(ctx context.Context, since *time.Time, groupBy *model.StatsGroupBy) (*model.Stats, error) {
+	v := ctx.Value(mid.RequestValueKey).(*mid.RequestValues)
+
+	now := time.Now()
+
+	from := now.Add(-defaultStatsPeriod)
+	if since != nil {
+		from = *since
+	}
+
+	period := stats.GroupByDay
+	if groupBy != nil {
+		period = string(*groupBy)
+	}
+
+	st, err := r.StatsStore.Query(v.TraceID, from, now, period)
+	if err != nil {
+		if errors.Cause(err) == stats.ErrTooManyBuckets {
+			return nil, errors.New("since is too long ago for the period, group by a longer one")
+		}
+
+		return nil, errors.New("unable to compute stats")
+	}
+
+	return toStats(st), nil
+}
+
+func (r *queryResolver) Webhooks(ctx context.Context) ([]*model.Webhook, error) {
+	v := ctx.Value(mid.RequestValueKey).(*mid.RequestValues)
+
+	hooks, err := r.WebhookStore.Query(v.TraceID)
+	if err != nil {
+		return nil, errors.New("unable to retrive webhooks")
+	}
+
+	response := make([]*model.Webhook, 0, len(hooks))
+	for _, w := range hooks {
+		response = append(response, toWebhook(w))
+	}
+
+	return response, nil
+}
+
+func (r *queryResolver) WebhookDeliveries(ctx context.Context, webhookID string, status *model.WebhookDeliveryStatus, limit *int) ([]*model.WebhookDelivery, error) {
+	v := ctx.Value(mid.RequestValueKey).(*mid.RequestValues)
+
+	n := defaultDeliveriesLimit
+	if limit != nil {
+		n = *limit
+	}
+
+	if n < 1 || n > maxDeliveriesLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxDeliveriesLimit)
+	}
+
+	var st string
+	if status != nil {
+		st = string(*status)
+	}
+
+	deliveries, err := r.WebhookStore.QueryDeliveries(v.TraceID, webhookID, st, n)
+	if err != nil {
+		if errors.Cause(err) == webhook.ErrInvalidID {
+			return nil, fmt.Errorf("invalid webhook id : %s", webhookID)
+		}
+
+		return nil, errors.New("unable to retrive webhook deliveries")
+	}
+
+	response := make([]*model.WebhookDelivery, 0, len(deliveries))
+	for _, d := range deliveries {
+		response = append(response, toWebhookDelivery(d))
+	}
+
+	return response, nil
+}
+
+func (r *subscriptionResolver) IPResultUpdated(ctx context.Context, ips []string) (<-chan *model.IPDetails, error) {
+	for i, a := range ips {
+		if !r.ProcessIPStore.IsValid(a) {
+			return nil, fmt.Errorf("invalid ip : %s", a)
+		}
+
+		// results are published under the canonical form of each address
+		ips[i] = net.ParseIP(a).String()
+	}
+
+	results, unsubscribe := r.Events.SubscribeIPResults(ips)
+
+	ch := make(chan *model.IPDetails)
+	go func() {
+		defer close(ch)
+		defer unsubscribe()
+
+		for {
+			select {
+			case result := <-results:
+				select {
+				case ch <- toIPDetails(result):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (r *subscriptionResolver) JobProgress(ctx context.Context, jobID string) (<-chan *model.Job, error) {
+	// subscribe before looking the job up so no update lands in between
+	updates, unsubscribe := r.Events.SubscribeJob(jobID)
+
+	j, err := r.JobStore.QueryByID(ctx, jobID)
+	if err != nil {
+		unsubscribe()
+
+		switch errors.Cause(err) {
+		case job.ErrNotFound:
+			return nil, fmt.Errorf("unknown job : %s", jobID)
+		case job.ErrInvalidID:
+			return nil, fmt.Errorf("invalid job id : %s", jobID)
+		}
+
+		return nil, errors.New("unable to retrive job")
 	}
 
-	return &response, nil
+	ch := make(chan *model.Job)
+	go func() {
+		defer close(ch)
+		defer unsubscribe()
+
+		// the job is also read again every jobProgressPoll, so the subscription still follows it and ends once it's
+		// completed should an update never arrive
+		poll := time.NewTicker(jobProgressPoll)
+		defer poll.Stop()
+
+		select {
+		case ch <- toJob(j):
+		case <-ctx.Done():
+			return
+		}
+
+		for j.Status != job.StatusCompleted {
+			var next job.Job
+			select {
+			case next = <-updates:
+			case <-poll.C:
+				stored, err := r.JobStore.QueryByID(ctx, jobID)
+				if err != nil {
+					continue
+				}
+				next = stored
+			case <-ctx.Done():
+				return
+			}
+
+			// updates are published as lookups finish concurrently so they can arrive out of order, skip any
+			// older than what's already been sent
+			if !newerJob(next, j) {
+				continue
+			}
+			j = next
+
+			select {
+			case ch <- toJob(j):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
 }
 
+// IPDetails returns generated.IPDetailsResolver implementation.
+func (r *Resolver) IPDetails() generated.IPDetailsResolver { return &iPDetailsResolver{r} }
+
 // Mutation returns generated.MutationResolver implementation.
 func (r *Resolver) Mutation() generated.MutationResolver { return &mutationResolver{r} }
 
 // Query returns generated.QueryResolver implementation.
 func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
 
+// Subscription returns generated.SubscriptionResolver implementation.
+func (r *Resolver) Subscription() generated.SubscriptionResolver { return &subscriptionResolver{r} }
+
+type iPDetailsResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
+type subscriptionResolver struct{ *Resolver }
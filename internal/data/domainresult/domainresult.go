@@ -0,0 +1,145 @@
+package domainresult
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+)
+
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrInvalidDomain = errors.New("domain is not in its proper form")
+)
+
+type Store struct {
+	log *log.Logger
+	db  *sqlx.DB
+}
+
+// New returns a configured Store
+func New(log *log.Logger, db *sqlx.DB) Store {
+	return Store{
+		log: log,
+		db:  db,
+	}
+}
+
+// Create inserts a new row into the db. Domains are stored in their canonical form, lower case without a
+// trailing dot, so Example.COM. and example.com map to a single row
+func (s Store) Create(ctx context.Context, newDomain NewDomainResult, now time.Time) (DomainResult, error) {
+	domain, err := dnsbl.CanonicalDomain(newDomain.Domain)
+	if err != nil {
+		return DomainResult{}, ErrInvalidDomain
+	}
+
+	domRes := DomainResult{
+		CreatedAt:    now.UTC(),
+		ID:           uuid.New().String(),
+		Domain:       domain,
+		Provider:     newDomain.Provider,
+		ResponseCode: newDomain.ResponseCode,
+		UpdatedAt:    now.UTC(),
+	}
+
+	const q = `INSERT INTO domain_results
+		(id, created_at, updated_at, domain, provider, response_code)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	s.log.Printf("%s : query : %s %s domainresult.Create", trace.ID(ctx), domRes.Domain, domRes.Provider)
+
+	if _, err := s.db.ExecContext(ctx, q, domRes.ID, domRes.CreatedAt, domRes.UpdatedAt, domRes.Domain, domRes.Provider, domRes.ResponseCode); err != nil {
+		return DomainResult{}, errors.Wrap(err, "inserting domainresult")
+	}
+
+	return domRes, nil
+}
+
+// AddOrUpdate adds or updates the row for a domain and provider, returning the row as written. The row is written
+// with a single upsert so concurrent lookups of the same domain can't both miss it and race to insert it, whichever
+// comes second updates the row the first created. The id and created_at of an existing row are kept
+func (s Store) AddOrUpdate(ctx context.Context, domain string, provider string, uDomain UpdateDomainResult, now time.Time) (DomainResult, error) {
+	domain, err := dnsbl.CanonicalDomain(domain)
+	if err != nil {
+		return DomainResult{}, ErrInvalidDomain
+	}
+
+	const q = `INSERT INTO domain_results
+		(id, created_at, updated_at, domain, provider, response_code)
+		VALUES ($1, $2, $2, $3, $4, $5)
+		ON CONFLICT (domain, provider) DO UPDATE SET
+		"updated_at" = excluded.updated_at, "response_code" = excluded.response_code`
+
+	s.log.Printf("%s : query : %s %s domainresult.AddOrUpdate", trace.ID(ctx), domain, provider)
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return DomainResult{}, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, q, uuid.New().String(), now.UTC(), domain, provider, uDomain.ResponseCode); err != nil {
+		return DomainResult{}, errors.Wrap(err, "upserting domainresult")
+	}
+
+	// read back within the transaction rather than with RETURNING which sqlite can't scan times from
+	var domRes DomainResult
+	const sel = `SELECT * FROM domain_results WHERE domain = $1 AND provider = $2`
+	if err := tx.GetContext(ctx, &domRes, sel, domain, provider); err != nil {
+		return DomainResult{}, errors.Wrapf(err, "selecting domain %q", domain)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return DomainResult{}, errors.Wrap(err, "committing domainresult")
+	}
+
+	return domRes, nil
+}
+
+// QueryByDomain finds the row for a domain from a single provider
+func (s Store) QueryByDomain(ctx context.Context, domain string, provider string) (DomainResult, error) {
+	domain, err := dnsbl.CanonicalDomain(domain)
+	if err != nil {
+		return DomainResult{}, ErrInvalidDomain
+	}
+
+	const q = `SELECT * FROM domain_results WHERE domain = $1 AND provider = $2`
+
+	s.log.Printf("%s : query : %s %s domainresult.QueryByDomain", trace.ID(ctx), domain, provider)
+
+	var domRes DomainResult
+	if err := s.db.GetContext(ctx, &domRes, q, domain, provider); err != nil {
+		if err == sql.ErrNoRows {
+			return DomainResult{}, ErrNotFound
+		}
+
+		return DomainResult{}, errors.Wrapf(err, "selecting domain %q", domain)
+	}
+
+	return domRes, nil
+}
+
+// QueryAllByDomain finds the rows for a domain from every provider it has been checked against
+func (s Store) QueryAllByDomain(ctx context.Context, domain string) ([]DomainResult, error) {
+	domain, err := dnsbl.CanonicalDomain(domain)
+	if err != nil {
+		return nil, ErrInvalidDomain
+	}
+
+	const q = `SELECT * FROM domain_results WHERE domain = $1 ORDER BY provider`
+
+	s.log.Printf("%s : query : %s domainresult.QueryAllByDomain", trace.ID(ctx), domain)
+
+	var domRes []DomainResult
+	if err := s.db.SelectContext(ctx, &domRes, q, domain); err != nil {
+		return nil, errors.Wrapf(err, "selecting domain %q", domain)
+	}
+
+	return domRes, nil
+}
@@ -0,0 +1,209 @@
+package domainresult_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jmoiron/sqlx"
+	"github.com/shaneu/indahaus/internal/data/domainresult"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000", tempFile.Name()),
+	}
+
+	// see ipresult_test.go, we test against a real database rather than a mock
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+func TestDomainResult(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to work with Domain Result records.")
+	// ============================================================================
+	// Setup: create a domainresult store
+	s := domainresult.New(log, db)
+
+	testID := 0
+
+	t.Logf("\tTest %d:\tWhen inserting a domain result.", testID)
+	// ============================================================================
+	// Create a domain result
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+	ctx := trace.WithID(context.Background(), traceID)
+	provider := "spamhaus-dbl"
+
+	codes := "127.0.1.2"
+	newDomain := domainresult.NewDomainResult{
+		Domain:       "Example.COM.",
+		Provider:     provider,
+		ResponseCode: &codes,
+	}
+
+	domRes, err := s.Create(ctx, newDomain, now)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to create domain result : %s.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to create domain result.", success, testID)
+
+	if domRes.Domain != "example.com" {
+		t.Fatalf("\t%s\tTest %d:\tShould store the canonical domain : %s.", failure, testID, domRes.Domain)
+	}
+	t.Logf("\t%s\tTest %d:\tShould store the canonical domain.", success, testID)
+
+	// ============================================================================
+	// Query by domain
+	saved, err := s.QueryByDomain(ctx, "EXAMPLE.com", provider)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to retrieve result by domain: %s.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to retrieve record by domain.", success, testID)
+
+	if diff := cmp.Diff(domRes, saved); diff != "" {
+		t.Fatalf("\t%s\tTest %d:\tShould get back the same domain result. Diff:\n %s.", failure, testID, diff)
+	}
+	t.Logf("\t%s\tTest %d:\tShould get back the same domain result.", success, testID)
+
+	// ============================================================================
+	// AddOrUpdate (Update original row)
+	upd := domainresult.UpdateDomainResult{}
+	if _, err := s.AddOrUpdate(ctx, "example.com", provider, upd, now); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to add or update (update) : %s.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to add or update (update).", success, testID)
+
+	// ============================================================================
+	// AddOrUpdate (Add) for a second provider
+	code := "127.0.2.5"
+	upd = domainresult.UpdateDomainResult{
+		ResponseCode: &code,
+	}
+	if _, err := s.AddOrUpdate(ctx, "example.com", "spamhaus-zrd", upd, now); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to add or update (add) : %s.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to add or update (add).", success, testID)
+
+	all, err := s.QueryAllByDomain(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to retrieve results for every provider : %s.", failure, testID, err)
+	}
+
+	if len(all) != 2 || all[0].ResponseCode != nil || all[1].ResponseCode == nil || *all[1].ResponseCode != code {
+		t.Fatalf("\t%s\tTest %d:\tShould get back one result per provider : %+v.", failure, testID, all)
+	}
+	t.Logf("\t%s\tTest %d:\tShould get back one result per provider.", success, testID)
+
+	// ============================================================================
+	// Invalid domains
+	if _, err := s.QueryByDomain(ctx, "127.0.0.1", provider); err != domainresult.ErrInvalidDomain {
+		t.Fatalf("\t%s\tTest %d:\tShould reject an IP address as a domain : %v.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould reject an IP address as a domain.", success, testID)
+}
+
+func TestAddOrUpdateConcurrent(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to write the same domain from many lookups at once.")
+	s := domainresult.New(log, db)
+
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+	ctx := trace.WithID(context.Background(), traceID)
+	provider := "spamhaus-dbl"
+
+	const writers = 20
+
+	type write struct {
+		res domainresult.DomainResult
+		err error
+	}
+
+	results := make(chan write, writers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			res, err := s.AddOrUpdate(ctx, "Example.com", provider, domainresult.UpdateDomainResult{}, now)
+			results <- write{res, err}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen %d writers hammer one domain.", testID, writers)
+	{
+		ids := make(map[string]bool)
+		for w := range results {
+			if w.err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to add or update : %s.", failure, testID, w.err)
+			}
+			ids[w.res.ID] = true
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to write every time.", success, testID)
+
+		if len(ids) != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould write to the same row every time : got ids %v.", failure, testID, ids)
+		}
+		t.Logf("\t%s\tTest %d:\tShould write to the same row every time.", success, testID)
+
+		var n int
+		if err := db.Get(&n, `SELECT COUNT(*) FROM domain_results WHERE domain = $1`, "example.com"); err != nil {
+			t.Fatalf("unable to count results %v", err)
+		}
+		if n != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould store a single row : got %d.", failure, testID, n)
+		}
+		t.Logf("\t%s\tTest %d:\tShould store a single row.", success, testID)
+	}
+}
@@ -0,0 +1,29 @@
+package domainresult
+
+import (
+	"time"
+)
+
+// A complete DomainResult
+type DomainResult struct {
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	ID        string    `db:"id" json:"id"`
+	Domain    string    `db:"domain" json:"domain"`
+	// Provider is the name of the dnsbl provider the result came from
+	Provider string `db:"provider" json:"provider"`
+	// Storing response code as a pointer to represent nil when a domain has zero codes
+	ResponseCode *string   `db:"response_code" json:"response_code"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// The subset of fields necessary to construct a DomainResult
+type NewDomainResult struct {
+	Domain       string  `db:"domain" json:"domain"`
+	Provider     string  `db:"provider" json:"provider"`
+	ResponseCode *string `db:"response_code" json:"response_code"`
+}
+
+// The subset of fields necessary to update a DomainResult
+type UpdateDomainResult struct {
+	ResponseCode *string `db:"response_code" json:"response_code"`
+}
@@ -0,0 +1,88 @@
+package ipresult
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/pkg/errors"
+)
+
+// cache holds the most recently read results in memory, keyed by address and provider. Writes made through the
+// Store remove the result they change so it's read from the db again next time. Writes made by other processes
+// sharing the db can't, so a result is only served from memory for ttl after it was read
+type cache struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+	ttl time.Duration
+	// gen is bumped on every write. A read only caches what it found when no write happened since it started, so a
+	// result read just before a write can't be cached after the write removed it
+	gen uint64
+}
+
+type cacheKey struct {
+	ip       string
+	provider string
+}
+
+// cacheEntry is a cached result along with when it was read from the db
+type cacheEntry struct {
+	res    IPResult
+	readAt time.Time
+}
+
+func newCache(size int, ttl time.Duration) (*cache, error) {
+	l, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating lru")
+	}
+
+	return &cache{lru: l, ttl: ttl}, nil
+}
+
+// get returns the cached result, if any, and the generation to pass to add when it isn't cached
+func (c *cache) get(ip string, provider string) (IPResult, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey{ip, provider}
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return IPResult{}, c.gen, false
+	}
+
+	e := v.(cacheEntry)
+	if time.Since(e.readAt) >= c.ttl {
+		c.lru.Remove(key)
+		return IPResult{}, c.gen, false
+	}
+
+	// hand out a copy of the codes so a caller changing them doesn't change the cached result
+	res := e.res
+	if res.Codes != nil {
+		res.Codes = append([]Code(nil), res.Codes...)
+	}
+
+	return res, c.gen, true
+}
+
+// add caches a result read from the db at readAt, unless it was written to since gen
+func (c *cache) add(gen uint64, res IPResult, readAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	c.lru.Add(cacheKey{res.IPAddress, res.Provider}, cacheEntry{res: res, readAt: readAt})
+}
+
+// remove drops the cached result of an address and provider that's about to change
+func (c *cache) remove(ip string, provider string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.lru.Remove(cacheKey{ip, provider})
+}
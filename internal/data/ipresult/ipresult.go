@@ -1,14 +1,19 @@
 package ipresult
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/trace"
 )
 
 var (
@@ -16,9 +21,18 @@ var (
 	ErrInvalidIP = errors.New("IP is not in its proper form")
 )
 
+// defaultCacheTTL is how long NewCached keeps a result in memory when it isn't given a ttl
+const defaultCacheTTL = 10 * time.Second
+
+// queryChunkSize is the most addresses or ids bound to a single IN query, well under the bind variable limits of the
+// databases we run on
+const queryChunkSize = 500
+
 type Store struct {
 	log *log.Logger
 	db  *sqlx.DB
+	// cache is nil unless the Store was made with NewCached
+	cache *cache
 }
 
 // New returns a configured Store
@@ -29,81 +43,316 @@ func New(log *log.Logger, db *sqlx.DB) Store {
 	}
 }
 
-// Create inserts a new row into the db
-func (s Store) Create(traceID string, newIP NewIPResult, now time.Time) (IPResult, error) {
+// NewCached returns a Store that keeps up to size of the results read by QueryByIP in memory, each for up to ttl. The
+// cache only sees writes made through the returned Store, and copies of it, so a process should share a single Store
+// rather than make one per caller. Writes made by other processes sharing the db, such as other replicas on postgres,
+// are seen once the ttl of the result cached before them runs out. A ttl of zero or less falls back to defaultCacheTTL
+func NewCached(log *log.Logger, db *sqlx.DB, size int, ttl time.Duration) (Store, error) {
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+
+	c, err := newCache(size, ttl)
+	if err != nil {
+		return Store{}, err
+	}
+
+	s := New(log, db)
+	s.cache = c
+
+	return s, nil
+}
+
+// Create inserts a new row into the db. Addresses are stored in their canonical form so the same IPv6 address
+// written two different ways, ex 2001:DB8:0:0::1 and 2001:db8::1, maps to a single row
+func (s Store) Create(ctx context.Context, newIP NewIPResult, now time.Time) (IPResult, error) {
+	addr := net.ParseIP(newIP.IPAddress)
+	if addr == nil {
+		return IPResult{}, ErrInvalidIP
+	}
+
 	ipRes := IPResult{
-		CreatedAt:    now.UTC(),
-		ID:           uuid.New().String(),
-		IPAddress:    newIP.IPAddress,
-		ResponseCode: newIP.ResponseCode,
-		UpdatedAt:    now.UTC(),
+		CreatedAt:     now.UTC(),
+		ID:            uuid.New().String(),
+		IPAddress:     addr.String(),
+		Provider:      newIP.Provider,
+		ResponseCode:  newIP.ResponseCode,
+		UpdatedAt:     now.UTC(),
+		Status:        newIP.Status,
+		LastError:     newIP.LastError,
+		LastAttemptAt: now.UTC(),
+		Attempts:      newIP.Attempts,
+		TTL:           newIP.TTL,
+		IPKey:         addr.To16(),
+	}
+	ipRes.Codes = withResultID(newIP.Codes, ipRes.ID)
+
+	if ipRes.Status == "" {
+		ipRes.Status = listingStatus(ipRes.ResponseCode, ipRes.Codes)
 	}
 
 	// we're writing our sql statements by hand rather than leverage some abstraction like an ORM. At this
 	// point in the projects lifecycle it will aid debugging and maintanice to not prematurely reach for an abstraction
 	// even if it means we write a little more code by hand
 	const q = `INSERT INTO ip_results
-		(id, created_at, updated_at, ip_address, response_code)	
-		VALUES ($1, $2, $3, $4, $5)`
+		(id, created_at, updated_at, ip_address, provider, response_code, status, last_error, last_attempt_at, attempts, ttl,
+		ip_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+	s.log.Printf("%s : query : %s %s ipresult.Create", trace.ID(ctx), ipRes.IPAddress, newIP.Provider)
 
-	s.log.Printf("%s : query : %s ipresult.Create", traceID, newIP.IPAddress)
+	// the row and its codes are written together so a reader never sees one without the other
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return IPResult{}, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
 
-	if _, err := s.db.Exec(q, ipRes.ID, ipRes.CreatedAt, ipRes.UpdatedAt, ipRes.IPAddress, ipRes.ResponseCode); err != nil {
+	if _, err := tx.ExecContext(ctx, q, ipRes.ID, ipRes.CreatedAt, ipRes.UpdatedAt, ipRes.IPAddress, ipRes.Provider, ipRes.ResponseCode,
+		ipRes.Status, ipRes.LastError, ipRes.LastAttemptAt, ipRes.Attempts, ipRes.TTL, ipRes.IPKey); err != nil {
 		return IPResult{}, errors.Wrap(err, "inserting ipresult")
 	}
 
+	if ipRes.Codes, _, _, err = syncCodes(ctx, tx, ipRes.ID, ipRes.Codes, now); err != nil {
+		return IPResult{}, err
+	}
+
+	if _, err := recordHistory(ctx, tx, ipRes, now); err != nil {
+		return IPResult{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return IPResult{}, errors.Wrap(err, "committing ipresult")
+	}
+	s.invalidate(ipRes.IPAddress, ipRes.Provider)
+
 	return ipRes, nil
 }
 
-// AddOrUpdate adds or, you guessed it, updates a row
-func (s Store) AddOrUpdate(traceID string, ip string, uIP UpdateIPResult, now time.Time) (IPResult, error) {
-	ipRes, err := s.QueryByIP(traceID, ip)
+// AddOrUpdate adds or, you guessed it, updates the row for an ip address and provider, returning the row as written
+// along with whether it was created, changed or left unchanged, see OutcomeCreated. The row is written with a single
+// upsert so concurrent writes of the same address can't both miss it and race to insert it, whichever comes second
+// updates the row the first created. The id and created_at of an existing row are kept
+func (s Store) AddOrUpdate(ctx context.Context, ip string, provider string, uIP UpdateIPResult, now time.Time) (IPResult, string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return IPResult{}, "", ErrInvalidIP
+	}
+
+	s.log.Printf("%s : query : %s %s ipresult.AddOrUpdate", trace.ID(ctx), addr.String(), provider)
+
+	// the row, its codes and its history are written together so a reader never sees one without the others
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
-		if errors.Cause(err) != ErrNotFound {
-			return IPResult{}, err
-		}
+		return IPResult{}, "", errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
 
-		nIP := NewIPResult{
-			IPAddress:    ip,
-			ResponseCode: uIP.ResponseCode,
+	u, err := upsert(ctx, tx, addr, provider, uIP, now)
+	if err != nil {
+		return IPResult{}, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return IPResult{}, "", errors.Wrap(err, "committing ipresult")
+	}
+	s.invalidate(u.IPResult.IPAddress, u.IPResult.Provider)
+
+	return u.IPResult, u.Outcome, nil
+}
+
+// AddOrUpdateMany makes each of the upserts as AddOrUpdate would, all in a single transaction, and returns what they
+// wrote in the same order along with the codes each row was listed under before. Writing many results at once takes the database's write lock once rather than once per
+// result. If any upsert fails none of them are written
+func (s Store) AddOrUpdateMany(ctx context.Context, upserts []Upsert, now time.Time) ([]Upserted, error) {
+	addrs := make([]net.IP, len(upserts))
+	for i, u := range upserts {
+		if addrs[i] = net.ParseIP(u.IPAddress); addrs[i] == nil {
+			return nil, ErrInvalidIP
 		}
+	}
 
-		created, err := s.Create(traceID, nIP, now)
-		if err != nil {
-			return IPResult{}, errors.Wrap(err, "addOrUpdate")
+	if len(upserts) == 0 {
+		return nil, nil
+	}
+
+	s.log.Printf("%s : query : %d ipresult.AddOrUpdateMany", trace.ID(ctx), len(upserts))
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	out := make([]Upserted, len(upserts))
+	for i, u := range upserts {
+		if out[i], err = upsert(ctx, tx, addrs[i], u.Provider, u.Update, now); err != nil {
+			return nil, errors.Wrapf(err, "%s %s", u.IPAddress, u.Provider)
 		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "committing ipresults")
+	}
+
+	for _, u := range out {
+		s.invalidate(u.IPResult.IPAddress, u.IPResult.Provider)
+	}
+
+	return out, nil
+}
+
+// upsert writes the row for an address and provider along with its codes and history, see AddOrUpdate
+func upsert(ctx context.Context, tx *sqlx.Tx, addr net.IP, provider string, uIP UpdateIPResult, now time.Time) (Upserted, error) {
+	id := uuid.New().String()
+	status := listingStatus(uIP.ResponseCode, uIP.Codes)
+
+	const q = `INSERT INTO ip_results
+		(id, created_at, updated_at, ip_address, provider, response_code, status, last_error, last_attempt_at, attempts, ttl,
+		ip_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULL, $8, $9, $10, $11)
+		ON CONFLICT (ip_address, provider) DO UPDATE SET
+		"updated_at" = excluded.updated_at, "response_code" = excluded.response_code, "status" = excluded.status,
+		"last_error" = NULL, "last_attempt_at" = excluded.last_attempt_at, "attempts" = excluded.attempts,
+		"ttl" = excluded.ttl`
+
+	if _, err := tx.ExecContext(ctx, q, id, now.UTC(), now.UTC(), addr.String(), provider, uIP.ResponseCode, status, now.UTC(),
+		uIP.Attempts, uIP.TTL, []byte(addr.To16())); err != nil {
+		return Upserted{}, errors.Wrap(err, "upserting ipresult")
+	}
+
+	// read back within the transaction, which holds the row until it commits, rather than with RETURNING which sqlite
+	// can't scan times from
+	var ipRes IPResult
+	const sel = `SELECT * FROM ip_results WHERE ip_address = $1 AND provider = $2`
+	if err := tx.GetContext(ctx, &ipRes, sel, addr.String(), provider); err != nil {
+		return Upserted{}, errors.Wrap(err, "selecting ipresult")
+	}
+
+	codes, prev, codesChanged, err := syncCodes(ctx, tx, ipRes.ID, withResultID(uIP.Codes, ipRes.ID), now)
+	if err != nil {
+		return Upserted{}, err
+	}
+	ipRes.Codes = codes
+
+	recorded, err := recordHistory(ctx, tx, ipRes, now)
+	if err != nil {
+		return Upserted{}, err
+	}
+
+	// the id we made up only sticks when there was no row to conflict with
+	outcome := OutcomeUnchanged
+	switch {
+	case ipRes.ID == id:
+		outcome = OutcomeCreated
+	case codesChanged || recorded:
+		outcome = OutcomeChanged
+	}
+
+	return Upserted{IPResult: ipRes, Outcome: outcome, Previous: prev}, nil
+}
+
+// RecordFailure records a lookup of an ip address that failed. The codes of an existing row are left as they are,
+// along with updated_at and ttl, since they're still the latest we know of. Only the status, error, attempts and
+// attempt time change. Like AddOrUpdate the row is written with a single upsert, an address without a row gets one
+// with no codes
+func (s Store) RecordFailure(ctx context.Context, ip string, provider string, f FailedLookup, now time.Time) (IPResult, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return IPResult{}, ErrInvalidIP
+	}
+	ip = addr.String()
+
+	msg := f.Err.Error()
+
+	const q = `INSERT INTO ip_results
+		(id, created_at, updated_at, ip_address, provider, response_code, status, last_error, last_attempt_at, attempts, ttl,
+		ip_key)
+		VALUES ($1, $2, $2, $3, $4, NULL, $5, $6, $2, $7, 0, $8)
+		ON CONFLICT (ip_address, provider) DO UPDATE SET
+		"status" = excluded.status, "last_error" = excluded.last_error, "last_attempt_at" = excluded.last_attempt_at,
+		"attempts" = excluded.attempts`
+
+	s.log.Printf("%s : query : %s %s ipresult.RecordFailure", trace.ID(ctx), ip, provider)
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return IPResult{}, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, q, uuid.New().String(), now.UTC(), ip, provider, f.Status, msg, f.Attempts,
+		[]byte(addr.To16())); err != nil {
+		return IPResult{}, errors.Wrap(err, "recording failure")
+	}
+
+	// read back within the transaction, see upsert
+	var ipRes IPResult
+	const sel = `SELECT * FROM ip_results WHERE ip_address = $1 AND provider = $2`
+	if err := tx.GetContext(ctx, &ipRes, sel, ip, provider); err != nil {
+		return IPResult{}, errors.Wrap(err, "selecting ipresult")
+	}
+
+	const codes = `SELECT * FROM ip_result_codes WHERE ip_result_id = $1 AND removed_at IS NULL ORDER BY code`
+	if err := tx.SelectContext(ctx, &ipRes.Codes, codes, ipRes.ID); err != nil {
+		return IPResult{}, errors.Wrap(err, "selecting codes")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return IPResult{}, errors.Wrap(err, "committing ipresult")
+	}
+	s.invalidate(ip, provider)
+
+	return ipRes, nil
+}
 
-		return created, nil
+// QueryByIP finds the row for an ip address from a single provider. When the Store has a cache the row is served
+// from it if it's there
+func (s Store) QueryByIP(ctx context.Context, ip string, provider string) (IPResult, error) {
+	if s.cache == nil {
+		return s.queryByIP(ctx, ip, provider)
 	}
 
-	ipRes.UpdatedAt = now.UTC()
-	ipRes.ResponseCode = uIP.ResponseCode
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return IPResult{}, ErrInvalidIP
+	}
 
-	const q = `UPDATE ip_results SET "updated_at" = $1, "response_code" = $2 WHERE ip_address = $3`
+	// a cancelled caller gets the same answer from the cache as from the db
+	if err := ctx.Err(); err != nil {
+		return IPResult{}, err
+	}
 
-	s.log.Printf("%s : query : %s ipresult.Update", traceID, ip)
+	ipRes, gen, ok := s.cache.get(addr.String(), provider)
+	if ok {
+		return ipRes, nil
+	}
 
-	if _, err := s.db.Exec(q, ipRes.UpdatedAt, ipRes.ResponseCode, ip); err != nil {
-		return IPResult{}, errors.Wrap(err, "updating ipresult")
+	// misses aren't cached, an address nobody has enqueued isn't hot
+	readAt := time.Now()
+	ipRes, err := s.queryByIP(ctx, ip, provider)
+	if err != nil {
+		return IPResult{}, err
 	}
+	s.cache.add(gen, ipRes, readAt)
 
 	return ipRes, nil
 }
 
-// QueryByIP finds a row by the ip address
-func (s Store) QueryByIP(traceID string, ip string) (IPResult, error) {
+// queryByIP finds the row for an ip address from a single provider in the db
+func (s Store) queryByIP(ctx context.Context, ip string, provider string) (IPResult, error) {
 	// we're leveraging net.ParseIP to do our IP validation
 	addr := net.ParseIP(ip)
 	if addr == nil {
 		return IPResult{}, ErrInvalidIP
 	}
 
-	const q = `SELECT * FROM ip_results WHERE ip_address = $1`
+	const q = `SELECT * FROM ip_results WHERE ip_address = $1 AND provider = $2`
 
-	s.log.Printf("%s : query : %s ipresult.QueryByIP", traceID, ip)
+	s.log.Printf("%s : query : %s %s ipresult.QueryByIP", trace.ID(ctx), ip, provider)
 
 	var ipRes IPResult
-	if err := s.db.Get(&ipRes, q, addr.String()); err != nil {
+	if err := s.db.GetContext(ctx, &ipRes, q, addr.String(), provider); err != nil {
 		if err == sql.ErrNoRows {
 			return IPResult{}, ErrNotFound
 		}
@@ -111,5 +360,538 @@ func (s Store) QueryByIP(traceID string, ip string) (IPResult, error) {
 		return IPResult{}, errors.Wrapf(err, "selecting ip address %q", addr.String())
 	}
 
+	codes, err := s.queryCodes(ctx, ipRes.ID)
+	if err != nil {
+		return IPResult{}, err
+	}
+	ipRes.Codes = codes[ipRes.ID]
+
 	return ipRes, nil
 }
+
+// QueryAllByIP finds the rows for an ip address from every provider it has been checked against
+func (s Store) QueryAllByIP(ctx context.Context, ip string) ([]IPResult, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, ErrInvalidIP
+	}
+
+	const q = `SELECT * FROM ip_results WHERE ip_address = $1 ORDER BY provider`
+
+	s.log.Printf("%s : query : %s ipresult.QueryAllByIP", trace.ID(ctx), ip)
+
+	var ipRes []IPResult
+	if err := s.db.SelectContext(ctx, &ipRes, q, addr.String()); err != nil {
+		return nil, errors.Wrapf(err, "selecting ip address %q", addr.String())
+	}
+
+	ids := make([]string, len(ipRes))
+	for i := range ipRes {
+		ids[i] = ipRes[i].ID
+	}
+
+	codes, err := s.queryCodes(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ipRes {
+		ipRes[i].Codes = codes[ipRes[i].ID]
+	}
+
+	return ipRes, nil
+}
+
+// QueryByIPs finds the rows for many ip addresses from a single provider, keyed by the canonical form of each address.
+// Addresses without a row are left out of the map. The addresses are read in chunks so any number of them costs a
+// handful of queries rather than one each
+func (s Store) QueryByIPs(ctx context.Context, ips []string, provider string) (map[string]IPResult, error) {
+	s.log.Printf("%s : query : %d %s ipresult.QueryByIPs", trace.ID(ctx), len(ips), provider)
+
+	rows, err := s.queryByIPs(ctx, ips, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]IPResult, len(rows))
+	for _, r := range rows {
+		results[r.IPAddress] = r
+	}
+
+	return results, nil
+}
+
+// QueryAllByIPs finds the rows for many ip addresses from every provider they have been checked against, in the
+// order the addresses were given then by provider. Addresses without a row are left out
+func (s Store) QueryAllByIPs(ctx context.Context, ips []string) ([]IPResult, error) {
+	s.log.Printf("%s : query : %d ipresult.QueryAllByIPs", trace.ID(ctx), len(ips))
+
+	rows, err := s.queryByIPs(ctx, ips, "")
+	if err != nil {
+		return nil, err
+	}
+
+	order := make(map[string]int, len(ips))
+	for i, ip := range ips {
+		if addr := net.ParseIP(ip); addr != nil {
+			if _, ok := order[addr.String()]; !ok {
+				order[addr.String()] = i
+			}
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].IPAddress != rows[j].IPAddress {
+			return order[rows[i].IPAddress] < order[rows[j].IPAddress]
+		}
+		return rows[i].Provider < rows[j].Provider
+	})
+
+	return rows, nil
+}
+
+// queryByIPs reads the rows of the addresses from the provider, or every provider when it's empty, in chunks of
+// queryChunkSize addresses
+func (s Store) queryByIPs(ctx context.Context, ips []string, provider string) ([]IPResult, error) {
+	canonical := make([]string, 0, len(ips))
+	seen := make(map[string]struct{}, len(ips))
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return nil, ErrInvalidIP
+		}
+
+		if _, ok := seen[addr.String()]; ok {
+			continue
+		}
+		seen[addr.String()] = struct{}{}
+		canonical = append(canonical, addr.String())
+	}
+
+	var results []IPResult
+	for start := 0; start < len(canonical); start += queryChunkSize {
+		end := start + queryChunkSize
+		if end > len(canonical) {
+			end = len(canonical)
+		}
+
+		q, args, err := sqlx.In(`SELECT * FROM ip_results WHERE (? = '' OR provider = ?) AND ip_address IN (?)`,
+			provider, provider, canonical[start:end])
+		if err != nil {
+			return nil, errors.Wrap(err, "building ipresults query")
+		}
+
+		var rows []IPResult
+		if err := s.db.SelectContext(ctx, &rows, s.db.Rebind(q), args...); err != nil {
+			return nil, errors.Wrap(err, "selecting ip addresses")
+		}
+
+		ids := make([]string, len(rows))
+		for i := range rows {
+			ids[i] = rows[i].ID
+		}
+
+		codes, err := s.queryCodes(ctx, ids...)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range rows {
+			rows[i].Codes = codes[rows[i].ID]
+		}
+		results = append(results, rows...)
+	}
+
+	return results, nil
+}
+
+// QueryPage returns up to limit results matching the filter in the given order, starting after the cursor when
+// it isn't nil. Paging by cursor rather than offset keeps pages stable while results are written, a result created
+// after the first page is read doesn't shift the rest along. Ordered by updated_at, a result looked up again while
+// paging moves and may be seen twice or not at all
+func (s Store) QueryPage(ctx context.Context, f Filter, o Order, after *Cursor, limit int) ([]IPResult, error) {
+	var column string
+	switch o.Field {
+	case OrderCreatedAt, OrderUpdatedAt:
+		column = o.Field
+	case OrderIPAddress:
+		column = "ip_key"
+	default:
+		return nil, errors.Errorf("unknown order %q", o.Field)
+	}
+
+	var where []string
+	var args []interface{}
+
+	if f.Listed != nil {
+		listed := `EXISTS (SELECT 1 FROM ip_result_codes c WHERE c.ip_result_id = r.id AND c.removed_at IS NULL)`
+		if !*f.Listed {
+			listed = "NOT " + listed
+		}
+		where = append(where, listed)
+	}
+	if f.Code != "" {
+		where = append(where, `r.id IN (SELECT ip_result_id FROM ip_result_codes WHERE code = ? AND removed_at IS NULL)`)
+		args = append(args, f.Code)
+	}
+	if f.List != "" {
+		where = append(where, `r.id IN (SELECT ip_result_id FROM ip_result_codes WHERE list = ? AND removed_at IS NULL)`)
+		args = append(args, f.List)
+	}
+	if f.Provider != "" {
+		where = append(where, `r.provider = ?`)
+		args = append(args, f.Provider)
+	}
+	if f.UpdatedAfter != nil {
+		where = append(where, `r.updated_at >= ?`)
+		args = append(args, f.UpdatedAfter.UTC())
+	}
+	if f.UpdatedBefore != nil {
+		where = append(where, `r.updated_at < ?`)
+		args = append(args, f.UpdatedBefore.UTC())
+	}
+	if f.CIDR != nil {
+		lo, hi := keyRange(f.CIDR)
+		where = append(where, `r.ip_key BETWEEN ? AND ?`)
+		args = append(args, lo, hi)
+	}
+
+	cmp, dir := ">", "ASC"
+	if o.Desc {
+		cmp, dir = "<", "DESC"
+	}
+
+	if after != nil {
+		var key interface{} = after.Time.UTC()
+		if o.Field == OrderIPAddress {
+			key = after.IPKey
+		}
+		where = append(where, fmt.Sprintf(`(r.%[1]s %[2]s ? OR (r.%[1]s = ? AND r.id %[2]s ?))`, column, cmp))
+		args = append(args, key, key, after.ID)
+	}
+
+	q := `SELECT r.* FROM ip_results r`
+	if len(where) > 0 {
+		q += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	q += fmt.Sprintf(` ORDER BY r.%[1]s %[2]s, r.id %[2]s LIMIT ?`, column, dir)
+	args = append(args, limit)
+
+	s.log.Printf("%s : query : %s ipresult.QueryPage", trace.ID(ctx), o.Field)
+
+	results := []IPResult{}
+	if err := s.db.SelectContext(ctx, &results, s.db.Rebind(q), args...); err != nil {
+		return nil, errors.Wrap(err, "selecting ip results")
+	}
+
+	ids := make([]string, len(results))
+	for i := range results {
+		ids[i] = results[i].ID
+	}
+
+	codes, err := s.queryCodes(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		results[i].Codes = codes[results[i].ID]
+	}
+
+	return results, nil
+}
+
+// SummarizeRange counts the results within the prefix from the provider, or every provider when it's empty, and how
+// many are listed under each code, the most common codes first. The counts are made by the database so a prefix of
+// any size can be summarized without reading its results
+func (s Store) SummarizeRange(ctx context.Context, n *net.IPNet, provider string) (RangeSummary, error) {
+	lo, hi := keyRange(n)
+
+	s.log.Printf("%s : query : %s %s ipresult.SummarizeRange", trace.ID(ctx), n, provider)
+
+	const q = `SELECT
+		COUNT(DISTINCT r.ip_address) AS addresses,
+		COUNT(DISTINCT CASE WHEN EXISTS (
+			SELECT 1 FROM ip_result_codes c WHERE c.ip_result_id = r.id AND c.removed_at IS NULL
+		) THEN r.ip_address END) AS listed
+		FROM ip_results r
+		WHERE r.ip_key BETWEEN $1 AND $2 AND ($3 = '' OR r.provider = $3)`
+
+	var sum RangeSummary
+	if err := s.db.GetContext(ctx, &sum, q, lo, hi, provider); err != nil {
+		return RangeSummary{}, errors.Wrap(err, "counting range")
+	}
+
+	// a code belongs to a single list so the list is the same for every row of a code
+	const codes = `SELECT r.provider, c.code, MAX(c.list) AS list, COUNT(*) AS count
+		FROM ip_results r
+		JOIN ip_result_codes c ON c.ip_result_id = r.id AND c.removed_at IS NULL
+		WHERE r.ip_key BETWEEN $1 AND $2 AND ($3 = '' OR r.provider = $3)
+		GROUP BY r.provider, c.code
+		ORDER BY count DESC, r.provider, c.code`
+
+	sum.Codes = []RangeCode{}
+	if err := s.db.SelectContext(ctx, &sum.Codes, codes, lo, hi, provider); err != nil {
+		return RangeSummary{}, errors.Wrap(err, "counting range codes")
+	}
+
+	return sum, nil
+}
+
+// QueryStale returns up to limit addresses due to be checked again, those whose results were last attempted before
+// cutoff, oldest first. Only the results of the given providers count, those of a provider that's since been disabled
+// are never looked up again so they'd keep an address stale forever. Addresses with a lookup already queued aren't
+// due. Watched addresses are always considered, including those never looked up which come first, the others only
+// when watchedOnly is false. The attempt time is used rather than updated_at so a lookup that keeps failing waits its
+// turn rather than being retried every time
+func (s Store) QueryStale(ctx context.Context, providers []string, cutoff time.Time, watchedOnly bool, limit int) ([]string, error) {
+	if len(providers) == 0 {
+		return []string{}, nil
+	}
+
+	s.log.Printf("%s : query : %s ipresult.QueryStale", trace.ID(ctx), cutoff.UTC().Format(time.RFC3339))
+
+	q, args, err := sqlx.In(`SELECT a.ip_address FROM (
+			SELECT ip_address FROM watched_ips
+			UNION
+			SELECT ip_address FROM ip_results WHERE NOT ?
+		) a
+		LEFT JOIN ip_results r ON r.ip_address = a.ip_address AND r.provider IN (?)
+		WHERE NOT EXISTS (SELECT 1 FROM queue_items q WHERE q.ip_address = a.ip_address)
+		GROUP BY a.ip_address
+		HAVING MIN(r.last_attempt_at) IS NULL OR MIN(r.last_attempt_at) < ?
+		ORDER BY MIN(r.last_attempt_at) NULLS FIRST, a.ip_address
+		LIMIT ?`, watchedOnly, providers, cutoff.UTC(), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "building stale query")
+	}
+
+	ips := []string{}
+	if err := s.db.SelectContext(ctx, &ips, s.db.Rebind(q), args...); err != nil {
+		return nil, errors.Wrap(err, "selecting stale addresses")
+	}
+
+	return ips, nil
+}
+
+// QueryHistory returns up to limit of the changes to a result's listing, newest first, starting after the entry
+// numbered after. An after of zero starts at the newest
+func (s Store) QueryHistory(ctx context.Context, resultID string, after int, limit int) ([]HistoryEntry, error) {
+	const q = `SELECT * FROM ip_result_history WHERE ip_result_id = $1 AND ($2 = 0 OR seq < $2)
+		ORDER BY seq DESC LIMIT $3`
+
+	s.log.Printf("%s : query : %s ipresult.QueryHistory", trace.ID(ctx), resultID)
+
+	entries := []HistoryEntry{}
+	if err := s.db.SelectContext(ctx, &entries, q, resultID, after, limit); err != nil {
+		return nil, errors.Wrapf(err, "selecting history of %q", resultID)
+	}
+
+	return entries, nil
+}
+
+// queryCodes loads the codes of the given results, keyed by result id
+func (s Store) queryCodes(ctx context.Context, ids ...string) (map[string][]Code, error) {
+	codes := make(map[string][]Code, len(ids))
+	if len(ids) == 0 {
+		return codes, nil
+	}
+
+	q, args, err := sqlx.In(`SELECT * FROM ip_result_codes WHERE ip_result_id IN (?) AND removed_at IS NULL ORDER BY code`, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "building codes query")
+	}
+
+	var rows []Code
+	if err := s.db.SelectContext(ctx, &rows, s.db.Rebind(q), args...); err != nil {
+		return nil, errors.Wrap(err, "selecting codes")
+	}
+
+	for _, c := range rows {
+		codes[c.IPResultID] = append(codes[c.IPResultID], c)
+	}
+
+	return codes, nil
+}
+
+// invalidate drops the cached row of an address and provider once it's been written to
+func (s Store) invalidate(ip string, provider string) {
+	if s.cache != nil {
+		s.cache.remove(ip, provider)
+	}
+}
+
+// syncCodes brings the codes of a result in line with the given set, returning them with their timestamps, the codes
+// the result was listed under before and whether any of them changed. Codes that are gone are marked removed rather than deleted so they keep when they were
+// first seen if they come back
+func syncCodes(ctx context.Context, tx *sqlx.Tx, id string, codes []Code, now time.Time) ([]Code, []Code, bool, error) {
+	var existing []Code
+	const sel = `SELECT * FROM ip_result_codes WHERE ip_result_id = $1 ORDER BY code`
+	if err := tx.SelectContext(ctx, &existing, sel, id); err != nil {
+		return nil, nil, false, errors.Wrap(err, "selecting codes")
+	}
+
+	var before []Code
+	prev := make(map[string]Code, len(existing))
+	for _, c := range existing {
+		prev[c.Code] = c
+		if c.RemovedAt == nil {
+			before = append(before, c)
+		}
+	}
+
+	const ins = `INSERT INTO ip_result_codes
+		(ip_result_id, code, list, description, category, first_seen_at, last_changed_at, removed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULL)`
+
+	const upd = `UPDATE ip_result_codes SET
+		"list" = $1, "description" = $2, "category" = $3, "last_changed_at" = $4, "removed_at" = NULL
+		WHERE ip_result_id = $5 AND code = $6`
+
+	var out []Code
+	var changed bool
+	for _, c := range codes {
+		c.IPResultID = id
+		c.RemovedAt = nil
+
+		p, ok := prev[c.Code]
+		delete(prev, c.Code)
+
+		if !ok {
+			c.FirstSeenAt = now.UTC()
+			c.LastChangedAt = now.UTC()
+
+			if _, err := tx.ExecContext(ctx, ins, id, c.Code, c.List, c.Description, c.Category, c.FirstSeenAt, c.LastChangedAt); err != nil {
+				return nil, nil, false, errors.Wrap(err, "inserting code")
+			}
+			changed = true
+
+			out = append(out, c)
+			continue
+		}
+
+		c.FirstSeenAt = p.FirstSeenAt
+		c.LastChangedAt = p.LastChangedAt
+		if p.RemovedAt != nil || p.List != c.List || p.Description != c.Description || p.Category != c.Category {
+			c.LastChangedAt = now.UTC()
+			changed = true
+		}
+
+		if _, err := tx.ExecContext(ctx, upd, c.List, c.Description, c.Category, c.LastChangedAt, id, c.Code); err != nil {
+			return nil, nil, false, errors.Wrap(err, "updating code")
+		}
+
+		out = append(out, c)
+	}
+
+	for _, p := range prev {
+		if p.RemovedAt != nil {
+			continue
+		}
+
+		const q = `UPDATE ip_result_codes SET "last_changed_at" = $1, "removed_at" = $1 WHERE ip_result_id = $2 AND code = $3`
+		if _, err := tx.ExecContext(ctx, q, now.UTC(), id, p.Code); err != nil {
+			return nil, nil, false, errors.Wrap(err, "removing code")
+		}
+		changed = true
+	}
+
+	// the same order they're read back in
+	sort.Slice(out, func(i, j int) bool { return out[i].Code < out[j].Code })
+
+	return out, before, changed, nil
+}
+
+// recordHistory adds an entry to the result's history when its listing differs from the latest entry, reporting
+// whether it did. Only successful lookups change the listing, a failed one leaves it as it was
+func recordHistory(ctx context.Context, tx *sqlx.Tx, ipRes IPResult, now time.Time) (bool, error) {
+	if ipRes.Status != StatusListed && ipRes.Status != StatusNotListed {
+		return false, nil
+	}
+
+	responseCode := sortedCodes(ipRes.ResponseCode)
+
+	var latest HistoryEntry
+	err := tx.GetContext(ctx, &latest, `SELECT * FROM ip_result_history WHERE ip_result_id = $1 ORDER BY seq DESC LIMIT 1`, ipRes.ID)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return false, errors.Wrap(err, "selecting latest history")
+	case latest.Status == ipRes.Status && equalCodes(latest.ResponseCode, responseCode):
+		return false, nil
+	}
+
+	const q = `INSERT INTO ip_result_history
+		(id, ip_result_id, seq, status, response_code, changed_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	if _, err := tx.ExecContext(ctx, q, uuid.New().String(), ipRes.ID, latest.Seq+1, ipRes.Status, responseCode, now.UTC()); err != nil {
+		return false, errors.Wrap(err, "inserting history")
+	}
+
+	return true, nil
+}
+
+// keyRange returns the first and last ip_key within the prefix
+func keyRange(n *net.IPNet) ([]byte, []byte) {
+	lo := n.IP.Mask(n.Mask).To16()
+
+	// the mask of an IPv4 prefix covers 4 bytes, the last 4 of the key
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+
+	hi := make([]byte, len(lo))
+	for i := range lo {
+		hi[i] = lo[i] | ^mask[i]
+	}
+
+	return []byte(lo), hi
+}
+
+// sortedCodes puts a comma separated list of codes in ascending order so the same listing always reads the same
+func sortedCodes(responseCode *string) *string {
+	if responseCode == nil {
+		return nil
+	}
+
+	codes := strings.Split(*responseCode, ",")
+	sort.Strings(codes)
+	joined := strings.Join(codes, ",")
+
+	return &joined
+}
+
+// equalCodes compares two sorted lists of codes, either of which may be nil
+func equalCodes(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// listingStatus is the status of a successful lookup
+func listingStatus(responseCode *string, codes []Code) string {
+	if responseCode == nil && len(codes) == 0 {
+		return StatusNotListed
+	}
+
+	return StatusListed
+}
+
+// withResultID returns a copy of codes pointing at the result with the given id
+func withResultID(codes []Code, id string) []Code {
+	if codes == nil {
+		return nil
+	}
+
+	out := make([]Code, len(codes))
+	for i, c := range codes {
+		c.IPResultID = id
+		out[i] = c
+	}
+
+	return out
+}
@@ -1,26 +1,206 @@
 package ipresult
 
 import (
+	"net"
 	"time"
 )
 
+// The outcome of the most recent lookup of an IPResult. Only StatusListed and StatusNotListed mean the codes are
+// current, the others mean the lookup failed and the codes are whatever the last successful lookup found
+const (
+	StatusListed              = "LISTED"
+	StatusNotListed           = "NOT_LISTED"
+	StatusRateLimited         = "RATE_LIMITED"
+	StatusOpenResolverBlocked = "OPEN_RESOLVER_BLOCKED"
+	StatusInvalidKey          = "INVALID_KEY"
+	StatusDNSTimeout          = "DNS_TIMEOUT"
+	StatusDNSError            = "DNS_ERROR"
+	StatusError               = "ERROR"
+)
+
+// What AddOrUpdate did to a row. A row is changed when the listing it records differs from before the write, the
+// status or the codes, not when only its timestamps, attempts or ttl moved on
+const (
+	OutcomeCreated   = "CREATED"
+	OutcomeChanged   = "CHANGED"
+	OutcomeUnchanged = "UNCHANGED"
+)
+
 // A complete IPResult
 type IPResult struct {
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 	ID        string    `db:"id" json:"id"`
 	IPAddress string    `db:"ip_address" json:"ip_address"`
+	// Provider is the name of the dnsbl provider the result came from
+	Provider string `db:"provider" json:"provider"`
 	// Storing response code as a pointer to represent nil when an IP address has zero codes
 	ResponseCode *string   `db:"response_code" json:"response_code"`
 	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+	// Codes are the decoded response codes, stored in the ip_result_codes table
+	Codes []Code `db:"-" json:"codes"`
+	// Status is the outcome of the most recent lookup, LastError is set when it failed
+	Status        string    `db:"status" json:"status"`
+	LastError     *string   `db:"last_error" json:"last_error"`
+	LastAttemptAt time.Time `db:"last_attempt_at" json:"last_attempt_at"`
+	// Attempts is the number of attempts the most recent lookup took, whether it succeeded or was given up on
+	Attempts int `db:"attempts" json:"attempts"`
+	// TTL is the number of seconds after UpdatedAt the result stays fresh, taken from the provider's answer
+	TTL int `db:"ttl" json:"ttl"`
+	// IPKey is the address as 16 bytes, IPv4 addresses mapped into IPv6, which orders addresses numerically and turns
+	// a CIDR into a range. It's set by the Store
+	IPKey []byte `db:"ip_key" json:"-"`
+}
+
+// ExpiresAt is when the result stops being fresh
+func (r IPResult) ExpiresAt() time.Time {
+	return r.UpdatedAt.Add(time.Duration(r.TTL) * time.Second)
+}
+
+// Fresh reports whether the result is still current at now, it has to come from a successful lookup that hasn't
+// outlived its TTL. A result whose latest lookup failed is never fresh
+func (r IPResult) Fresh(now time.Time) bool {
+	if r.Status != StatusListed && r.Status != StatusNotListed {
+		return false
+	}
+
+	return now.Before(r.ExpiresAt())
+}
+
+// Code is a single decoded response code of an IPResult
+type Code struct {
+	IPResultID  string `db:"ip_result_id" json:"-"`
+	Code        string `db:"code" json:"code"`
+	List        string `db:"list" json:"list"`
+	Description string `db:"description" json:"description"`
+	Category    string `db:"category" json:"category"`
+	// FirstSeenAt is when the address was first listed under the code, LastChangedAt is when it was last listed
+	// under it again or its details changed. Both are set by the Store, they're ignored when writing
+	FirstSeenAt   time.Time `db:"first_seen_at" json:"first_seen_at"`
+	LastChangedAt time.Time `db:"last_changed_at" json:"last_changed_at"`
+	// RemovedAt is set once the address is no longer listed under the code, such codes aren't returned
+	RemovedAt *time.Time `db:"removed_at" json:"-"`
+}
+
+// A HistoryEntry records the listing of an IPResult from one change to the next
+type HistoryEntry struct {
+	ID         string `db:"id" json:"id"`
+	IPResultID string `db:"ip_result_id" json:"ip_result_id"`
+	// Seq numbers the changes of a single result, starting at 1
+	Seq int `db:"seq" json:"seq"`
+	// Status is either StatusListed or StatusNotListed, failed lookups don't change the listing
+	Status string `db:"status" json:"status"`
+	// ResponseCode is the comma separated list of codes in ascending order, nil when the address isn't listed
+	ResponseCode *string   `db:"response_code" json:"response_code"`
+	ChangedAt    time.Time `db:"changed_at" json:"changed_at"`
 }
 
 // The subset of fields necessary to construct an IPResult
 type NewIPResult struct {
 	IPAddress    string  `db:"ip_address" json:"ip_address"`
+	Provider     string  `db:"provider" json:"provider"`
 	ResponseCode *string `db:"response_code" json:"response_code"`
+	Codes        []Code  `db:"-" json:"codes"`
+	Status       string  `db:"status" json:"status"`
+	LastError    *string `db:"last_error" json:"last_error"`
+	Attempts     int     `db:"attempts" json:"attempts"`
+	TTL          int     `db:"ttl" json:"ttl"`
 }
 
 // The subset of fields necessary to update an IPResult
 type UpdateIPResult struct {
 	ResponseCode *string `db:"response_code" json:"response_code"`
+	Codes        []Code  `db:"-" json:"codes"`
+	Attempts     int     `db:"attempts" json:"attempts"`
+	TTL          int     `db:"ttl" json:"ttl"`
+}
+
+// An Upsert is one of the writes made by AddOrUpdateMany
+type Upsert struct {
+	IPAddress string
+	Provider  string
+	Update    UpdateIPResult
+}
+
+// Upserted is the row an Upsert wrote along with one of the Outcome constants. Previous holds the codes the row was
+// listed under before the write, read in the same transaction, so it's nil for a row that was created
+type Upserted struct {
+	IPResult IPResult
+	Outcome  string
+	Previous []Code
+}
+
+// The fields recorded against an IPResult when a lookup fails
+type FailedLookup struct {
+	// Status is one of the statuses other than StatusListed and StatusNotListed
+	Status   string
+	Err      error
+	Attempts int
+}
+
+// A Filter narrows the results returned by QueryPage, zero values match every result
+type Filter struct {
+	// Listed matches results listed under at least one code when true, and those that aren't when false
+	Listed *bool
+	// Code and List match results listed under the code, or under a code of the list, ex 127.0.0.2 or SBL
+	Code     string
+	List     string
+	Provider string
+	// UpdatedAfter and UpdatedBefore bound updated_at, the former inclusively
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+	// CIDR matches addresses within the prefix
+	CIDR *net.IPNet
+}
+
+// A RangeSummary counts the results within a prefix, see SummarizeRange
+type RangeSummary struct {
+	// Addresses is the number of addresses with a result and Listed the number of those listed under at least one code
+	Addresses int `db:"addresses"`
+	Listed    int `db:"listed"`
+	Codes     []RangeCode
+}
+
+// A RangeCode is the number of results of a provider listed under a code
+type RangeCode struct {
+	Provider string `db:"provider"`
+	Code     string `db:"code"`
+	List     string `db:"list"`
+	Count    int    `db:"count"`
+}
+
+// The orders QueryPage can return results in
+const (
+	OrderCreatedAt = "created_at"
+	OrderUpdatedAt = "updated_at"
+	OrderIPAddress = "ip_address"
+)
+
+// An Order is the order QueryPage returns results in, ties are broken by id so the order is total
+type Order struct {
+	Field string
+	Desc  bool
+}
+
+// A Cursor is the position of a result in an Order, QueryPage returns the results after it. Only the field the order
+// is by is used, along with the id
+type Cursor struct {
+	Time  time.Time
+	IPKey []byte
+	ID    string
+}
+
+// Cursor returns the position of the result in the order
+func (o Order) Cursor(r IPResult) Cursor {
+	c := Cursor{ID: r.ID}
+
+	switch o.Field {
+	case OrderCreatedAt:
+		c.Time = r.CreatedAt
+	case OrderUpdatedAt:
+		c.Time = r.UpdatedAt
+	case OrderIPAddress:
+		c.IPKey = r.IPKey
+	}
+
+	return c
 }
@@ -0,0 +1,182 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/trace"
+)
+
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrInvalidID = errors.New("ID is not in its proper form")
+)
+
+type Store struct {
+	log *log.Logger
+	db  *sqlx.DB
+}
+
+// New returns a configured Store
+func New(log *log.Logger, db *sqlx.DB) Store {
+	return Store{
+		log: log,
+		db:  db,
+	}
+}
+
+// Create inserts a new job into the db. A job with no lookups has nothing to wait on so it's completed right away
+func (s Store) Create(ctx context.Context, nj NewJob, now time.Time) (Job, error) {
+	if nj.Total < 0 {
+		return Job{}, errors.Errorf("invalid total %d", nj.Total)
+	}
+
+	j := Job{
+		ID:        uuid.New().String(),
+		Status:    StatusQueued,
+		Total:     nj.Total,
+		CreatedAt: now.UTC(),
+		UpdatedAt: now.UTC(),
+	}
+
+	if j.Total == 0 {
+		finished := now.UTC()
+		j.Status = StatusCompleted
+		j.FinishedAt = &finished
+	}
+
+	const q = `INSERT INTO jobs
+		(id, status, total, completed, failed, created_at, updated_at, finished_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	s.log.Printf("%s : query : %s job.Create", trace.ID(ctx), j.ID)
+
+	if _, err := s.db.ExecContext(ctx, q, j.ID, j.Status, j.Total, j.Completed, j.Failed, j.CreatedAt, j.UpdatedAt, j.FinishedAt); err != nil {
+		return Job{}, errors.Wrap(err, "inserting job")
+	}
+
+	return j, nil
+}
+
+// RecordLookup counts a finished lookup against the job, as failed when failed is true, and returns the job as it
+// stands afterwards. The counts are incremented in a single statement as lookups finish concurrently, the job
+// completes with the statement counting its last lookup
+func (s Store) RecordLookup(ctx context.Context, id string, failed bool, now time.Time) (Job, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Job{}, ErrInvalidID
+	}
+
+	completed, fails := 1, 0
+	if failed {
+		completed, fails = 0, 1
+	}
+
+	const q = `UPDATE jobs SET
+		"completed" = completed + $1,
+		"failed" = failed + $2,
+		"updated_at" = $3,
+		"status" = CASE WHEN completed + failed + 1 >= total THEN $4 ELSE $5 END,
+		"finished_at" = CASE WHEN completed + failed + 1 >= total THEN $3 ELSE NULL END
+		WHERE id = $6 AND status != $4`
+
+	s.log.Printf("%s : query : %s job.RecordLookup", trace.ID(ctx), id)
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Job{}, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, q, completed, fails, now.UTC(), StatusCompleted, StatusRunning, id)
+	if err != nil {
+		return Job{}, errors.Wrapf(err, "updating job %q", id)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Job{}, errors.Wrapf(err, "updating job %q", id)
+	}
+
+	if n == 0 {
+		return Job{}, ErrNotFound
+	}
+
+	var j Job
+	if err := tx.GetContext(ctx, &j, `SELECT * FROM jobs WHERE id = $1`, id); err != nil {
+		return Job{}, errors.Wrapf(err, "selecting job %q", id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Job{}, errors.Wrap(err, "committing transaction")
+	}
+
+	return j, nil
+}
+
+// Delete removes a job, for one whose lookups couldn't be queued so it's never left waiting on lookups that won't come
+func (s Store) Delete(ctx context.Context, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `DELETE FROM jobs WHERE id = $1`
+
+	s.log.Printf("%s : query : %s job.Delete", trace.ID(ctx), id)
+
+	res, err := s.db.ExecContext(ctx, q, id)
+	if err != nil {
+		return errors.Wrapf(err, "deleting job %q", id)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "deleting job %q", id)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// QueryByID finds the job by its ID
+func (s Store) QueryByID(ctx context.Context, id string) (Job, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Job{}, ErrInvalidID
+	}
+
+	const q = `SELECT * FROM jobs WHERE id = $1`
+
+	s.log.Printf("%s : query : %s job.QueryByID", trace.ID(ctx), id)
+
+	var j Job
+	if err := s.db.GetContext(ctx, &j, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return Job{}, ErrNotFound
+		}
+
+		return Job{}, errors.Wrapf(err, "selecting job %q", id)
+	}
+
+	return j, nil
+}
+
+// Query returns the most recent jobs, newest first
+func (s Store) Query(ctx context.Context, limit int) ([]Job, error) {
+	const q = `SELECT * FROM jobs ORDER BY created_at DESC, id LIMIT $1`
+
+	s.log.Printf("%s : query : job.Query", trace.ID(ctx))
+
+	var jobs []Job
+	if err := s.db.SelectContext(ctx, &jobs, q, limit); err != nil {
+		return nil, errors.Wrap(err, "selecting jobs")
+	}
+
+	return jobs, nil
+}
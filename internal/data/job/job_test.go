@@ -0,0 +1,211 @@
+package job_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+func TestJob(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to track the lookups of an enqueue.")
+	// ============================================================================
+	// Setup: create a job store
+	s := job.New(log, db)
+
+	testID := 0
+
+	t.Logf("\tTest %d:\tWhen creating a job.", testID)
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+	ctx := trace.WithID(context.Background(), traceID)
+
+	j, err := s.Create(ctx, job.NewJob{Total: 3}, now)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to create a job : %s.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to create a job.", success, testID)
+
+	saved, err := s.QueryByID(ctx, j.ID)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to retrieve the job by ID : %s.", failure, testID, err)
+	}
+
+	if diff := cmp.Diff(j, saved); diff != "" {
+		t.Fatalf("\t%s\tTest %d:\tShould get back the same job. Diff:\n %s.", failure, testID, diff)
+	}
+	t.Logf("\t%s\tTest %d:\tShould get back the same job.", success, testID)
+
+	if saved.Status != job.StatusQueued {
+		t.Fatalf("\t%s\tTest %d:\tShould be queued : %s.", failure, testID, saved.Status)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be queued.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen recording lookups.", testID)
+
+	later := now.Add(time.Minute)
+	if _, err := s.RecordLookup(ctx, j.ID, false, later); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to record a lookup : %s.", failure, testID, err)
+	}
+
+	saved, err = s.QueryByID(ctx, j.ID)
+	if err != nil {
+		t.Fatalf("unable to retrieve job %v", err)
+	}
+
+	if saved.Status != job.StatusRunning || saved.Completed != 1 || saved.FinishedAt != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be running after the first lookup : %+v.", failure, testID, saved)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be running after the first lookup.", success, testID)
+
+	if _, err := s.RecordLookup(ctx, j.ID, true, later); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to record a failed lookup : %s.", failure, testID, err)
+	}
+	if _, err := s.RecordLookup(ctx, j.ID, false, later); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to record the last lookup : %s.", failure, testID, err)
+	}
+
+	saved, err = s.QueryByID(ctx, j.ID)
+	if err != nil {
+		t.Fatalf("unable to retrieve job %v", err)
+	}
+
+	if saved.Status != job.StatusCompleted || saved.Completed != 2 || saved.Failed != 1 {
+		t.Fatalf("\t%s\tTest %d:\tShould be completed after the last lookup : %+v.", failure, testID, saved)
+	}
+	if saved.FinishedAt == nil || !saved.FinishedAt.Equal(later) {
+		t.Fatalf("\t%s\tTest %d:\tShould record when the job finished : %v.", failure, testID, saved.FinishedAt)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be completed after the last lookup.", success, testID)
+
+	if _, err := s.RecordLookup(ctx, j.ID, false, later); errors.Cause(err) != job.ErrNotFound {
+		t.Fatalf("\t%s\tTest %d:\tShould not count lookups against a completed job : %v.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould not count lookups against a completed job.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen lookups finish concurrently.", testID)
+
+	const total = 20
+	j, err = s.Create(ctx, job.NewJob{Total: total}, later)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to create a job : %s.", failure, testID, err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(total)
+	for i := 0; i < total; i++ {
+		go func(failed bool) {
+			defer wg.Done()
+			if _, err := s.RecordLookup(ctx, j.ID, failed, later); err != nil {
+				t.Errorf("\t%s\tTest %d:\tShould be able to record a lookup : %s.", failure, testID, err)
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+
+	saved, err = s.QueryByID(ctx, j.ID)
+	if err != nil {
+		t.Fatalf("unable to retrieve job %v", err)
+	}
+
+	if saved.Status != job.StatusCompleted || saved.Completed+saved.Failed != total {
+		t.Fatalf("\t%s\tTest %d:\tShould count every lookup : %+v.", failure, testID, saved)
+	}
+	t.Logf("\t%s\tTest %d:\tShould count every lookup.", success, testID)
+
+	jobs, err := s.Query(ctx, 10)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to list jobs : %s.", failure, testID, err)
+	}
+
+	if len(jobs) != 2 || jobs[0].ID != j.ID {
+		t.Fatalf("\t%s\tTest %d:\tShould list the newest job first : %+v.", failure, testID, jobs)
+	}
+	t.Logf("\t%s\tTest %d:\tShould list the newest job first.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen a job has no lookups.", testID)
+
+	j, err = s.Create(ctx, job.NewJob{}, now)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to create a job : %s.", failure, testID, err)
+	}
+
+	if j.Status != job.StatusCompleted || j.FinishedAt == nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be completed right away : %+v.", failure, testID, j)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be completed right away.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen deleting a job.", testID)
+
+	if err := s.Delete(ctx, j.ID); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to delete the job : %s.", failure, testID, err)
+	}
+
+	if _, err := s.QueryByID(ctx, j.ID); errors.Cause(err) != job.ErrNotFound {
+		t.Fatalf("\t%s\tTest %d:\tShould not find the deleted job : %v.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to delete the job.", success, testID)
+
+	if err := s.Delete(ctx, j.ID); errors.Cause(err) != job.ErrNotFound {
+		t.Fatalf("\t%s\tTest %d:\tShould not find a job that's already deleted : %v.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould not find a job that's already deleted.", success, testID)
+}
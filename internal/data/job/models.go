@@ -0,0 +1,33 @@
+package job
+
+import (
+	"time"
+)
+
+// The lifecycle of a Job. A job is queued when it's created, running once its first lookup finishes and
+// completed once every lookup has finished, whether it succeeded or failed
+const (
+	StatusQueued    = "QUEUED"
+	StatusRunning   = "RUNNING"
+	StatusCompleted = "COMPLETED"
+)
+
+// A complete Job, tracking the lookups started by a single enqueue
+type Job struct {
+	ID     string `db:"id" json:"id"`
+	Status string `db:"status" json:"status"`
+	// Total is the number of lookups, one per address and provider pair, Completed and Failed count those
+	// that have finished
+	Total     int       `db:"total" json:"total"`
+	Completed int       `db:"completed" json:"completed"`
+	Failed    int       `db:"failed" json:"failed"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+	// FinishedAt is nil until the job is completed
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// The subset of fields necessary to construct a Job
+type NewJob struct {
+	Total int `db:"total" json:"total"`
+}
@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"time"
+)
+
+// The lifecycle of an Item. An item is pending until a worker claims it, and goes back to pending when its lookup
+// is retried. Items are deleted once they're acked so there's no status for finished work
+const (
+	StatusPending = "PENDING"
+	StatusClaimed = "CLAIMED"
+)
+
+// A complete Item, a single lookup of an ip address against a provider waiting to be made
+type Item struct {
+	ID        string `db:"id" json:"id"`
+	JobID     string `db:"job_id" json:"job_id"`
+	TraceID   string `db:"trace_id" json:"trace_id"`
+	IPAddress string `db:"ip_address" json:"ip_address"`
+	Provider  string `db:"provider" json:"provider"`
+	Status    string `db:"status" json:"status"`
+	// Force makes the lookup even when the stored result is still fresh
+	Force bool `db:"force" json:"force"`
+	// Attempts is the number of times the item has been claimed, LastError is the error of the last failed attempt
+	Attempts  int     `db:"attempts" json:"attempts"`
+	LastError *string `db:"last_error" json:"last_error"`
+	// AvailableAt is when the item can next be claimed, it's pushed back when a lookup is retried
+	AvailableAt time.Time  `db:"available_at" json:"available_at"`
+	ClaimedAt   *time.Time `db:"claimed_at" json:"claimed_at"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// The subset of fields necessary to construct an Item
+type NewItem struct {
+	JobID     string `db:"job_id" json:"job_id"`
+	IPAddress string `db:"ip_address" json:"ip_address"`
+	Provider  string `db:"provider" json:"provider"`
+	Force     bool   `db:"force" json:"force"`
+}
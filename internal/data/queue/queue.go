@@ -0,0 +1,224 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrInvalidID = errors.New("ID is not in its proper form")
+)
+
+type Store struct {
+	log *log.Logger
+	db  *sqlx.DB
+}
+
+// New returns a configured Store
+func New(log *log.Logger, db *sqlx.DB) Store {
+	return Store{
+		log: log,
+		db:  db,
+	}
+}
+
+// Enqueue inserts the items as pending, available right away. The trace ID is stored with each item so the work
+// done for a request can be followed through the logs even when it's picked up after a restart
+func (s Store) Enqueue(ctx context.Context, newItems []NewItem, now time.Time) ([]Item, error) {
+	const q = `INSERT INTO queue_items
+		(id, job_id, trace_id, ip_address, provider, status, force, attempts, available_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	s.log.Printf("%s : query : %d queue.Enqueue", trace.ID(ctx), len(newItems))
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	items := make([]Item, 0, len(newItems))
+	for _, ni := range newItems {
+		item := Item{
+			ID:          uuid.New().String(),
+			JobID:       ni.JobID,
+			TraceID:     trace.ID(ctx),
+			IPAddress:   ni.IPAddress,
+			Provider:    ni.Provider,
+			Status:      StatusPending,
+			Force:       ni.Force,
+			AvailableAt: now.UTC(),
+			CreatedAt:   now.UTC(),
+			UpdatedAt:   now.UTC(),
+		}
+
+		if _, err := tx.ExecContext(ctx, q, item.ID, item.JobID, item.TraceID, item.IPAddress, item.Provider, item.Status,
+			item.Force, item.Attempts, item.AvailableAt, item.CreatedAt, item.UpdatedAt); err != nil {
+			return nil, errors.Wrap(err, "inserting queue item")
+		}
+
+		items = append(items, item)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "committing transaction")
+	}
+
+	return items, nil
+}
+
+// Claim claims up to limit of the pending items that are available, oldest first, and counts an attempt against
+// each. A claimed item is invisible to other claims until it's retried, released or acked
+func (s Store) Claim(ctx context.Context, limit int, now time.Time) ([]Item, error) {
+	sel := `SELECT * FROM queue_items WHERE status = $1 AND available_at <= $2
+		ORDER BY available_at, created_at LIMIT $3`
+	if s.db.DriverName() == database.DriverPostgres {
+		// other replicas skip the rows we're claiming rather than claiming them too or waiting on our lock
+		sel += " FOR UPDATE SKIP LOCKED"
+	}
+
+	s.log.Printf("%s : query : queue.Claim", trace.ID(ctx))
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	var items []Item
+	if err := tx.SelectContext(ctx, &items, sel, StatusPending, now.UTC(), limit); err != nil {
+		return nil, errors.Wrap(err, "selecting queue items")
+	}
+
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	claimed := now.UTC()
+	ids := make([]string, 0, len(items))
+	for i := range items {
+		items[i].Status = StatusClaimed
+		items[i].Attempts++
+		items[i].ClaimedAt = &claimed
+		items[i].UpdatedAt = claimed
+		ids = append(ids, items[i].ID)
+	}
+
+	upd, args, err := sqlx.In(`UPDATE queue_items SET status = ?, attempts = attempts + 1, claimed_at = ?, updated_at = ?
+		WHERE id IN (?)`, StatusClaimed, claimed, claimed, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "building claim query")
+	}
+
+	if _, err := tx.ExecContext(ctx, tx.Rebind(upd), args...); err != nil {
+		return nil, errors.Wrap(err, "claiming queue items")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "committing transaction")
+	}
+
+	return items, nil
+}
+
+// Retry puts a claimed item back to pending once availableAt has passed, recording the error of the failed attempt
+func (s Store) Retry(ctx context.Context, id string, lookupErr error, availableAt time.Time, now time.Time) error {
+	msg := lookupErr.Error()
+
+	const q = `UPDATE queue_items SET status = $1, last_error = $2, available_at = $3, claimed_at = NULL, updated_at = $4
+		WHERE id = $5 AND status = $6`
+
+	s.log.Printf("%s : query : %s queue.Retry", trace.ID(ctx), id)
+
+	return s.exec(ctx, q, StatusPending, msg, availableAt.UTC(), now.UTC(), id, StatusClaimed)
+}
+
+// Release puts a claimed item back to pending without counting the attempt, for items claimed but never started
+func (s Store) Release(ctx context.Context, id string, now time.Time) error {
+	const q = `UPDATE queue_items SET status = $1, attempts = attempts - 1, claimed_at = NULL, updated_at = $2
+		WHERE id = $3 AND status = $4`
+
+	s.log.Printf("%s : query : %s queue.Release", trace.ID(ctx), id)
+
+	return s.exec(ctx, q, StatusPending, now.UTC(), id, StatusClaimed)
+}
+
+// Ack deletes a claimed item once it's finished with, whether its lookup succeeded or was given up on
+func (s Store) Ack(ctx context.Context, id string) error {
+	const q = `DELETE FROM queue_items WHERE id = $1 AND status = $2`
+
+	s.log.Printf("%s : query : %s queue.Ack", trace.ID(ctx), id)
+
+	return s.exec(ctx, q, id, StatusClaimed)
+}
+
+// Recover puts the items claimed before claimedBefore back to pending and returns how many there were. Items are
+// only left claimed when the process that claimed them stopped before finishing them, other processes sharing the
+// queue may still be working on recent claims so claimedBefore should be well past the time a claim takes to finish
+func (s Store) Recover(ctx context.Context, claimedBefore time.Time, now time.Time) (int, error) {
+	const q = `UPDATE queue_items SET status = $1, claimed_at = NULL, updated_at = $2 WHERE status = $3 AND claimed_at < $4`
+
+	s.log.Printf("%s : query : queue.Recover", trace.ID(ctx))
+
+	res, err := s.db.ExecContext(ctx, q, StatusPending, now.UTC(), StatusClaimed, claimedBefore.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, "recovering queue items")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "recovering queue items")
+	}
+
+	return int(n), nil
+}
+
+// QueryByID finds the item by its ID
+func (s Store) QueryByID(ctx context.Context, id string) (Item, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Item{}, ErrInvalidID
+	}
+
+	const q = `SELECT * FROM queue_items WHERE id = $1`
+
+	s.log.Printf("%s : query : %s queue.QueryByID", trace.ID(ctx), id)
+
+	var item Item
+	if err := s.db.GetContext(ctx, &item, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return Item{}, ErrNotFound
+		}
+
+		return Item{}, errors.Wrapf(err, "selecting queue item %q", id)
+	}
+
+	return item, nil
+}
+
+// exec runs a statement that changes a single claimed item, reporting ErrNotFound when no claimed item matched
+func (s Store) exec(ctx context.Context, q string, args ...interface{}) error {
+	res, err := s.db.ExecContext(ctx, q, args...)
+	if err != nil {
+		return errors.Wrap(err, "updating queue item")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "updating queue item")
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/queue"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+func TestQueue(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to queue lookups.")
+	// ============================================================================
+	// Setup: create a queue store
+	s := queue.New(log, db)
+
+	testID := 0
+
+	t.Logf("\tTest %d:\tWhen claiming enqueued items.", testID)
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+	ctx := trace.WithID(context.Background(), traceID)
+	jobID := "11111111-1111-1111-1111-111111111111"
+
+	items, err := s.Enqueue(ctx, []queue.NewItem{
+		{JobID: jobID, IPAddress: "127.0.0.2", Provider: "spamhaus"},
+		{JobID: jobID, IPAddress: "127.0.0.3", Provider: "spamhaus"},
+		{JobID: jobID, IPAddress: "127.0.0.4", Provider: "spamhaus"},
+	}, now)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to enqueue items : %s.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to enqueue items.", success, testID)
+
+	claimed, err := s.Claim(ctx, 2, now)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to claim items : %s.", failure, testID, err)
+	}
+
+	if len(claimed) != 2 || claimed[0].Attempts != 1 || claimed[0].Status != queue.StatusClaimed || claimed[0].TraceID != traceID {
+		t.Fatalf("\t%s\tTest %d:\tShould claim up to the limit : %+v.", failure, testID, claimed)
+	}
+	t.Logf("\t%s\tTest %d:\tShould claim up to the limit.", success, testID)
+
+	rest, err := s.Claim(ctx, 10, now)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to claim items : %s.", failure, testID, err)
+	}
+
+	if len(rest) != 1 || rest[0].ID != items[2].ID {
+		t.Fatalf("\t%s\tTest %d:\tShould not claim items that are already claimed : %+v.", failure, testID, rest)
+	}
+	t.Logf("\t%s\tTest %d:\tShould not claim items that are already claimed.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen finishing with claimed items.", testID)
+
+	if err := s.Ack(ctx, claimed[0].ID); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to ack an item : %s.", failure, testID, err)
+	}
+
+	if _, err := s.QueryByID(ctx, claimed[0].ID); errors.Cause(err) != queue.ErrNotFound {
+		t.Fatalf("\t%s\tTest %d:\tShould delete an acked item : %v.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould delete an acked item.", success, testID)
+
+	later := now.Add(time.Minute)
+	if err := s.Retry(ctx, claimed[1].ID, errors.New("i/o timeout"), later, now); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to retry an item : %s.", failure, testID, err)
+	}
+
+	if again, err := s.Claim(ctx, 10, now); err != nil || len(again) != 0 {
+		t.Fatalf("\t%s\tTest %d:\tShould not claim a retried item early : %v %+v.", failure, testID, err, again)
+	}
+
+	again, err := s.Claim(ctx, 10, later)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to claim items : %s.", failure, testID, err)
+	}
+
+	if len(again) != 1 || again[0].Attempts != 2 || again[0].LastError == nil || *again[0].LastError != "i/o timeout" {
+		t.Fatalf("\t%s\tTest %d:\tShould claim a retried item once it's available : %+v.", failure, testID, again)
+	}
+	t.Logf("\t%s\tTest %d:\tShould claim a retried item once it's available.", success, testID)
+
+	if err := s.Release(ctx, again[0].ID, later); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to release an item : %s.", failure, testID, err)
+	}
+
+	released, err := s.QueryByID(ctx, again[0].ID)
+	if err != nil {
+		t.Fatalf("unable to retrieve queue item %v", err)
+	}
+
+	if released.Status != queue.StatusPending || released.Attempts != 1 {
+		t.Fatalf("\t%s\tTest %d:\tShould release an item without counting the attempt : %+v.", failure, testID, released)
+	}
+	t.Logf("\t%s\tTest %d:\tShould release an item without counting the attempt.", success, testID)
+
+	if err := s.Ack(ctx, again[0].ID); errors.Cause(err) != queue.ErrNotFound {
+		t.Fatalf("\t%s\tTest %d:\tShould only ack claimed items : %v.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould only ack claimed items.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen the process restarts with items still claimed.", testID)
+
+	n, err := s.Recover(ctx, now, later)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to recover items : %s.", failure, testID, err)
+	}
+
+	if n != 0 {
+		t.Fatalf("\t%s\tTest %d:\tShould leave recent claims alone : %d.", failure, testID, n)
+	}
+	t.Logf("\t%s\tTest %d:\tShould leave recent claims alone.", success, testID)
+
+	n, err = s.Recover(ctx, later, later)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to recover items : %s.", failure, testID, err)
+	}
+
+	if n != 1 {
+		t.Fatalf("\t%s\tTest %d:\tShould recover the items left claimed : %d.", failure, testID, n)
+	}
+	t.Logf("\t%s\tTest %d:\tShould recover the items left claimed.", success, testID)
+
+	recovered, err := s.Claim(ctx, 10, later)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to claim items : %s.", failure, testID, err)
+	}
+
+	if len(recovered) != 2 {
+		t.Fatalf("\t%s\tTest %d:\tShould claim recovered items again : %+v.", failure, testID, recovered)
+	}
+	t.Logf("\t%s\tTest %d:\tShould claim recovered items again.", success, testID)
+}
+
+func TestCancel(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to stop claiming once the workers are stopped.")
+	s := queue.New(log, db)
+
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+	ctx := trace.WithID(context.Background(), traceID)
+	jobID := "11111111-1111-1111-1111-111111111111"
+
+	items, err := s.Enqueue(ctx, []queue.NewItem{{JobID: jobID, IPAddress: "127.0.0.2", Provider: "spamhaus"}}, now)
+	if err != nil {
+		t.Fatalf("unable to enqueue items %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen the context is cancelled.", testID)
+	{
+		if _, err := s.Claim(cancelled, 10, now); errors.Cause(err) != context.Canceled {
+			t.Fatalf("\t%s\tTest %d:\tShould not claim : %v.", failure, testID, err)
+		}
+		if _, err := s.Recover(cancelled, now, now); errors.Cause(err) != context.Canceled {
+			t.Fatalf("\t%s\tTest %d:\tShould not recover : %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould return %v.", success, testID, context.Canceled)
+
+		item, err := s.QueryByID(ctx, items[0].ID)
+		if err != nil {
+			t.Fatalf("unable to retrieve queue item %v", err)
+		}
+
+		if item.Status != queue.StatusPending || item.Attempts != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould leave the item pending : %+v.", failure, testID, item)
+		}
+		t.Logf("\t%s\tTest %d:\tShould leave the item pending.", success, testID)
+	}
+}
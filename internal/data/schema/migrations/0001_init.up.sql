@@ -0,0 +1,10 @@
+-- the schema as it stood before migrations were versioned. IF NOT EXISTS lets a database created back then be
+-- brought under version control by running it again, every change since is a migration of its own
+
+CREATE TABLE IF NOT EXISTS ip_results (
+    ip_address TEXT PRIMARY KEY,
+    id TEXT UNIQUE,
+    created_at DATETIME,
+    updated_at DATETIME,
+    response_code TEXT
+);
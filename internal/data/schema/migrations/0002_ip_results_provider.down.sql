@@ -0,0 +1,16 @@
+-- an address has a single result again, the spamhaus one, the results from any other provider are dropped
+
+CREATE TABLE ip_results_address (
+    ip_address TEXT PRIMARY KEY,
+    id TEXT UNIQUE,
+    created_at DATETIME,
+    updated_at DATETIME,
+    response_code TEXT
+);
+
+INSERT INTO ip_results_address (ip_address, id, created_at, updated_at, response_code)
+SELECT ip_address, id, created_at, updated_at, response_code FROM ip_results WHERE provider = 'spamhaus';
+
+DROP TABLE ip_results;
+
+ALTER TABLE ip_results_address RENAME TO ip_results;
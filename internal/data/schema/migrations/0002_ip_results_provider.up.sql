@@ -0,0 +1,19 @@
+-- results are stored per provider. Neither sqlite nor the other databases we run on can change a primary key in
+-- place so the table is rebuilt, the results from before providers were configurable all came from spamhaus
+
+CREATE TABLE ip_results_provider (
+    ip_address TEXT,
+    provider TEXT,
+    id TEXT UNIQUE,
+    created_at DATETIME,
+    updated_at DATETIME,
+    response_code TEXT,
+    PRIMARY KEY (ip_address, provider)
+);
+
+INSERT INTO ip_results_provider (ip_address, provider, id, created_at, updated_at, response_code)
+SELECT ip_address, 'spamhaus', id, created_at, updated_at, response_code FROM ip_results;
+
+DROP TABLE ip_results;
+
+ALTER TABLE ip_results_provider RENAME TO ip_results;
@@ -0,0 +1,9 @@
+CREATE TABLE domain_results (
+    domain TEXT,
+    provider TEXT,
+    id TEXT UNIQUE,
+    created_at DATETIME,
+    updated_at DATETIME,
+    response_code TEXT,
+    PRIMARY KEY (domain, provider)
+);
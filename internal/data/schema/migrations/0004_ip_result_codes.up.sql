@@ -0,0 +1,10 @@
+-- ip_result_codes holds the decoded response codes of an ip_results row, one row per code. Decoding takes the
+-- provider's table of codes so the results already stored get theirs the next time they're looked up
+CREATE TABLE ip_result_codes (
+    ip_result_id TEXT REFERENCES ip_results(id) ON DELETE CASCADE,
+    code TEXT,
+    list TEXT,
+    description TEXT,
+    category TEXT,
+    PRIMARY KEY (ip_result_id, code)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE ip_results DROP COLUMN last_attempt_at;
+ALTER TABLE ip_results DROP COLUMN last_error;
+ALTER TABLE ip_results DROP COLUMN status;
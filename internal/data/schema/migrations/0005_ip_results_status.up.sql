@@ -0,0 +1,9 @@
+-- the outcome of the most recent lookup. Every result stored until now came from a lookup that succeeded, when it
+-- was last updated
+ALTER TABLE ip_results ADD COLUMN status TEXT;
+ALTER TABLE ip_results ADD COLUMN last_error TEXT;
+ALTER TABLE ip_results ADD COLUMN last_attempt_at DATETIME;
+
+UPDATE ip_results
+SET status = CASE WHEN response_code IS NULL THEN 'NOT_LISTED' ELSE 'LISTED' END,
+    last_attempt_at = updated_at;
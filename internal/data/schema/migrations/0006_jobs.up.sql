@@ -0,0 +1,11 @@
+-- jobs tracks the lookups started by a single enqueue
+CREATE TABLE jobs (
+    id TEXT PRIMARY KEY,
+    status TEXT,
+    total INTEGER,
+    completed INTEGER,
+    failed INTEGER,
+    created_at DATETIME,
+    updated_at DATETIME,
+    finished_at DATETIME
+);
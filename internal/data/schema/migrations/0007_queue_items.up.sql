@@ -0,0 +1,18 @@
+-- queue_items holds the lookups waiting to be made, one row per address and provider. Rows are deleted once
+-- they're finished with so the table only ever holds outstanding work
+CREATE TABLE queue_items (
+    id TEXT PRIMARY KEY,
+    job_id TEXT,
+    trace_id TEXT,
+    ip_address TEXT,
+    provider TEXT,
+    status TEXT,
+    attempts INTEGER,
+    last_error TEXT,
+    available_at DATETIME,
+    claimed_at DATETIME,
+    created_at DATETIME,
+    updated_at DATETIME
+);
+
+CREATE INDEX queue_items_status_available_at ON queue_items (status, available_at);
@@ -0,0 +1 @@
+ALTER TABLE ip_results DROP COLUMN attempts;
@@ -0,0 +1,4 @@
+-- the number of attempts the most recent lookup took, lookups were only ever attempted once until now
+ALTER TABLE ip_results ADD COLUMN attempts INTEGER;
+
+UPDATE ip_results SET attempts = 1;
@@ -0,0 +1,2 @@
+ALTER TABLE queue_items DROP COLUMN force;
+ALTER TABLE ip_results DROP COLUMN ttl;
@@ -0,0 +1,7 @@
+-- the number of seconds a result stays fresh. Results stored until now have no TTL so they're looked up again the
+-- next time they're enqueued, as they always were, and a lookup already queued isn't forced
+ALTER TABLE ip_results ADD COLUMN ttl INTEGER;
+ALTER TABLE queue_items ADD COLUMN force BOOLEAN;
+
+UPDATE ip_results SET ttl = 0;
+UPDATE queue_items SET force = FALSE;
@@ -0,0 +1 @@
+DROP TABLE watched_ips;
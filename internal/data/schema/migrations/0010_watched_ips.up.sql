@@ -0,0 +1,5 @@
+-- watched_ips holds the addresses the scheduler keeps checking whether or not anyone enqueues them
+CREATE TABLE watched_ips (
+    ip_address TEXT PRIMARY KEY,
+    created_at DATETIME
+);
@@ -0,0 +1,5 @@
+DROP TABLE ip_result_history;
+
+ALTER TABLE ip_result_codes DROP COLUMN removed_at;
+ALTER TABLE ip_result_codes DROP COLUMN last_changed_at;
+ALTER TABLE ip_result_codes DROP COLUMN first_seen_at;
@@ -0,0 +1,21 @@
+-- A code the address is no longer listed under keeps its row with removed_at set, so first_seen_at survives being
+-- delisted and relisted. The codes stored until now were last seen changing when their result was last updated
+ALTER TABLE ip_result_codes ADD COLUMN first_seen_at DATETIME;
+ALTER TABLE ip_result_codes ADD COLUMN last_changed_at DATETIME;
+ALTER TABLE ip_result_codes ADD COLUMN removed_at DATETIME;
+
+UPDATE ip_result_codes
+SET first_seen_at = (SELECT updated_at FROM ip_results WHERE ip_results.id = ip_result_codes.ip_result_id),
+    last_changed_at = (SELECT updated_at FROM ip_results WHERE ip_results.id = ip_result_codes.ip_result_id);
+
+-- ip_result_history is an append only record of the listings of an ip_results row, a row is added each time the
+-- codes an address is listed under change. seq numbers the changes of a single result, starting at 1
+CREATE TABLE ip_result_history (
+    id TEXT PRIMARY KEY,
+    ip_result_id TEXT REFERENCES ip_results(id) ON DELETE CASCADE,
+    seq INTEGER,
+    status TEXT,
+    response_code TEXT,
+    changed_at DATETIME,
+    UNIQUE (ip_result_id, seq)
+);
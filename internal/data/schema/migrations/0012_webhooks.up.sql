@@ -0,0 +1,30 @@
+-- webhooks holds the registered webhooks. events and cidrs are comma separated lists, empty matches everything
+CREATE TABLE webhooks (
+    id TEXT PRIMARY KEY,
+    url TEXT,
+    secret TEXT,
+    events TEXT,
+    cidrs TEXT,
+    created_at DATETIME,
+    updated_at DATETIME
+);
+
+-- webhook_deliveries holds each notification sent to a webhook. Unlike queue_items rows are kept once finished, a
+-- delivery that ran out of attempts is left DEAD as a record of what the webhook missed
+CREATE TABLE webhook_deliveries (
+    id TEXT PRIMARY KEY,
+    webhook_id TEXT REFERENCES webhooks(id) ON DELETE CASCADE,
+    trace_id TEXT,
+    event TEXT,
+    payload TEXT,
+    status TEXT,
+    attempts INTEGER,
+    last_error TEXT,
+    available_at DATETIME,
+    claimed_at DATETIME,
+    delivered_at DATETIME,
+    created_at DATETIME,
+    updated_at DATETIME
+);
+
+CREATE INDEX webhook_deliveries_status_available_at ON webhook_deliveries (status, available_at);
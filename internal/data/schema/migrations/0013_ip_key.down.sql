@@ -0,0 +1,7 @@
+DROP INDEX ip_result_codes_list;
+DROP INDEX ip_result_codes_code;
+DROP INDEX ip_results_ip_key;
+DROP INDEX ip_results_updated_at;
+DROP INDEX ip_results_created_at;
+
+ALTER TABLE ip_results DROP COLUMN ip_key;
@@ -0,0 +1,13 @@
+-- ip_key is the address as 16 bytes, IPv4 addresses mapped into IPv6, so a CIDR is a range of keys. It's filled in
+-- for the results already stored once this has run, see backfills
+ALTER TABLE ip_results ADD COLUMN ip_key BLOB;
+
+-- the indexes behind browsing ip_results, one per order results can be paged through in and one for each filter
+-- that narrows them by a range
+CREATE INDEX ip_results_created_at ON ip_results (created_at, id);
+CREATE INDEX ip_results_updated_at ON ip_results (updated_at, id);
+CREATE INDEX ip_results_ip_key ON ip_results (ip_key, id);
+
+-- the indexes behind filtering ip_results by the code or list they're listed under
+CREATE INDEX ip_result_codes_code ON ip_result_codes (code, ip_result_id) WHERE removed_at IS NULL;
+CREATE INDEX ip_result_codes_list ON ip_result_codes (list, ip_result_id) WHERE removed_at IS NULL;
@@ -1,29 +1,351 @@
 package schema
 
 import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+var (
+	ErrUnknownVersion = errors.New("unknown migration version")
+	ErrNothingApplied = errors.New("no migrations have been applied")
 )
 
-const schema = `
-	CREATE TABLE IF NOT EXISTS ip_results (
-		ip_address TEXT PRIMARY KEY,
-		id TEXT UNIQUE,
-		created_at DATETIME,
-		updated_at DATETIME,
-		response_code TEXT
+// migrations holds a pair of files for each version, <version>_<name>.up.sql and <version>_<name>.down.sql. Once a
+// migration has been released it's never edited, changes to the schema are made by adding the next version
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// The migrations are written for sqlite. Postgres has no DATETIME or BLOB so they're mapped onto its equivalents, the
+// rest of the statements are the same for both
+var postgresTypes = strings.NewReplacer("DATETIME", "TIMESTAMPTZ", "BLOB", "BYTEA")
+
+// backfills fill in what a migration's SQL can't compute, keyed by the version of the migration. Each runs in the
+// migration's transaction once its up has been applied
+var backfills = map[int]func(tx *sqlx.Tx) error{
+	13: ipKeys,
+}
+
+// schema_migrations records the version of each migration applied to the database
+const schemaMigrations = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT,
+		applied_at DATETIME
 	)
 `
 
-// Migrate creates our table
-func Migrate(db *sqlx.DB) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.Errorf("unable to migrate db %v", r)
+// Migration is a change to the schema, Up makes it and Down undoes it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration along with when it was applied, AppliedAt is nil for a migration that's pending
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// dialect rewrites a statement for the database's driver
+func dialect(db *sqlx.DB, q string) string {
+	if db.DriverName() == database.DriverPostgres {
+		return postgresTypes.Replace(q)
+	}
+
+	return q
+}
+
+// Migrations returns the migrations embedded in the binary in version order
+func Migrations() ([]Migration, error) {
+	files, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return nil, errors.Wrap(err, "reading migrations")
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, f := range files {
+		m := migrationFile.FindStringSubmatch(f.Name())
+		if m == nil {
+			return nil, errors.Errorf("migration %s isn't named <version>_<name>.(up|down).sql", f.Name())
+		}
+
+		version, _ := strconv.Atoi(m[1])
+		if version < 1 {
+			return nil, errors.Errorf("migration %s : versions start at 1", f.Name())
+		}
+
+		b, err := migrations.ReadFile("migrations/" + f.Name())
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading migration %s", f.Name())
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, errors.Errorf("migration %d is named both %s and %s", version, mig.Name, m[2])
+		}
+
+		if m[3] == "up" {
+			mig.Up = string(b)
+		} else {
+			mig.Down = string(b)
+		}
+	}
+
+	all := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, errors.Errorf("migration %d_%s needs both an up and a down", m.Version, m.Name)
 		}
-	}()
+		all = append(all, *m)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+
+	return all, nil
+}
+
+// Version returns the version of the last migration applied, 0 when none have been
+func Version(db *sqlx.DB) (int, error) {
+	if _, err := db.Exec(dialect(db, schemaMigrations)); err != nil {
+		return 0, errors.Wrap(err, "creating schema_migrations")
+	}
+
+	var version int
+	if err := db.Get(&version, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`); err != nil {
+		return 0, errors.Wrap(err, "selecting version")
+	}
+
+	return version, nil
+}
+
+// Migrate applies every pending migration
+func Migrate(db *sqlx.DB) error {
+	all, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	if len(all) == 0 {
+		return nil
+	}
+
+	return MigrateTo(db, all[len(all)-1].Version)
+}
+
+// Rollback undoes the last migration applied
+func Rollback(db *sqlx.DB) error {
+	all, err := Migrations()
+	if err != nil {
+		return err
+	}
+
+	current, err := Version(db)
+	if err != nil {
+		return err
+	}
+
+	if current == 0 {
+		return ErrNothingApplied
+	}
+
+	// the version before the current one, 0 undoes them all
+	target := 0
+	for _, m := range all {
+		if m.Version < current {
+			target = m.Version
+		}
+	}
+
+	return MigrateTo(db, target)
+}
+
+// MigrateTo applies or undoes migrations until version is the last one applied, 0 undoes every migration. Each
+// migration runs in a transaction of its own so a failure leaves the database at the last version that succeeded
+func MigrateTo(db *sqlx.DB, version int) error {
+	all, err := Migrations()
+	if err != nil {
+		return err
+	}
 
-	db.MustExec(schema)
+	if version != 0 && !known(all, version) {
+		return ErrUnknownVersion
+	}
+
+	current, err := Version(db)
+	if err != nil {
+		return err
+	}
+
+	if current != 0 && !known(all, current) {
+		return errors.Errorf("database is at version %d which this binary doesn't know about", current)
+	}
+
+	if version >= current {
+		for _, m := range all {
+			if m.Version > current && m.Version <= version {
+				if err := up(db, m); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for i := len(all) - 1; i >= 0; i-- {
+		if m := all[i]; m.Version <= current && m.Version > version {
+			if err := down(db, m); err != nil {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
+
+// Statuses returns every migration along with when it was applied
+func Statuses(db *sqlx.DB) ([]Status, error) {
+	all, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := Version(db); err != nil {
+		return nil, err
+	}
+
+	var applied []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := db.Select(&applied, `SELECT version, applied_at FROM schema_migrations`); err != nil {
+		return nil, errors.Wrap(err, "selecting schema_migrations")
+	}
+
+	at := make(map[int]time.Time, len(applied))
+	for _, a := range applied {
+		at[a.Version] = a.AppliedAt
+	}
+
+	statuses := make([]Status, len(all))
+	for i, m := range all {
+		statuses[i].Migration = m
+		if t, ok := at[m.Version]; ok {
+			statuses[i].AppliedAt = &t
+		}
+	}
+
+	return statuses, nil
+}
+
+func known(all []Migration, version int) bool {
+	for _, m := range all {
+		if m.Version == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+func up(db *sqlx.DB, m Migration) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(dialect(db, m.Up)); err != nil {
+		return errors.Wrapf(err, "applying migration %s", m)
+	}
+
+	if backfill, ok := backfills[m.Version]; ok {
+		if err := backfill(tx); err != nil {
+			return errors.Wrapf(err, "backfilling migration %s", m)
+		}
+	}
+
+	const q = `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(q, m.Version, m.Name, time.Now().UTC()); err != nil {
+		return errors.Wrapf(err, "recording migration %s", m)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "committing migration %s", m)
+	}
+
+	return nil
+}
+
+func down(db *sqlx.DB, m Migration) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(dialect(db, m.Down)); err != nil {
+		return errors.Wrapf(err, "undoing migration %s", m)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+		return errors.Wrapf(err, "recording migration %s", m)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "committing migration %s", m)
+	}
+
+	return nil
+}
+
+// ipKeys sets the ip_key of the results stored before it was added, the address as 16 bytes like the ipresult
+// Store writes it
+func ipKeys(tx *sqlx.Tx) error {
+	var rows []struct {
+		IPAddress string `db:"ip_address"`
+		Provider  string `db:"provider"`
+	}
+	if err := tx.Select(&rows, `SELECT ip_address, provider FROM ip_results WHERE ip_key IS NULL`); err != nil {
+		return errors.Wrap(err, "selecting ip_results")
+	}
+
+	for _, r := range rows {
+		addr := net.ParseIP(r.IPAddress)
+		if addr == nil {
+			// nothing to key it by, it's left out of CIDR filters as it always was
+			continue
+		}
+
+		const q = `UPDATE ip_results SET ip_key = $1 WHERE ip_address = $2 AND provider = $3`
+		if _, err := tx.Exec(q, []byte(addr.To16()), r.IPAddress, r.Provider); err != nil {
+			return errors.Wrapf(err, "updating ip_key of %s", r.IPAddress)
+		}
+	}
+
+	return nil
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
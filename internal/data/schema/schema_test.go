@@ -0,0 +1,264 @@
+package schema_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	return db, teardown
+}
+
+// tables returns the number of our tables in the db, leaving out schema_migrations
+func tables(t *testing.T, db *sqlx.DB) int {
+	t.Helper()
+
+	var n int
+	const q = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_migrations'`
+	if err := db.Get(&n, q); err != nil {
+		t.Fatalf("unable to count tables : %v", err)
+	}
+
+	return n
+}
+
+func TestMigrate(t *testing.T) {
+	db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to version the schema.")
+
+	all, err := schema.Migrations()
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to read the embedded migrations : %s.", failure, err)
+	}
+	if len(all) == 0 {
+		t.Fatalf("\t%s\tShould embed at least one migration.", failure)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].Version <= all[i-1].Version {
+			t.Fatalf("\t%s\tShould return the migrations in version order : %v.", failure, all)
+		}
+	}
+	t.Logf("\t%s\tShould read the embedded migrations in version order.", success)
+	latest := all[len(all)-1].Version
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen migrating up.", testID)
+	{
+		if err := schema.Migrate(db); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to migrate : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to migrate.", success, testID)
+
+		v, err := schema.Version(db)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to read the version : %s.", failure, testID, err)
+		}
+		if v != latest {
+			t.Fatalf("\t%s\tTest %d:\tShould be at version %d : got %d.", failure, testID, latest, v)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be at the latest version.", success, testID)
+
+		statuses, err := schema.Statuses(db)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to read the statuses : %s.", failure, testID, err)
+		}
+		for _, s := range statuses {
+			if s.AppliedAt == nil {
+				t.Fatalf("\t%s\tTest %d:\tShould have applied %s.", failure, testID, s.Migration)
+			}
+		}
+		t.Logf("\t%s\tTest %d:\tShould have applied every migration.", success, testID)
+
+		// running it again finds nothing to do
+		if err := schema.Migrate(db); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to migrate again : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to migrate again.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen migrating to a version that doesn't exist.", testID)
+	{
+		if err := schema.MigrateTo(db, latest+1); errors.Cause(err) != schema.ErrUnknownVersion {
+			t.Fatalf("\t%s\tTest %d:\tShould receive ErrUnknownVersion : got %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould receive ErrUnknownVersion.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen rolling back every migration.", testID)
+	{
+		for i := len(all) - 1; i >= 0; i-- {
+			if err := schema.Rollback(db); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to roll back %s : %s.", failure, testID, all[i], err)
+			}
+
+			want := 0
+			if i > 0 {
+				want = all[i-1].Version
+			}
+			v, err := schema.Version(db)
+			if err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to read the version : %s.", failure, testID, err)
+			}
+			if v != want {
+				t.Fatalf("\t%s\tTest %d:\tShould be at version %d : got %d.", failure, testID, want, v)
+			}
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to roll back one migration at a time.", success, testID)
+
+		if n := tables(t, db); n != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould have dropped every table : %d left.", failure, testID, n)
+		}
+		t.Logf("\t%s\tTest %d:\tShould have dropped every table.", success, testID)
+
+		if err := schema.Rollback(db); errors.Cause(err) != schema.ErrNothingApplied {
+			t.Fatalf("\t%s\tTest %d:\tShould receive ErrNothingApplied : got %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould receive ErrNothingApplied with nothing to roll back.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen migrating to a version.", testID)
+	{
+		if err := schema.MigrateTo(db, latest); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to migrate to %d : %s.", failure, testID, latest, err)
+		}
+		if n := tables(t, db); n == 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould have created the tables.", failure, testID)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to migrate to a version.", success, testID)
+
+		if err := schema.MigrateTo(db, 0); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to migrate to 0 : %s.", failure, testID, err)
+		}
+		if n := tables(t, db); n != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould have dropped every table : %d left.", failure, testID, n)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to undo every migration by migrating to 0.", success, testID)
+	}
+}
+
+// baseline is ip_results as it was created before migrations were versioned, by Migrate's CREATE TABLE IF NOT EXISTS
+const baseline = `
+	CREATE TABLE IF NOT EXISTS ip_results (
+		ip_address TEXT PRIMARY KEY,
+		id TEXT UNIQUE,
+		created_at DATETIME,
+		updated_at DATETIME,
+		response_code TEXT
+	)
+`
+
+func TestMigrateExisting(t *testing.T) {
+	db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given a database created before migrations were versioned.")
+
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	db.MustExec(baseline)
+	db.MustExec(`INSERT INTO ip_results (ip_address, id, created_at, updated_at, response_code) VALUES ($1, $2, $3, $3, $4)`,
+		"127.0.0.2", "00000000-0000-0000-0000-000000000001", now, "127.0.0.2,127.0.0.4")
+	db.MustExec(`INSERT INTO ip_results (ip_address, id, created_at, updated_at, response_code) VALUES ($1, $2, $3, $3, NULL)`,
+		"2001:db8::1", "00000000-0000-0000-0000-000000000002", now)
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen migrating up.", testID)
+	{
+		if err := schema.Migrate(db); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to migrate : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to migrate.", success, testID)
+
+		// reading them through the store shows every column added since was filled in
+		s := ipresult.New(log.New(ioutil.Discard, "", 0), db)
+		ctx := context.Background()
+
+		listed, err := s.QueryByIP(ctx, "127.0.0.2", "spamhaus")
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould keep the existing rows as spamhaus results : %s.", failure, testID, err)
+		}
+		notListed, err := s.QueryByIP(ctx, "2001:db8::1", "spamhaus")
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould keep the existing rows as spamhaus results : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould keep the existing rows as spamhaus results.", success, testID)
+
+		if listed.Status != ipresult.StatusListed || *listed.ResponseCode != "127.0.0.2,127.0.0.4" ||
+			notListed.Status != ipresult.StatusNotListed || notListed.ResponseCode != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould derive the status from the codes : %+v %+v.", failure, testID, listed, notListed)
+		}
+		if listed.Attempts != 1 || !listed.LastAttemptAt.Equal(now) || !listed.CreatedAt.Equal(now) {
+			t.Fatalf("\t%s\tTest %d:\tShould keep the timestamps and record a single attempt : %+v.", failure, testID, listed)
+		}
+		t.Logf("\t%s\tTest %d:\tShould fill in the columns added since.", success, testID)
+
+		_, cidr, _ := net.ParseCIDR("2001:db8::/32")
+		page, err := s.QueryPage(ctx, ipresult.Filter{CIDR: cidr}, ipresult.Order{Field: ipresult.OrderIPAddress}, nil, 10)
+		if err != nil || len(page) != 1 || page[0].ID != notListed.ID {
+			t.Fatalf("\t%s\tTest %d:\tShould key the existing rows by address : %v %+v.", failure, testID, err, page)
+		}
+		t.Logf("\t%s\tTest %d:\tShould key the existing rows by address.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen rolling back to the baseline.", testID)
+	{
+		if err := schema.MigrateTo(db, 1); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to migrate to 1 : %s.", failure, testID, err)
+		}
+
+		var n int
+		if err := db.Get(&n, `SELECT COUNT(*) FROM ip_results`); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to count results : %s.", failure, testID, err)
+		}
+		if n != 2 {
+			t.Fatalf("\t%s\tTest %d:\tShould keep the rows : got %d.", failure, testID, n)
+		}
+		t.Logf("\t%s\tTest %d:\tShould keep the rows.", success, testID)
+	}
+}
@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"time"
+)
+
+// The periods Stats can be grouped by
+const (
+	GroupByDay  = "DAY"
+	GroupByWeek = "WEEK"
+)
+
+// Stats summarizes the stored results as they stand, and how they changed since a point in time
+type Stats struct {
+	Since time.Time `json:"since"`
+	// Results is the number of results, one per address and provider, and Addresses the number of distinct addresses.
+	// Listed is the number of those addresses listed under at least one code
+	Results   int `json:"results"`
+	Addresses int `json:"addresses"`
+	Listed    int `json:"listed"`
+	// Failing is the number of results whose most recent lookup failed
+	Failing int         `json:"failing"`
+	Codes   []CodeCount `json:"codes"`
+	// Buckets are the changes since Since, one per period, oldest first
+	Buckets []Bucket `json:"buckets"`
+}
+
+// CodeCount is the number of addresses a provider currently lists under a code
+type CodeCount struct {
+	Provider string `db:"provider" json:"provider"`
+	Code     string `db:"code" json:"code"`
+	List     string `db:"list" json:"list"`
+	Count    int    `db:"count" json:"count"`
+}
+
+// Bucket is what changed over a single period
+type Bucket struct {
+	Start time.Time `json:"start"`
+	// NewlyListed is the number of results that went from not listed, or never looked up, to listed and Delisted the
+	// number that went from listed to not listed, per the history of each result
+	NewlyListed int `json:"newly_listed"`
+	Delisted    int `json:"delisted"`
+	// Lookups and Failed are the lookups finished and failed by the jobs started in the period
+	Lookups int `json:"lookups"`
+	Failed  int `json:"failed"`
+}
+
+// ErrorRate is the fraction of the bucket's lookups that failed, zero when there were none
+func (b Bucket) ErrorRate() float64 {
+	if b.Lookups == 0 {
+		return 0
+	}
+
+	return float64(b.Failed) / float64(b.Lookups)
+}
@@ -0,0 +1,205 @@
+package stats
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+var (
+	ErrInvalidGroupBy = errors.New("unknown period to group by")
+	ErrTooManyBuckets = errors.New("too many periods between since and now")
+)
+
+// maxBuckets bounds the periods a single query returns, a couple of years of days
+const maxBuckets = 1000
+
+type Store struct {
+	log *log.Logger
+	db  *sqlx.DB
+}
+
+// New returns a configured Store
+func New(log *log.Logger, db *sqlx.DB) Store {
+	return Store{
+		log: log,
+		db:  db,
+	}
+}
+
+// Query computes the stats as of now, with a bucket for every period of groupBy from the one holding since to the
+// one holding now. Periods are in UTC and weeks start on Monday
+func (s Store) Query(traceID string, since time.Time, now time.Time, groupBy string) (Stats, error) {
+	if groupBy != GroupByDay && groupBy != GroupByWeek {
+		return Stats{}, ErrInvalidGroupBy
+	}
+
+	since = since.UTC()
+	now = now.UTC()
+
+	// build the empty buckets up front so periods where nothing happened still show up
+	var buckets []Bucket
+	index := make(map[time.Time]int)
+	for start := truncate(since, groupBy); !start.After(now); start = next(start, groupBy) {
+		if len(buckets) == maxBuckets {
+			return Stats{}, ErrTooManyBuckets
+		}
+		index[start] = len(buckets)
+		buckets = append(buckets, Bucket{Start: start})
+	}
+
+	st := Stats{
+		Since:   since,
+		Codes:   []CodeCount{},
+		Buckets: buckets,
+	}
+
+	s.log.Printf("%s : query : %s %s stats.Query", traceID, since.Format(time.RFC3339), groupBy)
+
+	const totals = `SELECT
+		COUNT(*) AS results,
+		COUNT(DISTINCT ip_address) AS addresses,
+		COUNT(DISTINCT CASE WHEN EXISTS (
+			SELECT 1 FROM ip_result_codes c WHERE c.ip_result_id = r.id AND c.removed_at IS NULL
+		) THEN ip_address END) AS listed,
+		COUNT(CASE WHEN status NOT IN ($1, $2) THEN 1 END) AS failing
+		FROM ip_results r`
+
+	row := struct {
+		Results   int `db:"results"`
+		Addresses int `db:"addresses"`
+		Listed    int `db:"listed"`
+		Failing   int `db:"failing"`
+	}{}
+	if err := s.db.Get(&row, totals, ipresult.StatusListed, ipresult.StatusNotListed); err != nil {
+		return Stats{}, errors.Wrap(err, "counting results")
+	}
+	st.Results, st.Addresses, st.Listed, st.Failing = row.Results, row.Addresses, row.Listed, row.Failing
+
+	const codes = `SELECT r.provider, c.code, c.list, COUNT(*) AS count
+		FROM ip_result_codes c JOIN ip_results r ON r.id = c.ip_result_id
+		WHERE c.removed_at IS NULL
+		GROUP BY r.provider, c.code, c.list
+		ORDER BY count DESC, r.provider, c.code`
+
+	if err := s.db.Select(&st.Codes, codes); err != nil {
+		return Stats{}, errors.Wrap(err, "counting codes")
+	}
+
+	// the changes and lookups are counted by the database a day at a time, which are then added up into the buckets,
+	// so a long since doesn't mean reading every row since then. A bucket is a whole number of days
+	day := s.day
+
+	// a change is a listing when the entry before it, if there is one, wasn't listed and a delisting when it was.
+	// Changes from one set of codes to another don't count as either
+	changes := `SELECT ` + day("h.changed_at") + ` AS day,
+		COUNT(CASE WHEN h.status = $1 THEN 1 END) AS listed,
+		COUNT(CASE WHEN h.status = $2 THEN 1 END) AS delisted
+		FROM ip_result_history h
+		LEFT JOIN ip_result_history p ON p.ip_result_id = h.ip_result_id AND p.seq = h.seq - 1
+		WHERE h.changed_at >= $3 AND (
+			(h.status = $1 AND (p.status IS NULL OR p.status = $2)) OR
+			(h.status = $2 AND p.status = $1)
+		)
+		GROUP BY 1`
+
+	var history []struct {
+		Day      string `db:"day"`
+		Listed   int    `db:"listed"`
+		Delisted int    `db:"delisted"`
+	}
+	if err := s.db.Select(&history, changes, ipresult.StatusListed, ipresult.StatusNotListed, since); err != nil {
+		return Stats{}, errors.Wrap(err, "counting changes")
+	}
+
+	for _, h := range history {
+		i, ok, err := bucket(index, h.Day, groupBy)
+		if err != nil {
+			return Stats{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		st.Buckets[i].NewlyListed += h.Listed
+		st.Buckets[i].Delisted += h.Delisted
+	}
+
+	lookups := `SELECT ` + day("created_at") + ` AS day,
+		COALESCE(SUM(completed + failed), 0) AS lookups,
+		COALESCE(SUM(failed), 0) AS failed
+		FROM jobs WHERE created_at >= $1
+		GROUP BY 1`
+
+	var jobs []struct {
+		Day     string `db:"day"`
+		Lookups int    `db:"lookups"`
+		Failed  int    `db:"failed"`
+	}
+	if err := s.db.Select(&jobs, lookups, since); err != nil {
+		return Stats{}, errors.Wrap(err, "counting lookups")
+	}
+
+	for _, j := range jobs {
+		i, ok, err := bucket(index, j.Day, groupBy)
+		if err != nil {
+			return Stats{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		st.Buckets[i].Lookups += j.Lookups
+		st.Buckets[i].Failed += j.Failed
+	}
+
+	return st, nil
+}
+
+// day returns the expression for the UTC day of the timestamp column, as YYYY-MM-DD
+func (s Store) day(column string) string {
+	if s.db.DriverName() == database.DriverPostgres {
+		return fmt.Sprintf("to_char(%s AT TIME ZONE 'UTC', 'YYYY-MM-DD')", column)
+	}
+
+	return fmt.Sprintf("date(%s)", column)
+}
+
+// bucket returns the index of the bucket holding the day, a YYYY-MM-DD date, and false when there isn't one
+func bucket(index map[time.Time]int, day string, groupBy string) (int, bool, error) {
+	d, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "parsing day %q", day)
+	}
+
+	i, ok := index[truncate(d, groupBy)]
+	return i, ok, nil
+}
+
+// truncate returns the start of the period holding t
+func truncate(t time.Time, groupBy string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	if groupBy == GroupByWeek {
+		// Sunday is 0, go back to the Monday before it
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	}
+
+	return day
+}
+
+// next returns the start of the period after the one starting at start
+func next(start time.Time, groupBy string) time.Time {
+	if groupBy == GroupByWeek {
+		return start.AddDate(0, 0, 7)
+	}
+
+	return start.AddDate(0, 0, 1)
+}
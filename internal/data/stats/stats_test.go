@@ -0,0 +1,186 @@
+package stats_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/data/stats"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+func TestStats(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to report on the stored results.")
+	// ============================================================================
+	// Setup: over three days, starting on a Monday, list and delist a few addresses and run a job a day
+	s := stats.New(log, db)
+	results := ipresult.New(log, db)
+	jobs := job.New(log, db)
+
+	day := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+	ctx := trace.WithID(context.Background(), traceID)
+
+	sbl, xbl := "127.0.0.2", "127.0.0.4"
+	listed := func(code string, list string) ipresult.UpdateIPResult {
+		return ipresult.UpdateIPResult{ResponseCode: &code, Codes: []ipresult.Code{{Code: code, List: list}}}
+	}
+
+	writes := []struct {
+		ip  string
+		up  ipresult.UpdateIPResult
+		day int
+	}{
+		// day 0: two addresses listed and one clean
+		{"10.0.0.1", listed(sbl, "SBL"), 0},
+		{"10.0.0.2", listed(sbl, "SBL"), 0},
+		{"10.0.0.3", ipresult.UpdateIPResult{}, 0},
+		// day 1: one moves from SBL to XBL, which is neither a listing nor a delisting, and the clean one is listed
+		{"10.0.0.1", listed(xbl, "XBL"), 1},
+		{"10.0.0.3", listed(sbl, "SBL"), 1},
+		// day 2: one is delisted
+		{"10.0.0.2", ipresult.UpdateIPResult{}, 2},
+	}
+
+	for _, w := range writes {
+		if _, _, err := results.AddOrUpdate(ctx, w.ip, "spamhaus", w.up, day.AddDate(0, 0, w.day)); err != nil {
+			t.Fatalf("unable to add an IP result %v", err)
+		}
+	}
+
+	// the last lookup of 10.0.0.3 fails, it keeps its listing
+	if _, err := results.RecordFailure(ctx, "10.0.0.3", "spamhaus", ipresult.FailedLookup{Status: ipresult.StatusDNSTimeout,
+		Err: errors.New("timeout"), Attempts: 3}, day.AddDate(0, 0, 2)); err != nil {
+		t.Fatalf("unable to record a failure %v", err)
+	}
+
+	for d, failed := range []int{0, 1, 3} {
+		j, err := jobs.Create(ctx, job.NewJob{Total: 4}, day.AddDate(0, 0, d))
+		if err != nil {
+			t.Fatalf("unable to create job %v", err)
+		}
+
+		for i := 0; i < 4; i++ {
+			if _, err := jobs.RecordLookup(ctx, j.ID, i < failed, day.AddDate(0, 0, d)); err != nil {
+				t.Fatalf("unable to record lookup %v", err)
+			}
+		}
+	}
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen grouping by day.", testID)
+	{
+		st, err := s.Query(traceID, day, day.AddDate(0, 0, 2).Add(time.Hour), stats.GroupByDay)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to query stats : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to query stats.", success, testID)
+
+		if st.Results != 3 || st.Addresses != 3 || st.Listed != 2 || st.Failing != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould count the results : %+v.", failure, testID, st)
+		}
+		t.Logf("\t%s\tTest %d:\tShould count the results.", success, testID)
+
+		wantCodes := []stats.CodeCount{
+			{Provider: "spamhaus", Code: sbl, List: "SBL", Count: 1},
+			{Provider: "spamhaus", Code: xbl, List: "XBL", Count: 1},
+		}
+		if diff := cmp.Diff(wantCodes, st.Codes); diff != "" {
+			t.Fatalf("\t%s\tTest %d:\tShould count the codes. Diff:\n %s.", failure, testID, diff)
+		}
+		t.Logf("\t%s\tTest %d:\tShould count the codes.", success, testID)
+
+		wantBuckets := []stats.Bucket{
+			{Start: day, NewlyListed: 2, Lookups: 4},
+			{Start: day.AddDate(0, 0, 1), NewlyListed: 1, Lookups: 4, Failed: 1},
+			{Start: day.AddDate(0, 0, 2), Delisted: 1, Lookups: 4, Failed: 3},
+		}
+		if diff := cmp.Diff(wantBuckets, st.Buckets); diff != "" {
+			t.Fatalf("\t%s\tTest %d:\tShould count the changes each day. Diff:\n %s.", failure, testID, diff)
+		}
+		t.Logf("\t%s\tTest %d:\tShould count the changes each day.", success, testID)
+
+		if st.Buckets[2].ErrorRate() != 0.75 {
+			t.Fatalf("\t%s\tTest %d:\tShould compute the error rate : %v.", failure, testID, st.Buckets[2].ErrorRate())
+		}
+		t.Logf("\t%s\tTest %d:\tShould compute the error rate.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen grouping by week.", testID)
+	{
+		st, err := s.Query(traceID, day.Add(12*time.Hour), day.AddDate(0, 0, 2), stats.GroupByWeek)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to query stats : %s.", failure, testID, err)
+		}
+
+		// the first day's changes are before since
+		want := []stats.Bucket{{Start: day, NewlyListed: 1, Delisted: 1, Lookups: 8, Failed: 4}}
+		if diff := cmp.Diff(want, st.Buckets); diff != "" {
+			t.Fatalf("\t%s\tTest %d:\tShould count the changes since, in a single week. Diff:\n %s.", failure, testID, diff)
+		}
+		t.Logf("\t%s\tTest %d:\tShould count the changes since, in a single week.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen grouping by an unknown period.", testID)
+	{
+		if _, err := s.Query(traceID, day, day, "MONTH"); errors.Cause(err) != stats.ErrInvalidGroupBy {
+			t.Fatalf("\t%s\tTest %d:\tShould receive ErrInvalidGroupBy : %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould receive ErrInvalidGroupBy.", success, testID)
+	}
+}
@@ -0,0 +1,11 @@
+package watch
+
+import (
+	"time"
+)
+
+// A Watch marks an address the scheduler keeps checking on its own
+type Watch struct {
+	IPAddress string    `db:"ip_address" json:"ip_address"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,104 @@
+package watch
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/trace"
+)
+
+var (
+	ErrInvalidIP = errors.New("IP is not in its proper form")
+)
+
+type Store struct {
+	log *log.Logger
+	db  *sqlx.DB
+}
+
+// New returns a configured Store
+func New(log *log.Logger, db *sqlx.DB) Store {
+	return Store{
+		log: log,
+		db:  db,
+	}
+}
+
+// Add watches each address, addresses already watched keep the time they were first watched. Addresses are stored
+// in their canonical form, the same as ip_results
+func (s Store) Add(ctx context.Context, ips []string, now time.Time) error {
+	const q = `INSERT INTO watched_ips (ip_address, created_at) VALUES ($1, $2)
+		ON CONFLICT (ip_address) DO NOTHING`
+
+	s.log.Printf("%s : query : %d watch.Add", trace.ID(ctx), len(ips))
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return ErrInvalidIP
+		}
+
+		if _, err := tx.ExecContext(ctx, q, addr.String(), now.UTC()); err != nil {
+			return errors.Wrap(err, "inserting watch")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return nil
+}
+
+// Remove stops watching each address, addresses that weren't watched are ignored. Their results are kept
+func (s Store) Remove(ctx context.Context, ips []string) error {
+	canonical := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return ErrInvalidIP
+		}
+		canonical = append(canonical, addr.String())
+	}
+
+	if len(canonical) == 0 {
+		return nil
+	}
+
+	q, args, err := sqlx.In(`DELETE FROM watched_ips WHERE ip_address IN (?)`, canonical)
+	if err != nil {
+		return errors.Wrap(err, "building delete")
+	}
+
+	s.log.Printf("%s : query : %d watch.Remove", trace.ID(ctx), len(canonical))
+
+	if _, err := s.db.ExecContext(ctx, s.db.Rebind(q), args...); err != nil {
+		return errors.Wrap(err, "deleting watches")
+	}
+
+	return nil
+}
+
+// Query returns every watched address, in the order they were watched
+func (s Store) Query(ctx context.Context) ([]Watch, error) {
+	const q = `SELECT * FROM watched_ips ORDER BY created_at, ip_address`
+
+	s.log.Printf("%s : query : watch.Query", trace.ID(ctx))
+
+	watches := []Watch{}
+	if err := s.db.SelectContext(ctx, &watches, q); err != nil {
+		return nil, errors.Wrap(err, "selecting watches")
+	}
+
+	return watches, nil
+}
@@ -0,0 +1,118 @@
+package watch_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/data/watch"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+func TestWatch(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to keep track of watched addresses.")
+	// ============================================================================
+	// Setup: create a watch store
+	s := watch.New(log, db)
+
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+	ctx := trace.WithID(context.Background(), traceID)
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen watching addresses.", testID)
+	{
+		if err := s.Add(ctx, []string{"199.83.128.60", "2001:DB8:0:0::1"}, now); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to watch addresses : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to watch addresses.", success, testID)
+
+		// watching an address twice keeps the first time it was watched
+		if err := s.Add(ctx, []string{"199.83.128.60"}, now.Add(time.Hour)); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to watch an address again : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to watch an address again.", success, testID)
+
+		watches, err := s.Query(ctx)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to query watches : %s.", failure, testID, err)
+		}
+
+		if len(watches) != 2 || watches[0].IPAddress != "199.83.128.60" || !watches[0].CreatedAt.Equal(now) || watches[1].IPAddress != "2001:db8::1" {
+			t.Fatalf("\t%s\tTest %d:\tShould store each canonical address once : %+v.", failure, testID, watches)
+		}
+		t.Logf("\t%s\tTest %d:\tShould store each canonical address once.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen unwatching addresses.", testID)
+	{
+		if err := s.Remove(ctx, []string{"2001:db8::1", "127.0.0.1"}); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to unwatch addresses : %s.", failure, testID, err)
+		}
+
+		watches, err := s.Query(ctx)
+		if err != nil || len(watches) != 1 || watches[0].IPAddress != "199.83.128.60" {
+			t.Fatalf("\t%s\tTest %d:\tShould only remove the watched address : %v %+v.", failure, testID, err, watches)
+		}
+		t.Logf("\t%s\tTest %d:\tShould only remove the watched address.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen watching an invalid address.", testID)
+	{
+		if err := s.Add(ctx, []string{"not an ip"}, now); err != watch.ErrInvalidIP {
+			t.Fatalf("\t%s\tTest %d:\tShould be rejected : %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be rejected.", success, testID)
+	}
+}
@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"time"
+)
+
+// The changes to a listing a webhook can be notified of
+const (
+	// EventListed is an address being listed after it wasn't, or the first lookup of an address finding it listed
+	EventListed = "LISTED"
+	// EventDelisted is a listed address no longer being listed
+	EventDelisted = "DELISTED"
+	// EventCodeChanged is a listed address being listed under a different set of codes
+	EventCodeChanged = "CODE_CHANGED"
+)
+
+// The lifecycle of a Delivery. A delivery is pending until it's claimed, goes back to pending when it's retried
+// and ends up delivered or, once it's out of attempts, dead
+const (
+	StatusPending   = "PENDING"
+	StatusClaimed   = "CLAIMED"
+	StatusDelivered = "DELIVERED"
+	StatusDead      = "DEAD"
+)
+
+// A complete Webhook
+type Webhook struct {
+	ID  string `db:"id" json:"id"`
+	URL string `db:"url" json:"url"`
+	// Secret signs the body of each delivery, it's never returned to clients
+	Secret string `db:"secret" json:"-"`
+	// Events and CIDRs filter what the webhook is notified of, either being empty matches everything
+	Events    []string  `db:"-" json:"events"`
+	CIDRs     []string  `db:"-" json:"cidrs"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// The subset of fields necessary to construct a Webhook
+type NewWebhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	CIDRs  []string `json:"cidrs"`
+}
+
+// A complete Delivery, a single notification sent to a webhook
+type Delivery struct {
+	ID        string `db:"id" json:"id"`
+	WebhookID string `db:"webhook_id" json:"webhook_id"`
+	TraceID   string `db:"trace_id" json:"trace_id"`
+	Event     string `db:"event" json:"event"`
+	// Payload is the JSON body sent to the webhook
+	Payload string `db:"payload" json:"payload"`
+	Status  string `db:"status" json:"status"`
+	// Attempts is the number of times the delivery has been claimed, LastError is the error of the last failed attempt
+	Attempts    int        `db:"attempts" json:"attempts"`
+	LastError   *string    `db:"last_error" json:"last_error"`
+	AvailableAt time.Time  `db:"available_at" json:"available_at"`
+	ClaimedAt   *time.Time `db:"claimed_at" json:"claimed_at"`
+	DeliveredAt *time.Time `db:"delivered_at" json:"delivered_at"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at" json:"updated_at"`
+}
+
+// The subset of fields necessary to construct a Delivery
+type NewDelivery struct {
+	WebhookID string `json:"webhook_id"`
+	Event     string `json:"event"`
+	Payload   string `json:"payload"`
+}
@@ -0,0 +1,451 @@
+package webhook
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrInvalidID    = errors.New("ID is not in its proper form")
+	ErrInvalidURL   = errors.New("URL must be an absolute http or https URL")
+	ErrInvalidCIDR  = errors.New("CIDR is not in its proper form")
+	ErrInvalidEvent = errors.New("unknown event")
+	ErrNoSecret     = errors.New("secret is required")
+)
+
+type Store struct {
+	log *log.Logger
+	db  *sqlx.DB
+}
+
+// New returns a configured Store
+func New(log *log.Logger, db *sqlx.DB) Store {
+	return Store{
+		log: log,
+		db:  db,
+	}
+}
+
+// row is a Webhook as it's stored, with its lists joined
+type row struct {
+	ID        string    `db:"id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Events    string    `db:"events"`
+	CIDRs     string    `db:"cidrs"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func (r row) webhook() Webhook {
+	return Webhook{
+		ID:        r.ID,
+		URL:       r.URL,
+		Secret:    r.Secret,
+		Events:    split(r.Events),
+		CIDRs:     split(r.CIDRs),
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+	}
+}
+
+// Create validates and inserts a new webhook. CIDRs are stored in their canonical form, ex 10.0.0.1/8 is 10.0.0.0/8
+func (s Store) Create(traceID string, nw NewWebhook, now time.Time) (Webhook, error) {
+	u, err := url.Parse(nw.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, ErrInvalidURL
+	}
+
+	if nw.Secret == "" {
+		return Webhook{}, ErrNoSecret
+	}
+
+	for _, e := range nw.Events {
+		if e != EventListed && e != EventDelisted && e != EventCodeChanged {
+			return Webhook{}, ErrInvalidEvent
+		}
+	}
+
+	cidrs := make([]string, 0, len(nw.CIDRs))
+	for _, c := range nw.CIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return Webhook{}, ErrInvalidCIDR
+		}
+		cidrs = append(cidrs, n.String())
+	}
+
+	w := Webhook{
+		ID:        uuid.New().String(),
+		URL:       u.String(),
+		Secret:    nw.Secret,
+		Events:    nw.Events,
+		CIDRs:     cidrs,
+		CreatedAt: now.UTC(),
+		UpdatedAt: now.UTC(),
+	}
+
+	const q = `INSERT INTO webhooks
+		(id, url, secret, events, cidrs, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	s.log.Printf("%s : query : %s webhook.Create", traceID, w.ID)
+
+	if _, err := s.db.Exec(q, w.ID, w.URL, w.Secret, strings.Join(w.Events, ","), strings.Join(w.CIDRs, ","),
+		w.CreatedAt, w.UpdatedAt); err != nil {
+		return Webhook{}, errors.Wrap(err, "inserting webhook")
+	}
+
+	return w, nil
+}
+
+// Delete removes a webhook along with its deliveries
+func (s Store) Delete(traceID string, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `DELETE FROM webhooks WHERE id = $1`
+
+	s.log.Printf("%s : query : %s webhook.Delete", traceID, id)
+
+	res, err := s.db.Exec(q, id)
+	if err != nil {
+		return errors.Wrapf(err, "deleting webhook %q", id)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "deleting webhook %q", id)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// QueryByID finds the webhook by its ID
+func (s Store) QueryByID(traceID string, id string) (Webhook, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Webhook{}, ErrInvalidID
+	}
+
+	const q = `SELECT * FROM webhooks WHERE id = $1`
+
+	s.log.Printf("%s : query : %s webhook.QueryByID", traceID, id)
+
+	var r row
+	if err := s.db.Get(&r, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return Webhook{}, ErrNotFound
+		}
+
+		return Webhook{}, errors.Wrapf(err, "selecting webhook %q", id)
+	}
+
+	return r.webhook(), nil
+}
+
+// Query returns every webhook, oldest first
+func (s Store) Query(traceID string) ([]Webhook, error) {
+	const q = `SELECT * FROM webhooks ORDER BY created_at, id`
+
+	s.log.Printf("%s : query : webhook.Query", traceID)
+
+	var rows []row
+	if err := s.db.Select(&rows, q); err != nil {
+		return nil, errors.Wrap(err, "selecting webhooks")
+	}
+
+	hooks := make([]Webhook, 0, len(rows))
+	for _, r := range rows {
+		hooks = append(hooks, r.webhook())
+	}
+
+	return hooks, nil
+}
+
+// Matches reports whether the webhook wants to be notified of the event for the ip address
+func (w Webhook) Matches(event string, ip string) bool {
+	if len(w.Events) > 0 {
+		var found bool
+		for _, e := range w.Events {
+			found = found || e == event
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(w.CIDRs) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	for _, c := range w.CIDRs {
+		if _, n, err := net.ParseCIDR(c); err == nil && n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Enqueue inserts the deliveries as pending, available right away
+func (s Store) Enqueue(traceID string, newDeliveries []NewDelivery, now time.Time) ([]Delivery, error) {
+	const q = `INSERT INTO webhook_deliveries
+		(id, webhook_id, trace_id, event, payload, status, attempts, available_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	s.log.Printf("%s : query : %d webhook.Enqueue", traceID, len(newDeliveries))
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	deliveries := make([]Delivery, 0, len(newDeliveries))
+	for _, nd := range newDeliveries {
+		d := Delivery{
+			ID:          uuid.New().String(),
+			WebhookID:   nd.WebhookID,
+			TraceID:     traceID,
+			Event:       nd.Event,
+			Payload:     nd.Payload,
+			Status:      StatusPending,
+			AvailableAt: now.UTC(),
+			CreatedAt:   now.UTC(),
+			UpdatedAt:   now.UTC(),
+		}
+
+		if _, err := tx.Exec(q, d.ID, d.WebhookID, d.TraceID, d.Event, d.Payload, d.Status, d.Attempts, d.AvailableAt,
+			d.CreatedAt, d.UpdatedAt); err != nil {
+			return nil, errors.Wrap(err, "inserting delivery")
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "committing transaction")
+	}
+
+	return deliveries, nil
+}
+
+// Claim claims up to limit of the pending deliveries that are available, oldest first, and counts an attempt
+// against each. A claimed delivery is invisible to other claims until it's retried, delivered or given up on
+func (s Store) Claim(traceID string, limit int, now time.Time) ([]Delivery, error) {
+	sel := `SELECT * FROM webhook_deliveries WHERE status = $1 AND available_at <= $2
+		ORDER BY available_at, created_at LIMIT $3`
+	if s.db.DriverName() == database.DriverPostgres {
+		// other replicas skip the rows we're claiming rather than claiming them too or waiting on our lock
+		sel += " FOR UPDATE SKIP LOCKED"
+	}
+
+	s.log.Printf("%s : query : webhook.Claim", traceID)
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, errors.Wrap(err, "beginning transaction")
+	}
+	defer tx.Rollback()
+
+	var deliveries []Delivery
+	if err := tx.Select(&deliveries, sel, StatusPending, now.UTC(), limit); err != nil {
+		return nil, errors.Wrap(err, "selecting deliveries")
+	}
+
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+
+	claimed := now.UTC()
+	ids := make([]string, 0, len(deliveries))
+	for i := range deliveries {
+		deliveries[i].Status = StatusClaimed
+		deliveries[i].Attempts++
+		deliveries[i].ClaimedAt = &claimed
+		deliveries[i].UpdatedAt = claimed
+		ids = append(ids, deliveries[i].ID)
+	}
+
+	upd, args, err := sqlx.In(`UPDATE webhook_deliveries SET status = ?, attempts = attempts + 1, claimed_at = ?, updated_at = ?
+		WHERE id IN (?)`, StatusClaimed, claimed, claimed, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "building claim query")
+	}
+
+	if _, err := tx.Exec(tx.Rebind(upd), args...); err != nil {
+		return nil, errors.Wrap(err, "claiming deliveries")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "committing transaction")
+	}
+
+	return deliveries, nil
+}
+
+// Delivered marks a claimed delivery as delivered
+func (s Store) Delivered(traceID string, id string, now time.Time) error {
+	const q = `UPDATE webhook_deliveries SET status = $1, last_error = NULL, claimed_at = NULL, delivered_at = $2,
+		updated_at = $2 WHERE id = $3 AND status = $4`
+
+	s.log.Printf("%s : query : %s webhook.Delivered", traceID, id)
+
+	return s.exec(q, StatusDelivered, now.UTC(), id, StatusClaimed)
+}
+
+// Retry puts a claimed delivery back to pending once availableAt has passed, recording the error of the failed attempt
+func (s Store) Retry(traceID string, id string, deliveryErr error, availableAt time.Time, now time.Time) error {
+	const q = `UPDATE webhook_deliveries SET status = $1, last_error = $2, available_at = $3, claimed_at = NULL,
+		updated_at = $4 WHERE id = $5 AND status = $6`
+
+	s.log.Printf("%s : query : %s webhook.Retry", traceID, id)
+
+	return s.exec(q, StatusPending, deliveryErr.Error(), availableAt.UTC(), now.UTC(), id, StatusClaimed)
+}
+
+// Release puts a claimed delivery back to pending without counting the attempt, for deliveries abandoned on shutdown
+func (s Store) Release(traceID string, id string, now time.Time) error {
+	const q = `UPDATE webhook_deliveries SET status = $1, attempts = attempts - 1, claimed_at = NULL, updated_at = $2
+		WHERE id = $3 AND status = $4`
+
+	s.log.Printf("%s : query : %s webhook.Release", traceID, id)
+
+	return s.exec(q, StatusPending, now.UTC(), id, StatusClaimed)
+}
+
+// Dead gives up on a claimed delivery, it's kept with the error of its last attempt so it can be looked into and
+// sent again with Redeliver
+func (s Store) Dead(traceID string, id string, deliveryErr error, now time.Time) error {
+	const q = `UPDATE webhook_deliveries SET status = $1, last_error = $2, claimed_at = NULL, updated_at = $3
+		WHERE id = $4 AND status = $5`
+
+	s.log.Printf("%s : query : %s webhook.Dead", traceID, id)
+
+	return s.exec(q, StatusDead, deliveryErr.Error(), now.UTC(), id, StatusClaimed)
+}
+
+// Redeliver puts a dead delivery back to pending with a fresh set of attempts
+func (s Store) Redeliver(traceID string, id string, now time.Time) (Delivery, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Delivery{}, ErrInvalidID
+	}
+
+	const q = `UPDATE webhook_deliveries SET status = $1, attempts = 0, available_at = $2, updated_at = $2
+		WHERE id = $3 AND status = $4`
+
+	s.log.Printf("%s : query : %s webhook.Redeliver", traceID, id)
+
+	if err := s.exec(q, StatusPending, now.UTC(), id, StatusDead); err != nil {
+		return Delivery{}, err
+	}
+
+	return s.QueryDeliveryByID(traceID, id)
+}
+
+// Recover puts the deliveries claimed before claimedBefore back to pending and returns how many there were, see
+// queue.Recover
+func (s Store) Recover(traceID string, claimedBefore time.Time, now time.Time) (int, error) {
+	const q = `UPDATE webhook_deliveries SET status = $1, claimed_at = NULL, updated_at = $2
+		WHERE status = $3 AND claimed_at < $4`
+
+	s.log.Printf("%s : query : webhook.Recover", traceID)
+
+	res, err := s.db.Exec(q, StatusPending, now.UTC(), StatusClaimed, claimedBefore.UTC())
+	if err != nil {
+		return 0, errors.Wrap(err, "recovering deliveries")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "recovering deliveries")
+	}
+
+	return int(n), nil
+}
+
+// QueryDeliveryByID finds the delivery by its ID
+func (s Store) QueryDeliveryByID(traceID string, id string) (Delivery, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return Delivery{}, ErrInvalidID
+	}
+
+	const q = `SELECT * FROM webhook_deliveries WHERE id = $1`
+
+	s.log.Printf("%s : query : %s webhook.QueryDeliveryByID", traceID, id)
+
+	var d Delivery
+	if err := s.db.Get(&d, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return Delivery{}, ErrNotFound
+		}
+
+		return Delivery{}, errors.Wrapf(err, "selecting delivery %q", id)
+	}
+
+	return d, nil
+}
+
+// QueryDeliveries returns up to limit of a webhook's deliveries, newest first, only those with the given status
+// when it isn't empty
+func (s Store) QueryDeliveries(traceID string, webhookID string, status string, limit int) ([]Delivery, error) {
+	if _, err := uuid.Parse(webhookID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	const q = `SELECT * FROM webhook_deliveries WHERE webhook_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC, id LIMIT $3`
+
+	s.log.Printf("%s : query : %s webhook.QueryDeliveries", traceID, webhookID)
+
+	deliveries := []Delivery{}
+	if err := s.db.Select(&deliveries, q, webhookID, status, limit); err != nil {
+		return nil, errors.Wrapf(err, "selecting deliveries of %q", webhookID)
+	}
+
+	return deliveries, nil
+}
+
+// exec runs a statement that changes a single delivery, reporting ErrNotFound when no delivery matched
+func (s Store) exec(q string, args ...interface{}) error {
+	res, err := s.db.Exec(q, args...)
+	if err != nil {
+		return errors.Wrap(err, "updating delivery")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "updating delivery")
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// split undoes strings.Join, an empty string is an empty list rather than a list of one empty string
+func split(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+
+	return strings.Split(s, ",")
+}
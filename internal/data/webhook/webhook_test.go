@@ -0,0 +1,244 @@
+package webhook_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+func TestWebhook(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to register webhooks.")
+	// ============================================================================
+	// Setup: create a webhook store
+	s := webhook.New(log, db)
+
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen registering an invalid webhook.", testID)
+	{
+		invalid := []struct {
+			nw  webhook.NewWebhook
+			err error
+		}{
+			{webhook.NewWebhook{URL: "ftp://example.com", Secret: "s"}, webhook.ErrInvalidURL},
+			{webhook.NewWebhook{URL: "https://example.com"}, webhook.ErrNoSecret},
+			{webhook.NewWebhook{URL: "https://example.com", Secret: "s", Events: []string{"UNKNOWN"}}, webhook.ErrInvalidEvent},
+			{webhook.NewWebhook{URL: "https://example.com", Secret: "s", CIDRs: []string{"10.0.0.1"}}, webhook.ErrInvalidCIDR},
+		}
+
+		for _, tt := range invalid {
+			if _, err := s.Create(traceID, tt.nw, now); errors.Cause(err) != tt.err {
+				t.Fatalf("\t%s\tTest %d:\tShould receive %v : %v.", failure, testID, tt.err, err)
+			}
+		}
+		t.Logf("\t%s\tTest %d:\tShould receive an error for each invalid webhook.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen registering a webhook.", testID)
+	{
+		nw := webhook.NewWebhook{
+			URL:    "https://example.com/hook",
+			Secret: "secret",
+			Events: []string{webhook.EventListed},
+			CIDRs:  []string{"10.1.2.3/8"},
+		}
+
+		w, err := s.Create(traceID, nw, now)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to create a webhook : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to create a webhook.", success, testID)
+
+		got, err := s.QueryByID(traceID, w.ID)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to query the webhook : %s.", failure, testID, err)
+		}
+		if got.Secret != "secret" || len(got.CIDRs) != 1 || got.CIDRs[0] != "10.0.0.0/8" {
+			t.Fatalf("\t%s\tTest %d:\tShould store the canonical CIDR : %+v.", failure, testID, got)
+		}
+		t.Logf("\t%s\tTest %d:\tShould store the canonical CIDR.", success, testID)
+
+		matches := []struct {
+			event string
+			ip    string
+			want  bool
+		}{
+			{webhook.EventListed, "10.9.9.9", true},
+			{webhook.EventDelisted, "10.9.9.9", false},
+			{webhook.EventListed, "11.0.0.1", false},
+		}
+		for _, tt := range matches {
+			if got.Matches(tt.event, tt.ip) != tt.want {
+				t.Fatalf("\t%s\tTest %d:\tShould match %s %s : %v.", failure, testID, tt.event, tt.ip, tt.want)
+			}
+		}
+		t.Logf("\t%s\tTest %d:\tShould match on its events and CIDRs.", success, testID)
+
+		if err := s.Delete(traceID, w.ID); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to delete the webhook : %s.", failure, testID, err)
+		}
+		if _, err := s.QueryByID(traceID, w.ID); errors.Cause(err) != webhook.ErrNotFound {
+			t.Fatalf("\t%s\tTest %d:\tShould not find the deleted webhook : %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to delete the webhook.", success, testID)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to keep track of deliveries.")
+	// ============================================================================
+	// Setup: create a webhook store and a webhook
+	s := webhook.New(log, db)
+
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+	traceID := "00000000-0000-0000-0000-000000000000"
+
+	w, err := s.Create(traceID, webhook.NewWebhook{URL: "https://example.com/hook", Secret: "secret"}, now)
+	if err != nil {
+		t.Fatalf("creating webhook: %v", err)
+	}
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen claiming a delivery.", testID)
+	var d webhook.Delivery
+	{
+		nd := webhook.NewDelivery{WebhookID: w.ID, Event: webhook.EventListed, Payload: `{}`}
+		if _, err := s.Enqueue(traceID, []webhook.NewDelivery{nd}, now); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to enqueue a delivery : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to enqueue a delivery.", success, testID)
+
+		claimed, err := s.Claim(traceID, 10, now)
+		if err != nil || len(claimed) != 1 || claimed[0].Attempts != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould claim the delivery with one attempt : %+v %v.", failure, testID, claimed, err)
+		}
+		d = claimed[0]
+		t.Logf("\t%s\tTest %d:\tShould claim the delivery with one attempt.", success, testID)
+
+		if claimed, _ := s.Claim(traceID, 10, now); len(claimed) != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould not claim the delivery twice : %+v.", failure, testID, claimed)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not claim the delivery twice.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen retrying a delivery.", testID)
+	{
+		if err := s.Retry(traceID, d.ID, errors.New("503"), now.Add(time.Minute), now); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to retry the delivery : %s.", failure, testID, err)
+		}
+
+		if claimed, _ := s.Claim(traceID, 10, now); len(claimed) != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould not claim the delivery before it's available : %+v.", failure, testID, claimed)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not claim the delivery before it's available.", success, testID)
+
+		claimed, err := s.Claim(traceID, 10, now.Add(time.Minute))
+		if err != nil || len(claimed) != 1 || claimed[0].Attempts != 2 || *claimed[0].LastError != "503" {
+			t.Fatalf("\t%s\tTest %d:\tShould claim the delivery again : %+v %v.", failure, testID, claimed, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould claim the delivery again once it's available.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen giving up on a delivery.", testID)
+	{
+		if err := s.Dead(traceID, d.ID, errors.New("503"), now); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to give up on the delivery : %s.", failure, testID, err)
+		}
+
+		dead, err := s.QueryDeliveries(traceID, w.ID, webhook.StatusDead, 10)
+		if err != nil || len(dead) != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould keep the dead delivery : %+v %v.", failure, testID, dead, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould keep the dead delivery.", success, testID)
+
+		re, err := s.Redeliver(traceID, d.ID, now)
+		if err != nil || re.Status != webhook.StatusPending || re.Attempts != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to redeliver : %+v %v.", failure, testID, re, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to redeliver the dead delivery.", success, testID)
+
+		if _, err := s.Redeliver(traceID, d.ID, now); errors.Cause(err) != webhook.ErrNotFound {
+			t.Fatalf("\t%s\tTest %d:\tShould only redeliver dead deliveries : %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould only redeliver dead deliveries.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen recovering claimed deliveries.", testID)
+	{
+		if _, err := s.Claim(traceID, 10, now); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to claim : %s.", failure, testID, err)
+		}
+
+		n, err := s.Recover(traceID, now, now)
+		if err != nil || n != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould leave recent claims alone : %d %v.", failure, testID, n, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould leave recent claims alone.", success, testID)
+
+		n, err = s.Recover(traceID, now.Add(time.Second), now)
+		if err != nil || n != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould recover the claimed delivery : %d %v.", failure, testID, n, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould recover the claimed delivery.", success, testID)
+	}
+}
@@ -0,0 +1,145 @@
+// Package events fans out the changes made while processing lookups to anyone subscribed to them, such as the
+// graphql subscriptions. The bus lives in the memory of a single process, replicas sharing a database each have their
+// own and only see the events of the lookups they make
+package events
+
+import (
+	"sync"
+
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+)
+
+// bufferSize is the number of events a subscriber can fall behind by before events are dropped for it. Publishing
+// never blocks, a slow subscriber shouldn't hold up the lookups. A job subscriber loses its oldest updates rather
+// than the newest so the last one, the job completing, always arrives
+const bufferSize = 64
+
+type ipResultSub struct {
+	// ips is the set of addresses the subscriber is interested in, every address when empty
+	ips map[string]struct{}
+	ch  chan ipresult.IPResult
+}
+
+type jobSub struct {
+	id string
+	ch chan job.Job
+}
+
+// Bus delivers published events to subscribers. The zero value isn't usable, construct one with New
+type Bus struct {
+	mu        sync.Mutex
+	nextID    int
+	ipResults map[int]ipResultSub
+	jobs      map[int]jobSub
+}
+
+// New constructs a Bus
+func New() *Bus {
+	return &Bus{
+		ipResults: make(map[int]ipResultSub),
+		jobs:      make(map[int]jobSub),
+	}
+}
+
+// SubscribeIPResults returns a channel of the ip results published for the given addresses, or for every address
+// when ips is empty. The addresses must be in their canonical form. Calling the returned func unsubscribes and
+// closes the channel
+func (b *Bus) SubscribeIPResults(ips []string) (<-chan ipresult.IPResult, func()) {
+	sub := ipResultSub{
+		ips: make(map[string]struct{}, len(ips)),
+		ch:  make(chan ipresult.IPResult, bufferSize),
+	}
+	for _, ip := range ips {
+		sub.ips[ip] = struct{}{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.ipResults[id] = sub
+
+	return sub.ch, b.unsubscribe(func() {
+		delete(b.ipResults, id)
+		close(sub.ch)
+	})
+}
+
+// PublishIPResult sends the ip result to its subscribers
+func (b *Bus) PublishIPResult(result ipresult.IPResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range b.ipResults {
+		if len(sub.ips) > 0 {
+			if _, ok := sub.ips[result.IPAddress]; !ok {
+				continue
+			}
+		}
+
+		select {
+		case sub.ch <- result:
+		default:
+		}
+	}
+}
+
+// SubscribeJob returns a channel of the updates published for the job with the given ID. Calling the returned
+// func unsubscribes and closes the channel
+func (b *Bus) SubscribeJob(id string) (<-chan job.Job, func()) {
+	sub := jobSub{
+		id: id,
+		ch: make(chan job.Job, bufferSize),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subID := b.nextID
+	b.nextID++
+	b.jobs[subID] = sub
+
+	return sub.ch, b.unsubscribe(func() {
+		delete(b.jobs, subID)
+		close(sub.ch)
+	})
+}
+
+// PublishJob sends the job to its subscribers
+func (b *Bus) PublishJob(j job.Job) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range b.jobs {
+		if sub.id != j.ID {
+			continue
+		}
+
+		select {
+		case sub.ch <- j:
+		default:
+			// each update holds the whole job so the subscriber only needs the latest, make room for it. Publishers
+			// hold the lock so once one update is taken off there's room for this one
+			select {
+			case <-sub.ch:
+			default:
+			}
+			sub.ch <- j
+		}
+	}
+}
+
+// unsubscribe wraps remove so it holds the lock and is safe to call more than once
+func (b *Bus) unsubscribe(remove func()) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			remove()
+		})
+	}
+}
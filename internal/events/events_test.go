@@ -0,0 +1,83 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/events"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func TestBus(t *testing.T) {
+	t.Log("Given the need to deliver events to subscribers.")
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen subscribed to ip results.", testID)
+
+	b := events.New()
+
+	some, unsubSome := b.SubscribeIPResults([]string{"127.0.0.2"})
+	all, unsubAll := b.SubscribeIPResults(nil)
+
+	b.PublishIPResult(ipresult.IPResult{IPAddress: "127.0.0.3"})
+	b.PublishIPResult(ipresult.IPResult{IPAddress: "127.0.0.2"})
+
+	if got := (<-some).IPAddress; got != "127.0.0.2" || len(some) != 0 {
+		t.Fatalf("\t%s\tTest %d:\tShould only receive results for the subscribed addresses : %s.", failure, testID, got)
+	}
+	t.Logf("\t%s\tTest %d:\tShould only receive results for the subscribed addresses.", success, testID)
+
+	if len(all) != 2 {
+		t.Fatalf("\t%s\tTest %d:\tShould receive every result with no addresses : %d.", failure, testID, len(all))
+	}
+	t.Logf("\t%s\tTest %d:\tShould receive every result with no addresses.", success, testID)
+
+	unsubSome()
+	unsubSome()
+	if _, ok := <-some; ok {
+		t.Fatalf("\t%s\tTest %d:\tShould close the channel once unsubscribed.", failure, testID)
+	}
+	t.Logf("\t%s\tTest %d:\tShould close the channel once unsubscribed.", success, testID)
+
+	// publishing never blocks on a subscriber that isn't keeping up
+	for i := 0; i < 1000; i++ {
+		b.PublishIPResult(ipresult.IPResult{IPAddress: "127.0.0.2"})
+	}
+	unsubAll()
+	t.Logf("\t%s\tTest %d:\tShould not block on a slow subscriber.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen subscribed to a job.", testID)
+
+	jobs, unsubJob := b.SubscribeJob("a")
+	defer unsubJob()
+
+	b.PublishJob(job.Job{ID: "b"})
+	b.PublishJob(job.Job{ID: "a", Completed: 1})
+
+	if got := <-jobs; got.ID != "a" || got.Completed != 1 || len(jobs) != 0 {
+		t.Fatalf("\t%s\tTest %d:\tShould only receive updates for the subscribed job : %+v.", failure, testID, got)
+	}
+	t.Logf("\t%s\tTest %d:\tShould only receive updates for the subscribed job.", success, testID)
+
+	// a subscriber that isn't keeping up loses the oldest updates, never the last
+	for i := 1; i <= 1000; i++ {
+		b.PublishJob(job.Job{ID: "a", Completed: i})
+	}
+	b.PublishJob(job.Job{ID: "a", Completed: 1000, Status: job.StatusCompleted})
+
+	var last job.Job
+	for len(jobs) > 0 {
+		last = <-jobs
+	}
+	if last.Status != job.StatusCompleted {
+		t.Fatalf("\t%s\tTest %d:\tShould always deliver the latest update : %+v.", failure, testID, last)
+	}
+	t.Logf("\t%s\tTest %d:\tShould always deliver the latest update.", success, testID)
+}
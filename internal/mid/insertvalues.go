@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/shaneu/indahaus/internal/trace"
 )
 
 type ctxKey int
@@ -29,6 +30,8 @@ func InsertValues() Middleware {
 				StatusCode: http.StatusOK,
 			}
 			ctx := context.WithValue(r.Context(), RequestValueKey, &v)
+			// the stores read the trace id on its own so they don't depend on the http layer
+			ctx = trace.WithID(ctx, v.TraceID)
 			handler.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
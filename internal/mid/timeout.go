@@ -0,0 +1,24 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Timeout gives each request a deadline so the queries and lookups made on its behalf are abandoned once nobody
+// is waiting on the response. A zero duration leaves requests without a deadline
+func Timeout(d time.Duration) Middleware {
+	return func(handler http.Handler) http.Handler {
+		if d <= 0 {
+			return handler
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			handler.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package processdomains
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shaneu/indahaus/internal/data/domainresult"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+)
+
+type Store struct {
+	log       *log.Logger
+	dataStore domainresult.Store
+	providers dnsbl.Registry
+	resolver  dnsbl.Resolver
+}
+
+func New(log *log.Logger, dataStore domainresult.Store, providers dnsbl.Registry, resolver dnsbl.Resolver) Store {
+	return Store{
+		log:       log,
+		dataStore: dataStore,
+		providers: providers,
+		resolver:  resolver,
+	}
+}
+
+// IsValid checks if a domain is valid or not
+func (Store) IsValid(domain string) bool {
+	_, err := dnsbl.CanonicalDomain(domain)
+	return err == nil
+}
+
+// ProcessDomains takes the list of domains and for each queries every enabled domain provider and stores the
+// results per provider. Unlike IP addresses, domains aren't queued, the lookups are made as they're asked for and
+// a lookup that fails is logged rather than retried. It returns once every lookup has finished. Cancelling ctx abandons any lookups still in flight and starts no more. The lookups are logged against
+// the trace id ctx carries
+func (s Store) ProcessDomains(ctx context.Context, domains []string) {
+	traceID := trace.ID(ctx)
+
+	// we bound the number of lookups in flight at once so a large request can't flood the resolver. A slot is taken
+	// before each goroutine is started so a large request waits its turn rather than starting a goroutine per lookup
+	// up front
+	sem := make(chan struct{}, 50)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, d := range domains {
+		domain, err := dnsbl.CanonicalDomain(d)
+		if err != nil {
+			s.log.Printf("%s : ERROR    : %v", traceID, err)
+			continue
+		}
+
+		for _, p := range s.providers.Providers() {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				s.log.Printf("%s : ERROR    : abandoning domain lookups %v", traceID, ctx.Err())
+				return
+			}
+
+			wg.Add(1)
+
+			// kick off a goroutine to process each domain and provider pair concurrently
+			go func(domain string, p dnsbl.Provider) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				codes, err := s.resolver.QueryDomain(ctx, p, domain)
+				if err != nil {
+					s.log.Printf("%s : ERROR    : resolver.QueryDomain %s for %s %v", traceID, p.Name(), domain, err)
+					return
+				}
+
+				up := domainresult.UpdateDomainResult{}
+
+				if codes != nil {
+					codes := strings.Join(codes, ",")
+					up.ResponseCode = &codes
+				}
+
+				_, err = s.dataStore.AddOrUpdate(ctx, domain, p.Name(), up, time.Now())
+				if err != nil {
+					s.log.Printf("%s : ERROR    : AddOrUpdate %s for %s %v", traceID, p.Name(), domain, err)
+					return
+				}
+			}(domain, p)
+		}
+	}
+}
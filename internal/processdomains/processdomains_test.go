@@ -0,0 +1,169 @@
+package processdomains_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/shaneu/indahaus/internal/data/domainresult"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/processdomains"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/pkg/database"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+const traceID = "00000000-0000-0000-0000-000000000000"
+
+// lookupFunc lets a plain function stand in for the network
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f lookupFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(ioutil.Discard, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+func TestProcessDomains(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to look up many domains at once.")
+
+	providers, err := dnsbl.NewRegistry(dnsbl.NewList(dnsbl.ListConfig{Name: "test", Zone: "dbl.test"}))
+	if err != nil {
+		t.Fatalf("unable to build registry : %v", err)
+	}
+
+	// every lookup waits on release so they pile up as far as ProcessDomains lets them
+	release := make(chan struct{})
+	var inFlight, most int32
+	resolver, err := dnsbl.NewResolver(dnsbl.ResolverConfig{Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+
+		select {
+		case <-release:
+			return []string{"127.0.1.2"}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})})
+	if err != nil {
+		t.Fatalf("unable to build resolver : %v", err)
+	}
+
+	results := domainresult.New(log, db)
+	s := processdomains.New(log, results, providers, resolver)
+
+	var domains []string
+	for i := 0; i < 500; i++ {
+		domains = append(domains, fmt.Sprintf("domain%d.example.com", i))
+	}
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen %d domains are processed.", testID, len(domains))
+	{
+		before := runtime.NumGoroutine()
+
+		done := make(chan struct{})
+		go func() {
+			s.ProcessDomains(trace.WithID(context.Background(), traceID), domains)
+			close(done)
+		}()
+
+		// give ProcessDomains time to start as many lookups as it will
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&inFlight) < 50 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		if g := runtime.NumGoroutine() - before; g > 100 {
+			t.Fatalf("\t%s\tTest %d:\tShould bound the goroutines started : %d started.", failure, testID, g)
+		}
+		t.Logf("\t%s\tTest %d:\tShould bound the goroutines started.", success, testID)
+
+		close(release)
+		<-done
+
+		if m := atomic.LoadInt32(&most); m > 50 {
+			t.Fatalf("\t%s\tTest %d:\tShould make at most 50 lookups at once : made %d.", failure, testID, m)
+		}
+		t.Logf("\t%s\tTest %d:\tShould make at most 50 lookups at once.", success, testID)
+
+		var n int
+		if err := db.Get(&n, `SELECT COUNT(*) FROM domain_results`); err != nil {
+			t.Fatalf("unable to count results %v", err)
+		}
+		if n != len(domains) {
+			t.Fatalf("\t%s\tTest %d:\tShould store a result for every domain before returning : got %d.", failure, testID, n)
+		}
+		t.Logf("\t%s\tTest %d:\tShould store a result for every domain before returning.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen the context is cancelled.", testID)
+	{
+		ctx, cancel := context.WithCancel(trace.WithID(context.Background(), traceID))
+		cancel()
+
+		atomic.StoreInt32(&most, 0)
+		s.ProcessDomains(ctx, domains)
+
+		if m := atomic.LoadInt32(&most); m != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould not start any lookups : %d started.", failure, testID, m)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not start any lookups.", success, testID)
+	}
+}
@@ -1,29 +1,144 @@
 package processips
 
 import (
+	"context"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/shaneu/indahaus/internal/data/ipresult"
-	"github.com/shaneu/indahaus/pkg/spamhaus"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/queue"
+	"github.com/shaneu/indahaus/internal/events"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/internal/webhooks"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
 )
 
-// the 127.255.255.0/24 network representing errors, see see https://www.spamhaus.org/faq/section/DNSBL%20Usage#200
-var errIP = []byte("127.255.255.0")
-var errIPMask = []byte("255.255.255.0")
-var spamhausErrIPNet = net.IPNet{IP: errIP, Mask: errIPMask}
+// Config tunes the workers that make the queued lookups, zero values fall back to the defaults below
+type Config struct {
+	// Workers is the number of lookups made concurrently
+	Workers int
+	// PollInterval is how often the queue is checked for work nobody signalled, such as retries coming due
+	PollInterval time.Duration
+	// MaxAttempts is the number of times a lookup is made before it's given up on
+	MaxAttempts int
+	// RetryDelay is how long a lookup that failed once waits before it's made again, it doubles with each failed
+	// attempt up to MaxRetryDelay, see Backoff
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// A result stays fresh for the TTL of the provider's answer, kept between MinTTL and MaxTTL. MinTTL is used when
+	// the answer's TTL isn't known, as with the system resolver. Fresh results aren't looked up again unless forced
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// MaxRangeSize is the most addresses a CIDR prefix expands to, see ExpandCIDR, and the most the prefixes of a
+	// single enqueue may expand to together
+	MaxRangeSize int
+	// Results are stored in batches of up to WriteBatchSize, never more than Workers, a batch that isn't full is
+	// stored once its first result has waited WriteInterval
+	WriteBatchSize int
+	WriteInterval  time.Duration
+	// LookupTimeout bounds each queued lookup, from querying the provider to storing the result
+	LookupTimeout time.Duration
+}
+
+// Starting with 50 workers, we can adjust based on the performance/limits of the spamhaus api
+const (
+	defaultWorkers       = 50
+	defaultPollInterval  = time.Second
+	defaultMaxAttempts   = 5
+	defaultRetryDelay    = 5 * time.Second
+	defaultMaxRetryDelay = 5 * time.Minute
+	defaultMinTTL        = 5 * time.Minute
+	defaultMaxTTL        = time.Hour
+	defaultMaxRangeSize  = 1024
+	defaultWriteBatch    = 100
+	defaultWriteInterval = 20 * time.Millisecond
+	defaultLookupTimeout = 30 * time.Second
+
+	// recordTimeout bounds recording a lookup that ran out of time
+	recordTimeout = 5 * time.Second
+
+	// staleClaims is how many claimHolds old a claim is before it's recovered, see recover
+	staleClaims = 3
+)
+
+var (
+	ErrInvalidCIDR   = errors.New("CIDR is not in its proper form")
+	ErrRangeTooLarge = errors.New("CIDR covers too many addresses")
+)
 
 type Store struct {
-	log       *log.Logger
-	dataStore ipresult.Store
+	log        *log.Logger
+	dataStore  ipresult.Store
+	jobStore   job.Store
+	queueStore queue.Store
+	events     *events.Bus
+	hooks      webhooks.Store
+	providers  dnsbl.Registry
+	resolver   dnsbl.Resolver
+	cfg        Config
+	// notify wakes Run when work is enqueued so it doesn't wait out the poll interval
+	notify chan struct{}
 }
 
-func New(log *log.Logger, dataStore ipresult.Store) Store {
+func New(log *log.Logger, dataStore ipresult.Store, jobStore job.Store, queueStore queue.Store, bus *events.Bus,
+	hooks webhooks.Store, providers dnsbl.Registry, resolver dnsbl.Resolver, cfg Config) Store {
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = defaultRetryDelay
+	}
+	if cfg.MaxRetryDelay <= 0 {
+		cfg.MaxRetryDelay = defaultMaxRetryDelay
+	}
+	if cfg.MaxRetryDelay < cfg.RetryDelay {
+		cfg.MaxRetryDelay = cfg.RetryDelay
+	}
+	if cfg.MinTTL <= 0 {
+		cfg.MinTTL = defaultMinTTL
+	}
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = defaultMaxTTL
+	}
+	if cfg.MaxTTL < cfg.MinTTL {
+		cfg.MaxTTL = cfg.MinTTL
+	}
+	if cfg.MaxRangeSize <= 0 {
+		cfg.MaxRangeSize = defaultMaxRangeSize
+	}
+	if cfg.WriteBatchSize <= 0 {
+		cfg.WriteBatchSize = defaultWriteBatch
+	}
+	if cfg.WriteInterval <= 0 {
+		cfg.WriteInterval = defaultWriteInterval
+	}
+	if cfg.LookupTimeout <= 0 {
+		cfg.LookupTimeout = defaultLookupTimeout
+	}
+
 	return Store{
-		log:       log,
-		dataStore: dataStore,
+		log:        log,
+		dataStore:  dataStore,
+		jobStore:   jobStore,
+		queueStore: queueStore,
+		events:     bus,
+		hooks:      hooks,
+		providers:  providers,
+		resolver:   resolver,
+		cfg:        cfg,
+		notify:     make(chan struct{}, 1),
 	}
 }
 
@@ -35,49 +150,449 @@ func (Store) IsValid(ip string) bool {
 	return r != nil
 }
 
-// ProcessIPs takes the list of IP address and for each queries the spamhouse API and stores the results
-// If the address is new it creates a new row, otherwise it updates the existing row with the latest response codes
-func (s Store) ProcessIPs(ips []string, traceID string) {
-	// limit the amount of concurrent process executing at the same time to avoid overwhelming resources in the event of a large number of ips
-	// to process. We make a channel of empty struct as the type of value is meaningless and struct{}{} doesn't allocate
-	// and can't be misinterpreted as having meaning beyond signaling. Starting with 50, we can adjust based on the
-	// performance/limits of the spamhaus api
-	sem := make(chan struct{}, 50)
+// IsCIDR reports whether the address is written as a CIDR prefix rather than a single address
+func (Store) IsCIDR(ip string) bool {
+	return strings.Contains(ip, "/")
+}
+
+// ExpandCIDR returns every address within the prefix, in order and in their canonical form. Prefixes covering more
+// than MaxRangeSize addresses return ErrRangeTooLarge, ex a /22 is 1024 addresses
+func (s Store) ExpandCIDR(cidr string) ([]string, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, ErrInvalidCIDR
+	}
+
+	ones, bits := n.Mask.Size()
+	if bits-ones >= 31 || 1<<uint(bits-ones) > s.cfg.MaxRangeSize {
+		return nil, ErrRangeTooLarge
+	}
+
+	ips := make([]string, 0, 1<<uint(bits-ones))
+	for addr := n.IP; n.Contains(addr); addr = next(addr) {
+		ips = append(ips, addr.String())
+	}
+
+	return ips, nil
+}
+
+// Providers returns the names of the providers lookups are queued against
+func (s Store) Providers() []string {
+	var names []string
+	for _, p := range s.providers.Providers() {
+		names = append(names, p.Name())
+	}
+
+	return names
+}
+
+// MaxRangeSize is the most addresses the prefixes of a single enqueue may expand to together
+func (s Store) MaxRangeSize() int {
+	return s.cfg.MaxRangeSize
+}
+
+// next returns the address after addr, wrapping around to zero after the last address
+func next(addr net.IP) net.IP {
+	n := make(net.IP, len(addr))
+	copy(n, addr)
+
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			break
+		}
+	}
+
+	return n
+}
+
+// Lookups returns the number of lookups Enqueue queues for the list of IP addresses, one for each address and
+// the providers that list addresses of its kind
+func (s Store) Lookups(ips []string) int {
+	return len(s.newItems("", ips))
+}
+
+// Enqueue queues a lookup of each IP address against every enabled dnsbl provider, counted against the job with
+// the given ID. The queue is stored in the database so lookups still waiting when the process stops are made once
+// it starts again, see Run. Addresses with a fresh result are skipped when their turn comes unless force is set. The
+// lookups are made under the trace id carried by ctx, nothing is queued once ctx is done
+func (s Store) Enqueue(ctx context.Context, jobID string, ips []string, force bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	items := s.newItems(jobID, ips)
+	for i := range items {
+		items[i].Force = force
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	if _, err := s.queueStore.Enqueue(ctx, items, time.Now()); err != nil {
+		return errors.Wrap(err, "enqueueing lookups")
+	}
+
+	// a signal is already waiting when the channel is full, which is as good as sending another
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// newItems builds the queue items for the list of IP addresses
+func (s Store) newItems(jobID string, ips []string) []queue.NewItem {
+	var items []queue.NewItem
 
 	for _, a := range ips {
-		// kick off a goroutine to process each ip concurrently
-		go func(ipAddr string) {
-			// push a value into the semaphore channel, once the channel reaches capacity the other goroutines
-			// will block on the send until completed goroutines remove a value from the channel
-			sem <- struct{}{}
-			defer func() { <-sem }()
-
-			codes, err := spamhaus.QueryDNSBL(ipAddr)
-			if err != nil {
-				s.log.Printf("%s : ERROR    : spamhaus.QueryDNSBL for %s %v", traceID, ipAddr, err)
-				return
-			}
+		addr := net.ParseIP(a)
+		if addr == nil {
+			continue
+		}
 
-			for _, code := range codes {
-				// we check if the code returned is in the `127.255.255.0/24` IP network indicating a request error
-				if spamhausErrIPNet.Contains(net.ParseIP(code)) {
-					s.log.Printf("%s : ERROR    : spamhaus for %s %s", traceID, ipAddr, code)
-					return
-				}
+		for _, p := range s.providers.Providers() {
+			// not every zone lists IPv6 addresses, rather than report an error for every address we skip those providers
+			if addr.To4() == nil && !p.IPv6() {
+				continue
 			}
 
-			up := ipresult.UpdateIPResult{}
+			items = append(items, queue.NewItem{
+				JobID:     jobID,
+				IPAddress: addr.String(),
+				Provider:  p.Name(),
+			})
+		}
+	}
+
+	return items
+}
+
+// Run makes the queued lookups until ctx is cancelled. Once it is no more lookups are claimed, the lookups in flight
+// are abandoned and handed back to the queue, and Run returns when their workers have stopped. Any lookup left
+// claimed by a process that stopped without handing it back is recovered once its claim is stale, see recover
+func (s Store) Run(ctx context.Context) {
+	traceID := uuid.New().String()
+
+	// claims are made under Run's ctx, what's claimed when it's cancelled is rolled back with the claim
+	rctx := trace.WithID(ctx, traceID)
+
+	s.recover(rctx)
+	recovered := time.Now()
+
+	// the writer outlives the workers so the results of the lookups they drain are stored
+	w := newWriter(s)
+	go w.run()
+	defer w.close()
 
-			if codes != nil {
-				codes := strings.Join(codes, ",")
-				up.ResponseCode = &codes
+	// the workers stop once work is closed and the lookups they're making see ctx is done, Run waits on them so nothing
+	// is left writing once it returns
+	work := make(chan queue.Item)
+	var wg sync.WaitGroup
+
+	wg.Add(s.cfg.Workers)
+	for i := 0; i < s.cfg.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				s.process(ctx, item, w)
 			}
+		}()
+	}
+
+	defer wg.Wait()
+	defer close(work)
+
+	for ctx.Err() == nil {
+		// another replica sharing the queue may have stopped with lookups claimed at any time, not just before we started
+		if time.Since(recovered) >= s.cfg.LookupTimeout {
+			s.recover(rctx)
+			recovered = time.Now()
+		}
+
+		items, err := s.queueStore.Claim(rctx, s.cfg.Workers, time.Now())
+		if err != nil && ctx.Err() == nil {
+			s.log.Printf("%s : ERROR    : queue.Claim %v", traceID, err)
+		}
 
-			_, err = s.dataStore.AddOrUpdate(traceID, ipAddr, up, time.Now())
-			if err != nil {
-				s.log.Printf("%s : ERROR    : AddOrUpdate for %s %v", traceID, ipAddr, err)
+		for i, item := range items {
+			select {
+			case work <- item:
+			case <-ctx.Done():
+				// hand back what was claimed but never started
+				for _, item := range items[i:] {
+					s.release(item)
+				}
 				return
 			}
-		}(a)
+		}
+
+		// a full batch means there may be more waiting
+		if len(items) == s.cfg.Workers {
+			continue
+		}
+
+		select {
+		case <-s.notify:
+		case <-time.After(s.cfg.PollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// recover puts the lookups left claimed by a process that stopped before finishing them back in the queue. A claim
+// is only taken to be left behind once it's older than staleClaims times claimHold, an item can wait one for a worker
+// to finish the item before it and one for its own lookup, so one that's older can't still be in flight in any
+// process sharing the queue. The rest leaves room for the clocks of replicas to disagree
+func (s Store) recover(ctx context.Context) {
+	traceID := trace.ID(ctx)
+	now := time.Now()
+
+	n, err := s.queueStore.Recover(ctx, now.Add(-staleClaims*s.claimHold()), now)
+	if err != nil && ctx.Err() == nil {
+		s.log.Printf("%s : ERROR    : queue.Recover %v", traceID, err)
+	}
+	if n > 0 {
+		s.log.Printf("%s : processips : resuming %d unfinished lookups", traceID, n)
+	}
+}
+
+// claimHold is the longest a worker can hold a claimed item. The lookup and storing its result are bounded by
+// LookupTimeout, the result can wait up to WriteInterval for its batch on top of that, a lookup that ran out of time
+// has up to recordTimeout more to record the failure and settling the claim takes up to recordTimeout, see
+// settleContext
+func (s Store) claimHold() time.Duration {
+	return s.cfg.LookupTimeout + s.cfg.WriteInterval + 2*recordTimeout
+}
+
+// process makes the lookup of a queued item, retrying it later when it fails and it has attempts left. Successful
+// lookups are stored by w
+func (s Store) process(ctx context.Context, item queue.Item, w *writer) {
+	traceID := item.TraceID
+
+	ctx, cancel := context.WithTimeout(trace.WithID(ctx, traceID), s.cfg.LookupTimeout)
+	defer cancel()
+
+	p, ok := s.providers.Provider(item.Provider)
+	if !ok {
+		// the provider was disabled while the lookup was waiting
+		s.log.Printf("%s : ERROR    : unknown provider %s for %s", traceID, item.Provider, item.IPAddress)
+		s.finish(item, true)
+		return
+	}
+
+	if !item.Force && s.fresh(ctx, item) {
+		s.log.Printf("%s : processips : skipping %s for %s, the stored result is fresh", traceID, p.Name(), item.IPAddress)
+		s.finish(item, false)
+		return
+	}
+
+	err := s.lookup(ctx, p, item, w)
+	if err == nil {
+		s.finish(item, false)
+		return
+	}
+
+	// Run was stopped, the lookup didn't fail so it's handed back without counting the attempt
+	if ctx.Err() == context.Canceled {
+		s.release(item)
+		return
+	}
+
+	if Transient(err) && item.Attempts < s.cfg.MaxAttempts {
+		delay := s.cfg.Backoff(item.Attempts)
+		s.log.Printf("%s : processips : retrying %s for %s in %s, attempt %d of %d", traceID, p.Name(), item.IPAddress,
+			delay, item.Attempts, s.cfg.MaxAttempts)
+
+		sctx, cancel := settleContext(item)
+		defer cancel()
+
+		if err := s.queueStore.Retry(sctx, item.ID, err, time.Now().Add(delay), time.Now()); err != nil {
+			s.log.Printf("%s : ERROR    : queue.Retry %s %v", traceID, item.ID, err)
+		}
+		return
+	}
+
+	s.log.Printf("%s : ERROR    : giving up on %s for %s after %d attempts", traceID, p.Name(), item.IPAddress, item.Attempts)
+	s.finish(item, true)
+}
+
+// release hands a claimed item back to the queue without counting the attempt, for one that was never started or
+// was abandoned when Run was stopped
+func (s Store) release(item queue.Item) {
+	ctx, cancel := settleContext(item)
+	defer cancel()
+
+	if err := s.queueStore.Release(ctx, item.ID, time.Now()); err != nil {
+		s.log.Printf("%s : ERROR    : queue.Release %s %v", item.TraceID, item.ID, err)
+	}
+}
+
+// settleContext returns the context an item's claim is settled under, whether it's acked, retried or released. It's
+// one of its own bounded by recordTimeout rather than Run's, so stopping Run never leaves the outcome of a lookup half
+// recorded, say counted against its job but still queued
+func settleContext(item queue.Item) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(trace.WithID(context.Background(), item.TraceID), recordTimeout)
+}
+
+// fresh reports whether the stored result of the item's lookup is still fresh
+func (s Store) fresh(ctx context.Context, item queue.Item) bool {
+	res, err := s.dataStore.QueryByIP(ctx, item.IPAddress, item.Provider)
+	if err != nil {
+		if errors.Cause(err) != ipresult.ErrNotFound {
+			s.log.Printf("%s : ERROR    : QueryByIP %s for %s %v", trace.ID(ctx), item.Provider, item.IPAddress, err)
+		}
+		return false
+	}
+
+	return res.Fresh(time.Now())
+}
+
+// ttl is how long the answer's result stays fresh, bounded by the configured minimum and maximum
+func (c Config) ttl(answer time.Duration) time.Duration {
+	switch {
+	case answer < c.MinTTL:
+		return c.MinTTL
+	case answer > c.MaxTTL:
+		return c.MaxTTL
+	}
+
+	return answer
+}
+
+// finish counts the item's lookup against its job and removes it from the queue
+func (s Store) finish(item queue.Item, failed bool) {
+	traceID := item.TraceID
+
+	ctx, cancel := settleContext(item)
+	defer cancel()
+
+	j, err := s.jobStore.RecordLookup(ctx, item.JobID, failed, time.Now())
+	if err != nil {
+		s.log.Printf("%s : ERROR    : RecordLookup %s %v", traceID, item.JobID, err)
+	} else {
+		s.events.PublishJob(j)
+	}
+
+	if err := s.queueStore.Ack(ctx, item.ID); err != nil {
+		s.log.Printf("%s : ERROR    : queue.Ack %s %v", traceID, item.ID, err)
+	}
+}
+
+// lookup queries the provider for the item's IP address and stores the result through w. If the address is new to the
+// provider it creates a new row, otherwise it updates the existing row with the latest response codes. A failed query
+// is recorded against the row and returned
+func (s Store) lookup(ctx context.Context, p dnsbl.Provider, item queue.Item, w *writer) error {
+	traceID := trace.ID(ctx)
+	ipAddr := item.IPAddress
+
+	// codes signalling a failed query, such as spamhaus' 127.255.255.0/24 network, come back as errors
+	answer, err := s.resolver.Lookup(ctx, p, ipAddr)
+	if err != nil {
+		s.log.Printf("%s : ERROR    : resolver.Lookup %s for %s %v", traceID, p.Name(), ipAddr, err)
+
+		// an abandoned lookup isn't a failed one, there's nothing to record
+		if ctx.Err() == context.Canceled {
+			return err
+		}
+
+		// a lookup that ran out of time is still worth recording, it's written under a context of its own since the
+		// lookup's is done
+		rctx := ctx
+		if ctx.Err() != nil {
+			var cancel context.CancelFunc
+			rctx, cancel = context.WithTimeout(trace.WithID(context.Background(), traceID), recordTimeout)
+			defer cancel()
+		}
+
+		// keep a record of the failed attempt so clients can tell a stale result from a fresh one
+		f := ipresult.FailedLookup{
+			Status:   lookupStatus(err),
+			Err:      err,
+			Attempts: item.Attempts,
+		}
+
+		res, rerr := s.dataStore.RecordFailure(rctx, ipAddr, p.Name(), f, time.Now())
+		if rerr != nil {
+			s.log.Printf("%s : ERROR    : RecordFailure %s for %s %v", traceID, p.Name(), ipAddr, rerr)
+			return err
+		}
+		s.events.PublishIPResult(res)
+
+		return err
+	}
+
+	codes := answer.Codes
+	up := ipresult.UpdateIPResult{
+		Attempts: item.Attempts,
+		TTL:      int(s.cfg.ttl(answer.TTL) / time.Second),
+	}
+
+	if codes != nil {
+		joined := strings.Join(codes, ",")
+		up.ResponseCode = &joined
+	}
+
+	// decode each code with the provider's table so clients don't have to keep their own
+	for _, code := range codes {
+		c := dnsbl.Decode(p, code)
+		up.Codes = append(up.Codes, ipresult.Code{
+			Code:        c.Code,
+			List:        c.List,
+			Description: c.Description,
+			Category:    string(c.Category),
+		})
+	}
+
+	res, err := w.store(ctx, ipresult.Upsert{IPAddress: ipAddr, Provider: p.Name(), Update: up})
+	if err != nil {
+		s.log.Printf("%s : ERROR    : AddOrUpdate %s for %s %v", traceID, p.Name(), ipAddr, err)
+		return err
+	}
+	s.events.PublishIPResult(res.IPResult)
+
+	s.notifyHooks(traceID, res)
+
+	return nil
+}
+
+// notifyHooks queues a notification to the webhooks when storing a lookup changed the codes an address is listed
+// under. A failure is logged rather than returned, the result is stored and making the lookup again wouldn't find a
+// change
+func (s Store) notifyHooks(traceID string, res ipresult.Upserted) {
+	// the write reports whether the listing moved, there's nothing to tell when it didn't
+	if res.Outcome == ipresult.OutcomeUnchanged {
+		return
+	}
+	next := res.IPResult
+
+	prevCodes := make([]string, 0, len(res.Previous))
+	for _, c := range res.Previous {
+		prevCodes = append(prevCodes, c.Code)
+	}
+
+	nextCodes := make([]string, 0, len(next.Codes))
+	for _, c := range next.Codes {
+		nextCodes = append(nextCodes, c.Code)
+	}
+
+	event, ok := webhooks.Classify(prevCodes, nextCodes)
+	if !ok {
+		return
+	}
+
+	c := webhooks.Change{
+		IPAddress:     next.IPAddress,
+		Provider:      next.Provider,
+		Event:         event,
+		Codes:         nextCodes,
+		PreviousCodes: prevCodes,
+		OccurredAt:    next.UpdatedAt,
+	}
+
+	if err := s.hooks.Notify(traceID, c); err != nil {
+		s.log.Printf("%s : ERROR    : webhooks.Notify %s for %s %v", traceID, next.Provider, next.IPAddress, err)
 	}
 }
@@ -0,0 +1,751 @@
+package processips_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/queue"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/internal/events"
+	"github.com/shaneu/indahaus/internal/processips"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/internal/webhooks"
+	"github.com/shaneu/indahaus/pkg/database"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+	"github.com/shaneu/indahaus/pkg/spamhaus"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+const traceID = "00000000-0000-0000-0000-000000000000"
+
+// tctx carries the trace id into the store calls made by the tests
+var tctx = trace.WithID(context.Background(), traceID)
+
+// lookupFunc lets a plain function stand in for the network
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f lookupFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+// ttlLookupFunc lets a plain function stand in for a nameserver that reports the TTL of its answers
+type ttlLookupFunc func(ctx context.Context, host string) ([]string, time.Duration, error)
+
+func (f ttlLookupFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, _, err := f(ctx, host)
+	return addrs, err
+}
+
+func (f ttlLookupFunc) LookupHostTTL(ctx context.Context, host string) ([]string, time.Duration, error) {
+	return f(ctx, host)
+}
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+// newStore builds a Store that queries a single test provider through lookup
+func newStore(t *testing.T, log *log.Logger, db *sqlx.DB, lookup dnsbl.HostLookup) processips.Store {
+	providers, err := dnsbl.NewRegistry(dnsbl.NewList(dnsbl.ListConfig{Name: "test", Zone: "dnsbl.test"}))
+	if err != nil {
+		t.Fatalf("unable to build registry : %v", err)
+	}
+
+	resolver, err := dnsbl.NewResolver(dnsbl.ResolverConfig{Lookup: lookup})
+	if err != nil {
+		t.Fatalf("unable to build resolver : %v", err)
+	}
+
+	return processips.New(log, ipresult.New(log, db), job.New(log, db), queue.New(log, db), events.New(),
+		webhooks.New(log, webhook.New(log, db), webhooks.Config{}), providers, resolver,
+		processips.Config{
+			Workers:       2,
+			PollInterval:  10 * time.Millisecond,
+			MaxAttempts:   2,
+			RetryDelay:    time.Millisecond,
+			MaxRetryDelay: 2 * time.Millisecond,
+			MinTTL:        time.Minute,
+			MaxTTL:        time.Hour,
+		})
+}
+
+// waitForJob polls the job until it's completed
+func waitForJob(t *testing.T, jobs job.Store, id string) job.Job {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		j, err := jobs.QueryByID(tctx, id)
+		if err != nil {
+			t.Fatalf("unable to retrieve job %v", err)
+		}
+
+		if j.Status == job.StatusCompleted {
+			return j
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s did not complete", id)
+	return job.Job{}
+}
+
+func TestProcessIPs(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to make queued lookups.")
+
+	jobs := job.New(log, db)
+	results := ipresult.New(log, db)
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen lookups are enqueued.", testID)
+
+	// the first lookup of 127.0.0.3 times out, every other lookup is listed
+	var timedOut int32
+	s := newStore(t, log, db, lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+		if host == "3.0.0.127.dnsbl.test" && atomic.CompareAndSwapInt32(&timedOut, 0, 1) {
+			return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+		}
+		return []string{"127.0.0.2"}, nil
+	}))
+
+	ips := []string{"127.0.0.2", "127.0.0.3"}
+	j, err := jobs.Create(tctx, job.NewJob{Total: s.Lookups(ips)}, time.Now())
+	if err != nil {
+		t.Fatalf("unable to create job %v", err)
+	}
+
+	if err := s.Enqueue(tctx, j.ID, ips, false); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to enqueue lookups : %s.", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to enqueue lookups.", success, testID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	j = waitForJob(t, jobs, j.ID)
+	if j.Completed != 2 || j.Failed != 0 {
+		t.Fatalf("\t%s\tTest %d:\tShould complete every lookup, retrying the one that failed : %+v.", failure, testID, j)
+	}
+	t.Logf("\t%s\tTest %d:\tShould complete every lookup, retrying the one that failed.", success, testID)
+
+	res, err := results.QueryByIP(tctx, "127.0.0.3", "test")
+	if err != nil || res.Status != ipresult.StatusListed || res.Attempts != 2 {
+		t.Fatalf("\t%s\tTest %d:\tShould store the result of the retried lookup : %v %+v.", failure, testID, err, res)
+	}
+	t.Logf("\t%s\tTest %d:\tShould store the result of the retried lookup.", success, testID)
+
+	cancel()
+	<-done
+
+	testID++
+	t.Logf("\tTest %d:\tWhen lookups keep failing.", testID)
+
+	// 127.0.0.7 times out every time, 127.0.0.8 is refused by spamhaus for coming through an open resolver
+	var refused int32
+	s = newStore(t, log, db, lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+		if host == "8.0.0.127.dnsbl.test" {
+			atomic.AddInt32(&refused, 1)
+			return nil, errors.Wrap(spamhaus.ErrOpenResolver, "spamhaus responded 127.255.255.254")
+		}
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+	}))
+
+	ips = []string{"127.0.0.7", "127.0.0.8"}
+	j, err = jobs.Create(tctx, job.NewJob{Total: s.Lookups(ips)}, time.Now())
+	if err != nil {
+		t.Fatalf("unable to create job %v", err)
+	}
+
+	if err := s.Enqueue(tctx, j.ID, ips, false); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to enqueue lookups : %s.", failure, testID, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	done = make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	j = waitForJob(t, jobs, j.ID)
+	if j.Failed != 2 {
+		t.Fatalf("\t%s\tTest %d:\tShould give up on both lookups : %+v.", failure, testID, j)
+	}
+	t.Logf("\t%s\tTest %d:\tShould give up on both lookups.", success, testID)
+
+	res, err = results.QueryByIP(tctx, "127.0.0.7", "test")
+	if err != nil || res.Status != ipresult.StatusDNSTimeout || res.Attempts != 2 {
+		t.Fatalf("\t%s\tTest %d:\tShould retry a timeout up to the max attempts : %v %+v.", failure, testID, err, res)
+	}
+	t.Logf("\t%s\tTest %d:\tShould retry a timeout up to the max attempts.", success, testID)
+
+	res, err = results.QueryByIP(tctx, "127.0.0.8", "test")
+	if err != nil || res.Status != ipresult.StatusOpenResolverBlocked || res.Attempts != 1 || atomic.LoadInt32(&refused) != 1 {
+		t.Fatalf("\t%s\tTest %d:\tShould not retry a refused lookup : %v %+v.", failure, testID, err, res)
+	}
+	t.Logf("\t%s\tTest %d:\tShould not retry a refused lookup.", success, testID)
+
+	cancel()
+	<-done
+
+	testID++
+	t.Logf("\tTest %d:\tWhen the process stops with lookups outstanding.", testID)
+
+	// a lookup blocks until released, standing in for one in flight at shutdown
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s = newStore(t, log, db, lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}))
+
+	ips = []string{"127.0.0.4", "127.0.0.5", "127.0.0.6"}
+	j, err = jobs.Create(tctx, job.NewJob{Total: s.Lookups(ips)}, time.Now())
+	if err != nil {
+		t.Fatalf("unable to create job %v", err)
+	}
+
+	if err := s.Enqueue(tctx, j.ID, ips, false); err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to enqueue lookups : %s.", failure, testID, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	done = make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+		t.Fatalf("\t%s\tTest %d:\tShould wait for the lookups in flight.", failure, testID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	t.Logf("\t%s\tTest %d:\tShould wait for the lookups in flight.", success, testID)
+
+	close(release)
+	<-done
+	t.Logf("\t%s\tTest %d:\tShould stop once the lookups in flight finish.", success, testID)
+
+	// whatever wasn't finished is picked up when the queue runs again
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	j = waitForJob(t, jobs, j.ID)
+	if j.Completed != 3 || j.Failed != 0 {
+		t.Fatalf("\t%s\tTest %d:\tShould resume the outstanding lookups : %+v.", failure, testID, j)
+	}
+	t.Logf("\t%s\tTest %d:\tShould resume the outstanding lookups.", success, testID)
+
+	for _, ip := range ips {
+		res, err := results.QueryByIP(tctx, ip, "test")
+		if err != nil || res.Status != ipresult.StatusNotListed {
+			t.Fatalf("\t%s\tTest %d:\tShould store a result for %s : %v %+v.", failure, testID, ip, err, res)
+		}
+	}
+	t.Logf("\t%s\tTest %d:\tShould store a result for every address.", success, testID)
+}
+
+// lineCounter counts the log lines containing match
+type lineCounter struct {
+	match string
+	n     int32
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), c.match) {
+		atomic.AddInt32(&c.n, 1)
+	}
+	return len(p), nil
+}
+
+func TestBatchedWrites(t *testing.T) {
+	_, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to store the results of a large job without contending for the database.")
+
+	flushes := &lineCounter{match: "ipresult.AddOrUpdateMany"}
+	log := log.New(flushes, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	providers, err := dnsbl.NewRegistry(dnsbl.NewList(dnsbl.ListConfig{Name: "test", Zone: "dnsbl.test"}))
+	if err != nil {
+		t.Fatalf("unable to build registry : %v", err)
+	}
+
+	resolver, err := dnsbl.NewResolver(dnsbl.ResolverConfig{Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+		return []string{"127.0.0.2"}, nil
+	})})
+	if err != nil {
+		t.Fatalf("unable to build resolver : %v", err)
+	}
+
+	jobs := job.New(log, db)
+	s := processips.New(log, ipresult.New(log, db), jobs, queue.New(log, db), events.New(),
+		webhooks.New(log, webhook.New(log, db), webhooks.Config{}), providers, resolver,
+		processips.Config{
+			Workers:        20,
+			PollInterval:   10 * time.Millisecond,
+			WriteBatchSize: 10,
+			WriteInterval:  5 * time.Millisecond,
+		})
+
+	ips, err := s.ExpandCIDR("10.0.0.0/24")
+	if err != nil {
+		t.Fatalf("unable to expand range %v", err)
+	}
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen %d lookups are enqueued.", testID, len(ips))
+	{
+		j, err := jobs.Create(tctx, job.NewJob{Total: s.Lookups(ips)}, time.Now())
+		if err != nil {
+			t.Fatalf("unable to create job %v", err)
+		}
+
+		if err := s.Enqueue(tctx, j.ID, ips, false); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to enqueue lookups : %s.", failure, testID, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			s.Run(ctx)
+			close(done)
+		}()
+
+		j = waitForJob(t, jobs, j.ID)
+		cancel()
+		<-done
+
+		if j.Completed != len(ips) || j.Failed != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould complete every lookup : %+v.", failure, testID, j)
+		}
+		t.Logf("\t%s\tTest %d:\tShould complete every lookup.", success, testID)
+
+		var n int
+		if err := db.Get(&n, `SELECT COUNT(*) FROM ip_results WHERE status = $1`, ipresult.StatusListed); err != nil {
+			t.Fatalf("unable to count results %v", err)
+		}
+		if n != len(ips) {
+			t.Fatalf("\t%s\tTest %d:\tShould store a result for every address : got %d.", failure, testID, n)
+		}
+		t.Logf("\t%s\tTest %d:\tShould store a result for every address.", success, testID)
+
+		// a batch holds at most 10 results so there's at least one flush per 10 addresses, and fewer than one per
+		// address as long as any batch held more than one
+		f := int(atomic.LoadInt32(&flushes.n))
+		if f < len(ips)/10 || f >= len(ips) {
+			t.Fatalf("\t%s\tTest %d:\tShould store the results in batches : %d flushes.", failure, testID, f)
+		}
+		t.Logf("\t%s\tTest %d:\tShould store the results in batches, %d flushes.", success, testID, f)
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to bound lookups that never answer.")
+
+	providers, err := dnsbl.NewRegistry(dnsbl.NewList(dnsbl.ListConfig{Name: "test", Zone: "dnsbl.test"}))
+	if err != nil {
+		t.Fatalf("unable to build registry : %v", err)
+	}
+
+	// 127.0.0.2 hangs on its first lookup only, 127.0.0.3 on every lookup
+	var hung int32
+	resolver, err := dnsbl.NewResolver(dnsbl.ResolverConfig{Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+		if host == "3.0.0.127.dnsbl.test" || atomic.CompareAndSwapInt32(&hung, 0, 1) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []string{"127.0.0.2"}, nil
+	})})
+	if err != nil {
+		t.Fatalf("unable to build resolver : %v", err)
+	}
+
+	results := ipresult.New(log, db)
+	jobs := job.New(log, db)
+	s := processips.New(log, results, jobs, queue.New(log, db), events.New(),
+		webhooks.New(log, webhook.New(log, db), webhooks.Config{}), providers, resolver,
+		processips.Config{
+			Workers:       2,
+			PollInterval:  10 * time.Millisecond,
+			MaxAttempts:   2,
+			RetryDelay:    time.Millisecond,
+			MaxRetryDelay: 2 * time.Millisecond,
+			LookupTimeout: 50 * time.Millisecond,
+		})
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen enqueueing with a cancelled context.", testID)
+	{
+		ctx, cancel := context.WithCancel(tctx)
+		cancel()
+
+		if err := s.Enqueue(ctx, "", []string{"127.0.0.2"}, false); errors.Cause(err) != context.Canceled {
+			t.Fatalf("\t%s\tTest %d:\tShould return context.Canceled : %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould return context.Canceled.", success, testID)
+
+		var n int
+		if err := db.Get(&n, `SELECT COUNT(*) FROM queue_items`); err != nil {
+			t.Fatalf("unable to count queued lookups %v", err)
+		}
+		if n != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould not queue anything : got %d.", failure, testID, n)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not queue anything.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen lookups outlast the lookup timeout.", testID)
+	{
+		ips := []string{"127.0.0.2", "127.0.0.3"}
+		j, err := jobs.Create(tctx, job.NewJob{Total: s.Lookups(ips)}, time.Now())
+		if err != nil {
+			t.Fatalf("unable to create job %v", err)
+		}
+
+		if err := s.Enqueue(tctx, j.ID, ips, false); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to enqueue lookups : %s.", failure, testID, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			s.Run(ctx)
+			close(done)
+		}()
+
+		j = waitForJob(t, jobs, j.ID)
+		cancel()
+		<-done
+
+		if j.Completed != 1 || j.Failed != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould retry the lookup that timed out and fail the one that never answers : %+v.",
+				failure, testID, j)
+		}
+		t.Logf("\t%s\tTest %d:\tShould retry the lookup that timed out and fail the one that never answers.", success, testID)
+
+		res, err := results.QueryByIP(tctx, "127.0.0.2", "test")
+		if err != nil || res.Status != ipresult.StatusListed || res.Attempts != 2 {
+			t.Fatalf("\t%s\tTest %d:\tShould store the result of the retried lookup : %v %+v.", failure, testID, err, res)
+		}
+		t.Logf("\t%s\tTest %d:\tShould store the result of the retried lookup.", success, testID)
+
+		res, err = results.QueryByIP(tctx, "127.0.0.3", "test")
+		if err != nil || res.Status != ipresult.StatusDNSTimeout {
+			t.Fatalf("\t%s\tTest %d:\tShould record the lookup that timed out : %v %+v.", failure, testID, err, res)
+		}
+		t.Logf("\t%s\tTest %d:\tShould record the lookup that timed out.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen Run is stopped mid-lookup.", testID)
+	{
+		started := make(chan struct{})
+		s := newStore(t, log, db, lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}))
+
+		if err := s.Enqueue(tctx, "", []string{"127.0.0.4"}, false); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to enqueue lookups : %s.", failure, testID, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			s.Run(ctx)
+			close(done)
+		}()
+
+		<-started
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("\t%s\tTest %d:\tShould abandon the lookup in flight.", failure, testID)
+		}
+		t.Logf("\t%s\tTest %d:\tShould abandon the lookup in flight.", success, testID)
+
+		var item struct {
+			Status   string `db:"status"`
+			Attempts int    `db:"attempts"`
+		}
+		if err := db.Get(&item, `SELECT status, attempts FROM queue_items WHERE ip_address = '127.0.0.4'`); err != nil {
+			t.Fatalf("unable to retrieve queued lookup %v", err)
+		}
+		if item.Status != queue.StatusPending || item.Attempts != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould hand the lookup back without counting the attempt : %+v.", failure, testID, item)
+		}
+		t.Logf("\t%s\tTest %d:\tShould hand the lookup back without counting the attempt.", success, testID)
+
+		if _, err := results.QueryByIP(tctx, "127.0.0.4", "test"); errors.Cause(err) != ipresult.ErrNotFound {
+			t.Fatalf("\t%s\tTest %d:\tShould not record the abandoned lookup : %v.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not record the abandoned lookup.", success, testID)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to skip lookups whose results are still fresh.")
+
+	jobs := job.New(log, db)
+	results := ipresult.New(log, db)
+
+	// every answer claims it can be cached for two hours
+	var lookups int32
+	s := newStore(t, log, db, ttlLookupFunc(func(ctx context.Context, host string) ([]string, time.Duration, error) {
+		atomic.AddInt32(&lookups, 1)
+		return []string{"127.0.0.2"}, 2 * time.Hour, nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	ips := []string{"127.0.0.2"}
+
+	// enqueue runs a job for the address and returns it once it's completed
+	enqueue := func(force bool) job.Job {
+		j, err := jobs.Create(tctx, job.NewJob{Total: s.Lookups(ips)}, time.Now())
+		if err != nil {
+			t.Fatalf("unable to create job %v", err)
+		}
+
+		if err := s.Enqueue(tctx, j.ID, ips, force); err != nil {
+			t.Fatalf("unable to enqueue lookups %v", err)
+		}
+
+		return waitForJob(t, jobs, j.ID)
+	}
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen an address is looked up for the first time.", testID)
+	{
+		j := enqueue(false)
+		if j.Completed != 1 || atomic.LoadInt32(&lookups) != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould query the provider : %+v %d.", failure, testID, j, atomic.LoadInt32(&lookups))
+		}
+		t.Logf("\t%s\tTest %d:\tShould query the provider.", success, testID)
+
+		res, err := results.QueryByIP(tctx, "127.0.0.2", "test")
+		if err != nil || res.TTL != int(time.Hour/time.Second) || !res.Fresh(time.Now()) {
+			t.Fatalf("\t%s\tTest %d:\tShould store the answer's TTL capped at the max TTL : %v %+v.", failure, testID, err, res)
+		}
+		t.Logf("\t%s\tTest %d:\tShould store the answer's TTL capped at the max TTL.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen an address with a fresh result is enqueued again.", testID)
+	{
+		j := enqueue(false)
+		if j.Completed != 1 || atomic.LoadInt32(&lookups) != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould complete the job without querying the provider : %+v %d.", failure, testID, j, atomic.LoadInt32(&lookups))
+		}
+		t.Logf("\t%s\tTest %d:\tShould complete the job without querying the provider.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen the lookup is forced.", testID)
+	{
+		j := enqueue(true)
+		if j.Completed != 1 || atomic.LoadInt32(&lookups) != 2 {
+			t.Fatalf("\t%s\tTest %d:\tShould query the provider regardless : %+v %d.", failure, testID, j, atomic.LoadInt32(&lookups))
+		}
+		t.Logf("\t%s\tTest %d:\tShould query the provider regardless.", success, testID)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to notify webhooks when a listing changes.")
+
+	jobs := job.New(log, db)
+	webhookStore := webhook.New(log, db)
+
+	w, err := webhookStore.Create(traceID, webhook.NewWebhook{URL: "https://example.com/hook", Secret: "secret"}, time.Now())
+	if err != nil {
+		t.Fatalf("unable to create webhook %v", err)
+	}
+
+	// listed holds the code the provider answers with, the address isn't listed when it's empty
+	var listed atomic.Value
+	listed.Store("")
+	s := newStore(t, log, db, lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+		if code := listed.Load().(string); code != "" {
+			return []string{code}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	ips := []string{"127.0.0.2"}
+
+	// lookup looks the address up and returns the events of the deliveries queued so far, newest first
+	lookup := func(code string) []string {
+		listed.Store(code)
+
+		j, err := jobs.Create(tctx, job.NewJob{Total: s.Lookups(ips)}, time.Now())
+		if err != nil {
+			t.Fatalf("unable to create job %v", err)
+		}
+
+		if err := s.Enqueue(tctx, j.ID, ips, true); err != nil {
+			t.Fatalf("unable to enqueue lookups %v", err)
+		}
+		waitForJob(t, jobs, j.ID)
+
+		deliveries, err := webhookStore.QueryDeliveries(traceID, w.ID, "", 10)
+		if err != nil {
+			t.Fatalf("unable to query deliveries %v", err)
+		}
+
+		var events []string
+		for _, d := range deliveries {
+			events = append(events, d.Event)
+		}
+		return events
+	}
+
+	tests := []struct {
+		name  string
+		code  string
+		count int
+		event string
+	}{
+		{"an address isn't listed", "", 0, ""},
+		{"an address is listed", "127.0.0.2", 1, webhook.EventListed},
+		{"an address is listed the same as before", "127.0.0.2", 1, webhook.EventListed},
+		{"an address is listed under another code", "127.0.0.4", 2, webhook.EventCodeChanged},
+		{"an address is delisted", "", 3, webhook.EventDelisted},
+	}
+
+	for testID, tt := range tests {
+		t.Logf("\tTest %d:\tWhen %s.", testID, tt.name)
+		{
+			events := lookup(tt.code)
+			if len(events) != tt.count || (tt.count > 0 && events[0] != tt.event) {
+				t.Fatalf("\t%s\tTest %d:\tShould have queued %d deliveries, the latest %q : %v.", failure, testID, tt.count, tt.event, events)
+			}
+			t.Logf("\t%s\tTest %d:\tShould have queued %d deliveries, the latest %q.", success, testID, tt.count, tt.event)
+		}
+	}
+}
+
+func TestExpandCIDR(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to enqueue whole ranges of addresses.")
+
+	s := newStore(t, log, db, lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+		return nil, nil
+	}))
+
+	tests := []struct {
+		cidr  string
+		count int
+		first string
+		last  string
+		err   error
+	}{
+		{"10.0.0.0/24", 256, "10.0.0.0", "10.0.0.255", nil},
+		{"10.0.1.7/22", 1024, "10.0.0.0", "10.0.3.255", nil},
+		{"255.255.255.252/30", 4, "255.255.255.252", "255.255.255.255", nil},
+		{"10.0.0.1/32", 1, "10.0.0.1", "10.0.0.1", nil},
+		{"2001:DB8::/126", 4, "2001:db8::", "2001:db8::3", nil},
+		{"10.0.0.0/21", 0, "", "", processips.ErrRangeTooLarge},
+		{"2001:db8::/64", 0, "", "", processips.ErrRangeTooLarge},
+		{"10.0.0.0/33", 0, "", "", processips.ErrInvalidCIDR},
+	}
+
+	for testID, tt := range tests {
+		ips, err := s.ExpandCIDR(tt.cidr)
+		if errors.Cause(err) != tt.err {
+			t.Fatalf("\t%s\tTest %d:\tShould receive %v for %s : %v.", failure, testID, tt.err, tt.cidr, err)
+		}
+
+		if tt.err == nil && (len(ips) != tt.count || ips[0] != tt.first || ips[len(ips)-1] != tt.last) {
+			t.Fatalf("\t%s\tTest %d:\tShould expand %s to %d addresses from %s to %s : %d %v.", failure, testID, tt.cidr,
+				tt.count, tt.first, tt.last, len(ips), ips)
+		}
+		t.Logf("\t%s\tTest %d:\tShould expand %s.", success, testID, tt.cidr)
+	}
+}
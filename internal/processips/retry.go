@@ -0,0 +1,61 @@
+package processips
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/retry"
+	"github.com/shaneu/indahaus/pkg/spamhaus"
+)
+
+// Backoff returns how long a lookup waits before it's made again after its attempt'th attempt failed. The delay
+// starts at RetryDelay and doubles with each attempt up to MaxRetryDelay, less some jitter, see retry.Backoff
+func (c Config) Backoff(attempt int) time.Duration {
+	return retry.Backoff(attempt, c.RetryDelay, c.MaxRetryDelay)
+}
+
+// Transient reports whether a failed lookup is worth making again. Timeouts, temporary failures such as SERVFAIL
+// and spamhaus' rate limiting all clear up on their own. A refused open resolver, a bad key or a typo in the zone
+// won't, and neither will any other error the zone answers with. A name that doesn't exist isn't a failure at all,
+// dnsbl.Resolver reports it as not listed
+func Transient(err error) bool {
+	switch errors.Cause(err) {
+	case spamhaus.ErrExcessiveQueries, context.DeadlineExceeded:
+		return true
+	case spamhaus.ErrOpenResolver, spamhaus.ErrDQSKey, spamhaus.ErrTypo, spamhaus.ErrUnknown, spamhaus.ErrIPQuery:
+		return false
+	}
+
+	if v, ok := errors.Cause(err).(*net.DNSError); ok {
+		return v.IsTimeout || v.IsTemporary
+	}
+
+	// anything else came from storing the result rather than the lookup, such as a locked database
+	return true
+}
+
+// lookupStatus classifies a failed lookup into one of the statuses stored with a result
+func lookupStatus(err error) string {
+	switch errors.Cause(err) {
+	case spamhaus.ErrExcessiveQueries:
+		return ipresult.StatusRateLimited
+	case spamhaus.ErrOpenResolver:
+		return ipresult.StatusOpenResolverBlocked
+	case spamhaus.ErrDQSKey:
+		return ipresult.StatusInvalidKey
+	case context.DeadlineExceeded:
+		return ipresult.StatusDNSTimeout
+	}
+
+	if v, ok := errors.Cause(err).(*net.DNSError); ok {
+		if v.IsTimeout {
+			return ipresult.StatusDNSTimeout
+		}
+		return ipresult.StatusDNSError
+	}
+
+	return ipresult.StatusError
+}
@@ -0,0 +1,75 @@
+package processips_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/processips"
+	"github.com/shaneu/indahaus/pkg/spamhaus"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Log("Given the need to space out retries.")
+
+	cfg := processips.Config{
+		RetryDelay:    time.Second,
+		MaxRetryDelay: 10 * time.Second,
+	}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for testID, tt := range tests {
+		t.Logf("\tTest %d:\tWhen attempt %d failed.", testID, tt.attempt)
+
+		// the jitter is random so check the bounds a few times over
+		for i := 0; i < 100; i++ {
+			got := cfg.Backoff(tt.attempt)
+			if got < tt.max/2 || got > tt.max {
+				t.Fatalf("\t%s\tTest %d:\tShould wait between %s and %s : %s.", failure, testID, tt.max/2, tt.max, got)
+			}
+		}
+		t.Logf("\t%s\tTest %d:\tShould wait between %s and %s.", success, testID, tt.max/2, tt.max)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	t.Log("Given the need to tell transient lookup failures from permanent ones.")
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{"servfail", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{"refused", &net.DNSError{Err: "connection refused"}, false},
+		{"deadline", context.DeadlineExceeded, true},
+		{"rate limited", errors.Wrap(spamhaus.ErrExcessiveQueries, "spamhaus responded 127.255.255.255"), true},
+		{"open resolver", errors.Wrap(spamhaus.ErrOpenResolver, "spamhaus responded 127.255.255.254"), false},
+		{"bad key", errors.Wrap(spamhaus.ErrDQSKey, "spamhaus responded 127.255.255.250"), false},
+		{"typo", errors.Wrap(spamhaus.ErrTypo, "spamhaus responded 127.255.255.252"), false},
+		{"store", errors.New("database is locked"), true},
+	}
+
+	for testID, tt := range tests {
+		t.Logf("\tTest %d:\tWhen the lookup failed with %s.", testID, tt.name)
+
+		if got := processips.Transient(tt.err); got != tt.want {
+			t.Fatalf("\t%s\tTest %d:\tShould be transient %t : %t.", failure, testID, tt.want, got)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be transient %t.", success, testID, tt.want)
+	}
+}
@@ -0,0 +1,142 @@
+package processips
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/trace"
+)
+
+// write is a result waiting on the writer, the outcome is sent on done once its batch is flushed. ctx is the
+// lookup's, it's only used should the result have to be written by itself
+type write struct {
+	ctx    context.Context
+	upsert ipresult.Upsert
+	done   chan written
+}
+
+type written struct {
+	res ipresult.Upserted
+	err error
+}
+
+// writer stores the results of successful lookups in batches so a large job takes the database's write lock once
+// per batch rather than once per address. A batch is flushed once it holds WriteBatchSize results, or one from every
+// worker, or the first of them has waited WriteInterval, whichever comes first. Workers wait on their result being
+// stored, and the writer only takes a batch's worth of results ahead of the one it's flushing, so a slow database
+// holds the workers back rather than piling up results in memory
+type writer struct {
+	s      Store
+	size   int
+	writes chan write
+	done   chan struct{}
+}
+
+func newWriter(s Store) *writer {
+	// each worker waits on a single result at a time, so once there's one from every worker there's no point
+	// waiting for more
+	size := s.cfg.WriteBatchSize
+	if size > s.cfg.Workers {
+		size = s.cfg.Workers
+	}
+
+	return &writer{
+		s:      s,
+		size:   size,
+		writes: make(chan write, size),
+		done:   make(chan struct{}),
+	}
+}
+
+// store waits for the result to be written, returning the row as written along with the codes it was listed under
+// before. It gives up once ctx is done, though a result already taken by the writer may still be written
+func (w *writer) store(ctx context.Context, u ipresult.Upsert) (ipresult.Upserted, error) {
+	done := make(chan written, 1)
+
+	select {
+	case w.writes <- write{ctx: ctx, upsert: u, done: done}:
+	case <-ctx.Done():
+		return ipresult.Upserted{}, ctx.Err()
+	}
+
+	select {
+	case res := <-done:
+		return res.res, res.err
+	case <-ctx.Done():
+		return ipresult.Upserted{}, ctx.Err()
+	}
+}
+
+// run flushes batches until close is called, the results already handed to it are written before it returns
+func (w *writer) run() {
+	defer close(w.done)
+
+	for {
+		first, ok := <-w.writes
+		if !ok {
+			return
+		}
+
+		batch := []write{first}
+		timer := time.NewTimer(w.s.cfg.WriteInterval)
+
+	collect:
+		for len(batch) < w.size {
+			select {
+			case next, ok := <-w.writes:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		w.flush(batch)
+	}
+}
+
+// close stops the writer once it's written every result handed to it. Nothing may be stored once it's called
+func (w *writer) close() {
+	close(w.writes)
+	<-w.done
+}
+
+// flush writes the batch in a single transaction. Should that fail each result is written by itself, so one bad
+// result only fails its own lookup rather than every lookup in the batch
+func (w *writer) flush(batch []write) {
+	// the batch is written under a trace of its own as it's made up of many lookups, bounded like any one of them
+	ctx, cancel := context.WithTimeout(trace.WithID(context.Background(), uuid.New().String()), w.s.cfg.LookupTimeout)
+	defer cancel()
+
+	upserts := make([]ipresult.Upsert, len(batch))
+	for i, wr := range batch {
+		upserts[i] = wr.upsert
+	}
+
+	out, err := w.s.dataStore.AddOrUpdateMany(ctx, upserts, time.Now())
+	if err == nil {
+		for i, wr := range batch {
+			wr.done <- written{res: out[i]}
+		}
+		return
+	}
+
+	if len(batch) > 1 {
+		w.s.log.Printf("%s : ERROR    : AddOrUpdateMany %d results, writing them one at a time %v", trace.ID(ctx),
+			len(batch), err)
+	}
+
+	for _, wr := range batch {
+		out, err := w.s.dataStore.AddOrUpdateMany(wr.ctx, []ipresult.Upsert{wr.upsert}, time.Now())
+		if err != nil {
+			wr.done <- written{err: err}
+			continue
+		}
+		wr.done <- written{res: out[0]}
+	}
+}
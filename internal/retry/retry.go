@@ -0,0 +1,28 @@
+// Package retry spaces out the attempts of work that's retried later when it fails, such as the queued lookups and
+// webhook deliveries
+package retry
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff returns how long to wait before trying again after the attempt'th attempt failed. The delay starts at
+// delay and doubles with each attempt up to max, then a random amount of up to half of it is taken off so work that
+// failed together, say when a resolver went away, doesn't all come back at once
+func Backoff(attempt int, delay time.Duration, max time.Duration) time.Duration {
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+
+	return delay - time.Duration(rand.Int63n(half+1))
+}
@@ -0,0 +1,43 @@
+package retry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shaneu/indahaus/internal/retry"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Log("Given the need to space out retries.")
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for testID, tt := range tests {
+		t.Logf("\tTest %d:\tWhen attempt %d failed.", testID, tt.attempt)
+
+		// the jitter is random so check the bounds a few times over
+		for i := 0; i < 100; i++ {
+			got := retry.Backoff(tt.attempt, time.Second, 10*time.Second)
+			if got < tt.max/2 || got > tt.max {
+				t.Fatalf("\t%s\tTest %d:\tShould wait between %s and %s : %s.", failure, testID, tt.max/2, tt.max, got)
+			}
+		}
+		t.Logf("\t%s\tTest %d:\tShould wait between %s and %s.", success, testID, tt.max/2, tt.max)
+	}
+}
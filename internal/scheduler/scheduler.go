@@ -0,0 +1,117 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/processips"
+	"github.com/shaneu/indahaus/internal/trace"
+)
+
+// Config sets the pace of the scheduler, zero values fall back to the defaults below
+type Config struct {
+	// Interval is how often stale addresses are looked for
+	Interval time.Duration
+	// BatchSize is the most addresses queued each interval, which keeps the scheduler from flooding the queue
+	// after a long time off
+	BatchSize int
+	// MaxAge is how long after its last lookup an address is checked again
+	MaxAge time.Duration
+	// WatchedOnly limits the scheduler to watched addresses, otherwise every address with a result is kept fresh
+	WatchedOnly bool
+}
+
+const (
+	defaultInterval  = time.Minute
+	defaultBatchSize = 100
+	defaultMaxAge    = 24 * time.Hour
+)
+
+// Store queues stale addresses to be checked again, so results stay current without anyone calling enqueue
+type Store struct {
+	log        *log.Logger
+	dataStore  ipresult.Store
+	jobStore   job.Store
+	processIPs processips.Store
+	cfg        Config
+}
+
+func New(log *log.Logger, dataStore ipresult.Store, jobStore job.Store, processIPs processips.Store, cfg Config) Store {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultMaxAge
+	}
+
+	return Store{
+		log:        log,
+		dataStore:  dataStore,
+		jobStore:   jobStore,
+		processIPs: processIPs,
+		cfg:        cfg,
+	}
+}
+
+// Run queues a batch of stale addresses straight away and once every interval after that until ctx is cancelled
+func (s Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		tctx := trace.WithID(ctx, uuid.New().String())
+		if _, err := s.Schedule(tctx, time.Now()); err != nil {
+			s.log.Printf("%s : ERROR    : scheduler.Schedule %v", trace.ID(tctx), err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Schedule queues the stale addresses as of now, up to the batch size, as a single job. It returns the job, which
+// is empty when nothing was stale
+func (s Store) Schedule(ctx context.Context, now time.Time) (job.Job, error) {
+	traceID := trace.ID(ctx)
+
+	ips, err := s.dataStore.QueryStale(ctx, s.processIPs.Providers(), now.Add(-s.cfg.MaxAge), s.cfg.WatchedOnly,
+		s.cfg.BatchSize)
+	if err != nil {
+		return job.Job{}, errors.Wrap(err, "querying stale addresses")
+	}
+
+	if len(ips) == 0 {
+		return job.Job{}, nil
+	}
+
+	j, err := s.jobStore.Create(ctx, job.NewJob{Total: s.processIPs.Lookups(ips)}, now)
+	if err != nil {
+		return job.Job{}, errors.Wrap(err, "creating job")
+	}
+
+	// the addresses are forced since they're stale by our own measure, MaxAge, whatever their TTL says. Otherwise an
+	// address within its TTL would be skipped, leaving its attempt time as it was, and come straight back next time
+	if err := s.processIPs.Enqueue(ctx, j.ID, ips, true); err != nil {
+		// nothing was queued against the job so it would never finish, see the enqueue resolver
+		// removed even when the enqueue failed because the scheduler was stopped
+		if err := s.jobStore.Delete(trace.WithID(context.Background(), traceID), j.ID); err != nil {
+			s.log.Printf("%s : ERROR    : job.Delete %s %v", traceID, j.ID, err)
+		}
+		return job.Job{}, errors.Wrap(err, "enqueueing lookups")
+	}
+
+	s.log.Printf("%s : scheduler : queued %d stale addresses as job %s", traceID, len(ips), j.ID)
+
+	return j, nil
+}
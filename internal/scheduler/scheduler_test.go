@@ -0,0 +1,237 @@
+package scheduler_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/shaneu/indahaus/internal/data/ipresult"
+	"github.com/shaneu/indahaus/internal/data/job"
+	"github.com/shaneu/indahaus/internal/data/queue"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/data/watch"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/internal/events"
+	"github.com/shaneu/indahaus/internal/processips"
+	"github.com/shaneu/indahaus/internal/scheduler"
+	"github.com/shaneu/indahaus/internal/trace"
+	"github.com/shaneu/indahaus/internal/webhooks"
+	"github.com/shaneu/indahaus/pkg/database"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+const traceID = "00000000-0000-0000-0000-000000000000"
+
+// tctx carries the trace id into the store calls made by the tests
+var tctx = trace.WithID(context.Background(), traceID)
+
+// lookupFunc lets a plain function stand in for the network
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f lookupFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+// queued returns the addresses waiting in the queue
+func queued(t *testing.T, db *sqlx.DB) []string {
+	var ips []string
+	if err := db.Select(&ips, `SELECT ip_address FROM queue_items ORDER BY ip_address`); err != nil {
+		t.Fatalf("unable to select queue items %v", err)
+	}
+
+	return ips
+}
+
+func TestScheduler(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to keep results fresh without anyone enqueueing them.")
+
+	providers, err := dnsbl.NewRegistry(dnsbl.NewList(dnsbl.ListConfig{Name: "test", Zone: "dnsbl.test"}))
+	if err != nil {
+		t.Fatalf("unable to build registry : %v", err)
+	}
+
+	resolver, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+		Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}),
+	})
+	if err != nil {
+		t.Fatalf("unable to build resolver : %v", err)
+	}
+
+	results := ipresult.New(log, db)
+	jobs := job.New(log, db)
+	processIPs := processips.New(log, results, jobs, queue.New(log, db), events.New(),
+		webhooks.New(log, webhook.New(log, db), webhooks.Config{}), providers, resolver, processips.Config{})
+
+	now := time.Date(2018, time.October, 1, 0, 0, 0, 0, time.UTC)
+
+	// 127.0.0.2 is watched but has never been looked up, 127.0.0.3 is watched and fresh, 127.0.0.4 is watched and
+	// stale and 127.0.0.5 is stale but not watched. 127.0.0.3 also has a stale result from a provider that's since
+	// been disabled, which nothing will ever look up again
+	if err := watch.New(log, db).Add(tctx, []string{"127.0.0.2", "127.0.0.3", "127.0.0.4"}, now); err != nil {
+		t.Fatalf("unable to watch addresses %v", err)
+	}
+
+	for ip, at := range map[string]time.Time{
+		"127.0.0.3": now.Add(-time.Hour),
+		"127.0.0.4": now.Add(-48 * time.Hour),
+		"127.0.0.5": now.Add(-72 * time.Hour),
+	} {
+		if _, _, err := results.AddOrUpdate(tctx, ip, "test", ipresult.UpdateIPResult{Attempts: 1}, at); err != nil {
+			t.Fatalf("unable to add result %v", err)
+		}
+	}
+
+	if _, _, err := results.AddOrUpdate(tctx, "127.0.0.3", "disabled", ipresult.UpdateIPResult{Attempts: 1},
+		now.Add(-72*time.Hour)); err != nil {
+		t.Fatalf("unable to add result %v", err)
+	}
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen the lookups can't be queued.", testID)
+	{
+		s := scheduler.New(log, results, jobs, processIPs, scheduler.Config{MaxAge: 24 * time.Hour, WatchedOnly: true})
+
+		const trigger = `CREATE TRIGGER queue_full BEFORE INSERT ON queue_items BEGIN SELECT RAISE(ABORT, 'queue full'); END`
+		if _, err := db.Exec(trigger); err != nil {
+			t.Fatalf("unable to create trigger %v", err)
+		}
+
+		if _, err := s.Schedule(tctx, now); err == nil {
+			t.Fatalf("\t%s\tTest %d:\tShould fail to schedule.", failure, testID)
+		}
+		t.Logf("\t%s\tTest %d:\tShould fail to schedule.", success, testID)
+
+		if _, err := db.Exec(`DROP TRIGGER queue_full`); err != nil {
+			t.Fatalf("unable to drop trigger %v", err)
+		}
+
+		left, err := jobs.Query(tctx, 10)
+		if err != nil {
+			t.Fatalf("unable to list jobs %v", err)
+		}
+		if len(left) != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould not leave a job that can't finish : %+v.", failure, testID, left)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not leave a job that can't finish.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen only watched addresses are scheduled.", testID)
+	{
+		s := scheduler.New(log, results, jobs, processIPs, scheduler.Config{MaxAge: 24 * time.Hour, WatchedOnly: true})
+
+		j, err := s.Schedule(tctx, now)
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to schedule : %s.", failure, testID, err)
+		}
+
+		ips := queued(t, db)
+		if j.Total != 2 || len(ips) != 2 || ips[0] != "127.0.0.2" || ips[1] != "127.0.0.4" {
+			t.Fatalf("\t%s\tTest %d:\tShould queue the stale watched addresses : %+v %v.", failure, testID, j, ips)
+		}
+		t.Logf("\t%s\tTest %d:\tShould queue the stale watched addresses.", success, testID)
+
+		j, err = s.Schedule(tctx, now)
+		if err != nil || j.ID != "" || len(queued(t, db)) != 2 {
+			t.Fatalf("\t%s\tTest %d:\tShould not queue addresses that are already queued : %v %+v.", failure, testID, err, j)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not queue addresses that are already queued.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen every address is scheduled.", testID)
+	{
+		s := scheduler.New(log, results, jobs, processIPs, scheduler.Config{MaxAge: 24 * time.Hour})
+
+		if _, err := s.Schedule(tctx, now); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to schedule : %s.", failure, testID, err)
+		}
+
+		ips := queued(t, db)
+		if len(ips) != 3 || ips[2] != "127.0.0.5" {
+			t.Fatalf("\t%s\tTest %d:\tShould queue the stale address that isn't watched : %v.", failure, testID, ips)
+		}
+		t.Logf("\t%s\tTest %d:\tShould queue the stale address that isn't watched.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen the queued lookups are made.", testID)
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			processIPs.Run(ctx)
+			close(done)
+		}()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(queued(t, db)) != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		<-done
+
+		res, err := results.QueryByIP(tctx, "127.0.0.4", "test")
+		if err != nil || !res.LastAttemptAt.After(now) {
+			t.Fatalf("\t%s\tTest %d:\tShould look the stale address up again : %v %+v.", failure, testID, err, res)
+		}
+		t.Logf("\t%s\tTest %d:\tShould look the stale address up again.", success, testID)
+
+		s := scheduler.New(log, results, jobs, processIPs, scheduler.Config{MaxAge: 24 * time.Hour})
+		j, err := s.Schedule(tctx, now)
+		if err != nil || j.ID != "" {
+			t.Fatalf("\t%s\tTest %d:\tShould have nothing left to schedule : %v %+v.", failure, testID, err, j)
+		}
+		t.Logf("\t%s\tTest %d:\tShould have nothing left to schedule.", success, testID)
+	}
+}
@@ -0,0 +1,26 @@
+// Package trace carries the trace id of a request, or of a unit of background work, in its context so the stores
+// and workers it passes through can log against it
+package trace
+
+import "context"
+
+type ctxKey int
+
+const idKey ctxKey = 0
+
+// untraced is logged in place of the trace id of work that wasn't given one
+const untraced = "untraced"
+
+// WithID returns a copy of ctx carrying the trace id
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey, id)
+}
+
+// ID returns the trace id carried by ctx
+func ID(ctx context.Context) string {
+	if id, ok := ctx.Value(idKey).(string); ok {
+		return id
+	}
+
+	return untraced
+}
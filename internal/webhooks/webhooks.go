@@ -0,0 +1,359 @@
+// Package webhooks notifies registered webhooks of changes to listings. Notifications are stored as deliveries
+// before they're sent, so they survive a restart and a webhook that's down is retried rather than missed
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/internal/retry"
+)
+
+// The headers sent with each delivery. The signature is the hex HMAC-SHA256, keyed with the webhook's secret, of
+// the timestamp, a dot and the body, see Sign. Receivers should check it and reject old timestamps to stop replays
+const (
+	HeaderDelivery  = "X-Indahaus-Delivery"
+	HeaderEvent     = "X-Indahaus-Event"
+	HeaderTimestamp = "X-Indahaus-Timestamp"
+	HeaderSignature = "X-Indahaus-Signature"
+)
+
+// Config tunes the delivery of notifications, zero values fall back to the defaults below
+type Config struct {
+	// PollInterval is how often deliveries are checked for work nobody signalled, such as retries coming due
+	PollInterval time.Duration
+	// BatchSize is the most deliveries sent at once
+	BatchSize int
+	// MaxAttempts is the number of times a delivery is sent before it's given up on and left dead
+	MaxAttempts int
+	// RetryDelay is how long a delivery that failed once waits before it's sent again, it doubles with each failed
+	// attempt up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Timeout bounds each request to a webhook
+	Timeout time.Duration
+}
+
+const (
+	defaultPollInterval  = time.Second
+	defaultBatchSize     = 10
+	defaultMaxAttempts   = 5
+	defaultRetryDelay    = 5 * time.Second
+	defaultMaxRetryDelay = 5 * time.Minute
+	defaultTimeout       = 10 * time.Second
+
+	// staleClaimTimeouts is how many timeouts old a claim is before it's recovered, see recover
+	staleClaimTimeouts = 2
+)
+
+// A Change is a listing of an address by a provider that changed with its latest lookup
+type Change struct {
+	IPAddress     string
+	Provider      string
+	Event         string
+	Codes         []string
+	PreviousCodes []string
+	OccurredAt    time.Time
+}
+
+// Payload is the JSON body sent to a webhook
+type Payload struct {
+	Event         string    `json:"event"`
+	IPAddress     string    `json:"ip_address"`
+	Provider      string    `json:"provider"`
+	Codes         []string  `json:"codes"`
+	PreviousCodes []string  `json:"previous_codes"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+type Store struct {
+	log          *log.Logger
+	webhookStore webhook.Store
+	client       *http.Client
+	cfg          Config
+	// notify wakes Run when deliveries are enqueued so they don't wait out the poll interval
+	notify chan struct{}
+}
+
+func New(log *log.Logger, webhookStore webhook.Store, cfg Config) Store {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = defaultRetryDelay
+	}
+	if cfg.MaxRetryDelay <= 0 {
+		cfg.MaxRetryDelay = defaultMaxRetryDelay
+	}
+	if cfg.MaxRetryDelay < cfg.RetryDelay {
+		cfg.MaxRetryDelay = cfg.RetryDelay
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	return Store{
+		log:          log,
+		webhookStore: webhookStore,
+		client:       &http.Client{Timeout: cfg.Timeout},
+		cfg:          cfg,
+		notify:       make(chan struct{}, 1),
+	}
+}
+
+// Classify returns the event of a listing going from the previous codes to the next, ok is false when nothing
+// changed. The codes are compared as sets
+func Classify(prev []string, next []string) (event string, ok bool) {
+	switch {
+	case len(prev) == 0 && len(next) == 0:
+		return "", false
+	case len(prev) == 0:
+		return webhook.EventListed, true
+	case len(next) == 0:
+		return webhook.EventDelisted, true
+	}
+
+	set := make(map[string]struct{}, len(prev))
+	for _, c := range prev {
+		set[c] = struct{}{}
+	}
+
+	same := len(prev) == len(next)
+	for _, c := range next {
+		if _, found := set[c]; !found {
+			same = false
+		}
+	}
+
+	if same {
+		return "", false
+	}
+
+	return webhook.EventCodeChanged, true
+}
+
+// Notify queues a delivery of the change to each webhook that matches it
+func (s Store) Notify(traceID string, c Change) error {
+	hooks, err := s.webhookStore.Query(traceID)
+	if err != nil {
+		return errors.Wrap(err, "querying webhooks")
+	}
+
+	body, err := json.Marshal(Payload{
+		Event:         c.Event,
+		IPAddress:     c.IPAddress,
+		Provider:      c.Provider,
+		Codes:         nonNil(c.Codes),
+		PreviousCodes: nonNil(c.PreviousCodes),
+		OccurredAt:    c.OccurredAt.UTC(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "encoding payload")
+	}
+
+	var deliveries []webhook.NewDelivery
+	for _, w := range hooks {
+		if !w.Matches(c.Event, c.IPAddress) {
+			continue
+		}
+
+		deliveries = append(deliveries, webhook.NewDelivery{
+			WebhookID: w.ID,
+			Event:     c.Event,
+			Payload:   string(body),
+		})
+	}
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	if _, err := s.webhookStore.Enqueue(traceID, deliveries, c.OccurredAt); err != nil {
+		return errors.Wrap(err, "enqueueing deliveries")
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run sends the queued deliveries until ctx is cancelled. The requests in flight are made under ctx, once it's
+// cancelled they're abandoned and their deliveries handed back to be sent later. Deliveries left claimed by a process
+// that stopped without handing them back are recovered once their claim is stale, see recover
+func (s Store) Run(ctx context.Context) {
+	traceID := uuid.New().String()
+
+	s.recover(traceID)
+	recovered := time.Now()
+
+	for ctx.Err() == nil {
+		// another replica may have stopped with deliveries claimed at any time, not just before we started
+		if time.Since(recovered) >= s.cfg.Timeout {
+			s.recover(traceID)
+			recovered = time.Now()
+		}
+
+		deliveries, err := s.webhookStore.Claim(traceID, s.cfg.BatchSize, time.Now())
+		if err != nil {
+			s.log.Printf("%s : ERROR    : webhook.Claim %v", traceID, err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(len(deliveries))
+		for _, d := range deliveries {
+			go func(d webhook.Delivery) {
+				defer wg.Done()
+				s.process(ctx, d)
+			}(d)
+		}
+		wg.Wait()
+
+		// a full batch means there may be more waiting
+		if len(deliveries) == s.cfg.BatchSize {
+			continue
+		}
+
+		select {
+		case <-s.notify:
+		case <-time.After(s.cfg.PollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// recover puts the deliveries left claimed by a process that stopped before finishing them back to pending. A batch
+// is sent at once with each request bounded by Timeout, so a claim older than staleClaimTimeouts of them can't still
+// be in flight in any process
+func (s Store) recover(traceID string) {
+	now := time.Now()
+
+	n, err := s.webhookStore.Recover(traceID, now.Add(-staleClaimTimeouts*s.cfg.Timeout), now)
+	if err != nil {
+		s.log.Printf("%s : ERROR    : webhook.Recover %v", traceID, err)
+	}
+	if n > 0 {
+		s.log.Printf("%s : webhooks : resuming %d unfinished deliveries", traceID, n)
+	}
+}
+
+// process sends a claimed delivery, retrying it later when it fails and it has attempts left
+func (s Store) process(ctx context.Context, d webhook.Delivery) {
+	traceID := d.TraceID
+
+	err := s.send(ctx, traceID, d)
+	if err == nil {
+		if err := s.webhookStore.Delivered(traceID, d.ID, time.Now()); err != nil {
+			s.log.Printf("%s : ERROR    : webhook.Delivered %s %v", traceID, d.ID, err)
+		}
+		return
+	}
+
+	// Run was stopped, the delivery didn't fail so it's handed back without counting the attempt
+	if ctx.Err() != nil {
+		if err := s.webhookStore.Release(traceID, d.ID, time.Now()); err != nil {
+			s.log.Printf("%s : ERROR    : webhook.Release %s %v", traceID, d.ID, err)
+		}
+		return
+	}
+
+	if d.Attempts < s.cfg.MaxAttempts {
+		delay := s.cfg.Backoff(d.Attempts)
+		s.log.Printf("%s : webhooks : retrying delivery %s in %s, attempt %d of %d : %v", traceID, d.ID, delay,
+			d.Attempts, s.cfg.MaxAttempts, err)
+
+		if err := s.webhookStore.Retry(traceID, d.ID, err, time.Now().Add(delay), time.Now()); err != nil {
+			s.log.Printf("%s : ERROR    : webhook.Retry %s %v", traceID, d.ID, err)
+		}
+		return
+	}
+
+	s.log.Printf("%s : ERROR    : giving up on delivery %s after %d attempts : %v", traceID, d.ID, d.Attempts, err)
+	if err := s.webhookStore.Dead(traceID, d.ID, err, time.Now()); err != nil {
+		s.log.Printf("%s : ERROR    : webhook.Dead %s %v", traceID, d.ID, err)
+	}
+}
+
+// send posts the delivery's payload to its webhook, any response other than a 2xx is an error
+func (s Store) send(ctx context.Context, traceID string, d webhook.Delivery) error {
+	w, err := s.webhookStore.QueryByID(traceID, d.WebhookID)
+	if err != nil {
+		return errors.Wrap(err, "querying webhook")
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, d.ID)
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(w.Secret, timestamp, []byte(d.Payload)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "posting delivery")
+	}
+	defer resp.Body.Close()
+
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of the timestamp, a dot and the body keyed with the secret
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns how long a delivery waits before it's sent again after its attempt'th attempt failed, see
+// retry.Backoff
+func (c Config) Backoff(attempt int) time.Duration {
+	return retry.Backoff(attempt, c.RetryDelay, c.MaxRetryDelay)
+}
+
+// nonNil keeps empty lists of codes as [] rather than null in the payload
+func nonNil(codes []string) []string {
+	if codes == nil {
+		return []string{}
+	}
+
+	return codes
+}
@@ -0,0 +1,305 @@
+package webhooks_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/shaneu/indahaus/internal/data/schema"
+	"github.com/shaneu/indahaus/internal/data/webhook"
+	"github.com/shaneu/indahaus/internal/webhooks"
+	"github.com/shaneu/indahaus/pkg/database"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func setup(t *testing.T) (*log.Logger, *sqlx.DB, func()) {
+	tempFile, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unable to create temp file %v", err)
+	}
+
+	cfg := database.Config{
+		Uri: fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", tempFile.Name()),
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		t.Fatalf("opening database connection: %v", err)
+	}
+
+	if err := schema.Migrate(db); err != nil {
+		t.Fatalf("unable to migrate schema: %v", err)
+	}
+
+	teardown := func() {
+		t.Helper()
+		db.Close()
+		tempFile.Close()
+		if err := os.Remove(tempFile.Name()); err != nil {
+			t.Fatalf("unable to remove temp file %s : %v", tempFile.Name(), err)
+		}
+	}
+
+	log := log.New(os.Stdout, "TEST: ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+
+	return log, db, teardown
+}
+
+// receiver is a webhook that fails the first failures requests it receives, recording each it accepts
+type receiver struct {
+	mu       sync.Mutex
+	secret   string
+	failures int
+	calls    int
+	bodies   []string
+	badSig   bool
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.calls++
+
+	want := "sha256=" + webhooks.Sign(rc.secret, r.Header.Get(webhooks.HeaderTimestamp), body)
+	if r.Header.Get(webhooks.HeaderSignature) != want {
+		rc.badSig = true
+	}
+
+	if rc.calls <= rc.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	rc.bodies = append(rc.bodies, string(body))
+}
+
+func TestClassify(t *testing.T) {
+	t.Log("Given the need to tell how a listing changed.")
+	{
+		tests := []struct {
+			prev  []string
+			next  []string
+			event string
+			ok    bool
+		}{
+			{nil, nil, "", false},
+			{nil, []string{"127.0.0.2"}, webhook.EventListed, true},
+			{[]string{"127.0.0.2"}, nil, webhook.EventDelisted, true},
+			{[]string{"127.0.0.2"}, []string{"127.0.0.4"}, webhook.EventCodeChanged, true},
+			{[]string{"127.0.0.2", "127.0.0.4"}, []string{"127.0.0.4", "127.0.0.2"}, "", false},
+		}
+
+		for testID, tt := range tests {
+			event, ok := webhooks.Classify(tt.prev, tt.next)
+			if event != tt.event || ok != tt.ok {
+				t.Fatalf("\t%s\tTest %d:\tShould classify %v to %v as %q : got %q.", failure, testID, tt.prev, tt.next, tt.event, event)
+			}
+			t.Logf("\t%s\tTest %d:\tShould classify %v to %v as %q.", success, testID, tt.prev, tt.next, tt.event)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to deliver notifications to webhooks.")
+	// ============================================================================
+	// Setup: a webhook that fails twice before succeeding and one that always fails
+	webhookStore := webhook.New(log, db)
+
+	flaky := &receiver{secret: "flaky", failures: 2}
+	flakySrv := httptest.NewServer(flaky)
+	t.Cleanup(flakySrv.Close)
+
+	down := &receiver{secret: "down", failures: 1 << 30}
+	downSrv := httptest.NewServer(down)
+	t.Cleanup(downSrv.Close)
+
+	now := time.Now()
+	traceID := "00000000-0000-0000-0000-000000000000"
+
+	flakyHook, err := webhookStore.Create(traceID, webhook.NewWebhook{URL: flakySrv.URL, Secret: flaky.secret}, now)
+	if err != nil {
+		t.Fatalf("creating webhook: %v", err)
+	}
+
+	downHook, err := webhookStore.Create(traceID, webhook.NewWebhook{URL: downSrv.URL, Secret: down.secret}, now)
+	if err != nil {
+		t.Fatalf("creating webhook: %v", err)
+	}
+
+	// a webhook for another network shouldn't be notified
+	if _, err := webhookStore.Create(traceID, webhook.NewWebhook{URL: downSrv.URL, Secret: "other",
+		CIDRs: []string{"10.0.0.0/8"}}, now); err != nil {
+		t.Fatalf("creating webhook: %v", err)
+	}
+
+	s := webhooks.New(log, webhookStore, webhooks.Config{
+		PollInterval:  10 * time.Millisecond,
+		MaxAttempts:   3,
+		RetryDelay:    time.Millisecond,
+		MaxRetryDelay: time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen a listing changes.", testID)
+	{
+		c := webhooks.Change{
+			IPAddress:  "127.0.0.2",
+			Provider:   "spamhaus",
+			Event:      webhook.EventListed,
+			Codes:      []string{"127.0.0.2"},
+			OccurredAt: now,
+		}
+
+		if err := s.Notify(traceID, c); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to notify : %s.", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould be able to notify.", success, testID)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			delivered, _ := webhookStore.QueryDeliveries(traceID, flakyHook.ID, webhook.StatusDelivered, 10)
+			dead, _ := webhookStore.QueryDeliveries(traceID, downHook.ID, webhook.StatusDead, 10)
+			if len(delivered) == 1 && len(dead) == 1 {
+				if delivered[0].Attempts != 3 {
+					t.Fatalf("\t%s\tTest %d:\tShould deliver on the third attempt : %d.", failure, testID, delivered[0].Attempts)
+				}
+				if dead[0].LastError == nil || dead[0].Attempts != 3 {
+					t.Fatalf("\t%s\tTest %d:\tShould record the error of the last attempt : %+v.", failure, testID, dead[0])
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("\t%s\tTest %d:\tShould deliver or give up in time : %d delivered, %d dead.", failure, testID,
+					len(delivered), len(dead))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Logf("\t%s\tTest %d:\tShould retry a failing webhook until it succeeds.", success, testID)
+		t.Logf("\t%s\tTest %d:\tShould give up on a webhook that keeps failing.", success, testID)
+
+		flaky.mu.Lock()
+		defer flaky.mu.Unlock()
+		down.mu.Lock()
+		defer down.mu.Unlock()
+
+		if flaky.badSig || down.badSig {
+			t.Fatalf("\t%s\tTest %d:\tShould sign each delivery with the webhook's secret.", failure, testID)
+		}
+		t.Logf("\t%s\tTest %d:\tShould sign each delivery with the webhook's secret.", success, testID)
+
+		if down.calls != 3 {
+			t.Fatalf("\t%s\tTest %d:\tShould only notify matching webhooks : %d calls.", failure, testID, down.calls)
+		}
+		t.Logf("\t%s\tTest %d:\tShould only notify matching webhooks.", success, testID)
+
+		want := `{"event":"LISTED","ip_address":"127.0.0.2","provider":"spamhaus","codes":["127.0.0.2"],"previous_codes":[],"occurred_at":"` +
+			now.UTC().Format(time.RFC3339Nano) + `"}`
+		if len(flaky.bodies) != 1 || flaky.bodies[0] != want {
+			t.Fatalf("\t%s\tTest %d:\tShould send the change : %v.", failure, testID, flaky.bodies)
+		}
+		t.Logf("\t%s\tTest %d:\tShould send the change.", success, testID)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	log, db, teardown := setup(t)
+	t.Cleanup(teardown)
+
+	t.Log("Given the need to stop delivering promptly on shutdown.")
+	// ============================================================================
+	// Setup: a webhook that never answers
+	webhookStore := webhook.New(log, db)
+
+	started := make(chan struct{})
+	var once sync.Once
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request's context is only cancelled once its body has been read
+		ioutil.ReadAll(r.Body)
+		once.Do(func() { close(started) })
+		<-r.Context().Done()
+	}))
+	t.Cleanup(hung.Close)
+
+	now := time.Now()
+	traceID := "00000000-0000-0000-0000-000000000000"
+
+	hook, err := webhookStore.Create(traceID, webhook.NewWebhook{URL: hung.URL, Secret: "hung"}, now)
+	if err != nil {
+		t.Fatalf("creating webhook: %v", err)
+	}
+
+	s := webhooks.New(log, webhookStore, webhooks.Config{PollInterval: 10 * time.Millisecond, Timeout: time.Minute})
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen Run is stopped mid-delivery.", testID)
+	{
+		c := webhooks.Change{
+			IPAddress:  "127.0.0.2",
+			Provider:   "spamhaus",
+			Event:      webhook.EventListed,
+			Codes:      []string{"127.0.0.2"},
+			OccurredAt: now,
+		}
+
+		if err := s.Notify(traceID, c); err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to notify : %s.", failure, testID, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			s.Run(ctx)
+			close(done)
+		}()
+
+		<-started
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("\t%s\tTest %d:\tShould abandon the request in flight.", failure, testID)
+		}
+		t.Logf("\t%s\tTest %d:\tShould abandon the request in flight.", success, testID)
+
+		pending, err := webhookStore.QueryDeliveries(traceID, hook.ID, webhook.StatusPending, 10)
+		if err != nil {
+			t.Fatalf("unable to query deliveries %v", err)
+		}
+		if len(pending) != 1 || pending[0].Attempts != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould hand the delivery back without counting the attempt : %+v.", failure,
+				testID, pending)
+		}
+		t.Logf("\t%s\tTest %d:\tShould hand the delivery back without counting the attempt.", success, testID)
+	}
+}
@@ -1,15 +1,51 @@
 package database
 
 import (
+	"strings"
+	"time"
+
 	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// The drivers Open can pick from the uri
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
 type Config struct {
+	// Uri is either a postgres:// or postgresql:// url, or a sqlite file uri or path, ex file:indahaus.db
 	Uri string
+	// MaxOpenConns and MaxIdleConns bound the pool, zero leaves the database/sql defaults of no limit on open
+	// connections and two idle ones. ConnMaxLifetime closes connections once they're that old, zero keeps them forever
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Driver returns the driver for the uri, postgres for postgres urls and sqlite for anything else
+func Driver(uri string) string {
+	if strings.HasPrefix(uri, "postgres://") || strings.HasPrefix(uri, "postgresql://") {
+		return DriverPostgres
+	}
+
+	return DriverSQLite
 }
 
-// Open the sqlite db
+// Open the db, picking the driver from the uri
 func Open(cfg Config) (*sqlx.DB, error) {
-	return sqlx.Open("sqlite3", cfg.Uri)
+	db, err := sqlx.Open(Driver(cfg.Uri), cfg.Uri)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	return db, nil
 }
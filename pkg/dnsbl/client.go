@@ -0,0 +1,227 @@
+package dnsbl
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TTLLookup is implemented by a HostLookup that can report how long its answer may be cached for. The TTL is
+// reported alongside an IsNotFound error as well, since an address that isn't listed can be cached too
+type TTLLookup interface {
+	LookupHostTTL(ctx context.Context, host string) ([]string, time.Duration, error)
+}
+
+// client sends A queries straight to a single nameserver. Unlike *net.Resolver it keeps the TTL of the answer,
+// which tells us how long a result stays fresh
+type client struct {
+	nameserver string
+	protocol   string
+}
+
+// maxUDPSize is the largest response we read over udp, we don't advertise EDNS so servers keep to 512 bytes and set
+// the truncated bit on anything bigger
+const maxUDPSize = 512
+
+// LookupHost implements HostLookup
+func (c client) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, _, err := c.LookupHostTTL(ctx, host)
+	return addrs, err
+}
+
+// LookupHostTTL implements TTLLookup. The TTL of an answer is the lowest TTL of its records, the TTL of a name that
+// doesn't exist is the negative caching TTL of the zone's SOA record, see RFC 2308. Failures come back as
+// *net.DNSError, the same as they do from *net.Resolver
+func (c client) LookupHostTTL(ctx context.Context, host string) ([]string, time.Duration, error) {
+	// a name we can't ask about, ex one that's too long, is a failed lookup rather than an address that isn't listed
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid query name : " + err.Error(), Name: host, Server: c.nameserver}
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	req, err := msg.Pack()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "packing query")
+	}
+
+	resp, err := c.exchange(ctx, c.protocol, req)
+	if err == nil && resp.Header.Truncated && c.protocol == "udp" {
+		// the answer didn't fit in a datagram, ask again over tcp
+		resp, err = c.exchange(ctx, "tcp", req)
+	}
+	if err != nil {
+		return nil, 0, c.dnsError(host, err)
+	}
+
+	if resp.Header.ID != msg.Header.ID {
+		return nil, 0, &net.DNSError{Err: "response id mismatch", Name: host, Server: c.nameserver, IsTemporary: true}
+	}
+
+	switch resp.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL(resp), &net.DNSError{Err: "no such host", Name: host, Server: c.nameserver, IsNotFound: true}
+	case dnsmessage.RCodeServerFailure:
+		return nil, 0, &net.DNSError{Err: "server misbehaving", Name: host, Server: c.nameserver, IsTemporary: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server misbehaving : " + resp.Header.RCode.String(), Name: host, Server: c.nameserver}
+	}
+
+	var addrs []string
+	var ttl uint32
+
+	for _, a := range resp.Answers {
+		if a.Header.Class != dnsmessage.ClassINET {
+			continue
+		}
+
+		// a recursive resolver includes the CNAMEs it followed, they limit how long the answer can be cached too
+		if ttl == 0 || a.Header.TTL < ttl {
+			ttl = a.Header.TTL
+		}
+
+		if r, ok := a.Body.(*dnsmessage.AResource); ok {
+			addrs = append(addrs, net.IP(r.A[:]).String())
+		}
+	}
+
+	// the name exists but has no A records, for a dnsbl that's as good as not being listed
+	if len(addrs) == 0 {
+		return nil, negativeTTL(resp), &net.DNSError{Err: "no such host", Name: host, Server: c.nameserver, IsNotFound: true}
+	}
+
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+// exchange sends the packed query to the nameserver and reads back the response
+func (c client) exchange(ctx context.Context, protocol string, req []byte) (dnsmessage.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, protocol, c.nameserver)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// the deadline only covers a context with one, close the connection to unblock the read when ctx is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	var resp []byte
+	if protocol == "tcp" {
+		resp, err = exchangeTCP(conn, req)
+	} else {
+		resp, err = exchangeUDP(conn, req)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return dnsmessage.Message{}, ctx.Err()
+		}
+		return dnsmessage.Message{}, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return dnsmessage.Message{}, errors.Wrap(err, "unpacking response")
+	}
+
+	return msg, nil
+}
+
+func exchangeUDP(conn net.Conn, req []byte) ([]byte, error) {
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxUDPSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// exchangeTCP frames the query and response with their length, see RFC 1035 section 4.2.2
+func exchangeTCP(conn net.Conn, req []byte) ([]byte, error) {
+	framed := make([]byte, 2+len(req))
+	binary.BigEndian.PutUint16(framed, uint16(len(req)))
+	copy(framed[2:], req)
+
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// dnsError reports a failure to reach the nameserver the way *net.Resolver does, so the resolver's retries and
+// the callers checking for timeouts work the same with either
+func (c client) dnsError(host string, err error) error {
+	if errors.Cause(err) == context.DeadlineExceeded {
+		return &net.DNSError{Err: "i/o timeout", Name: host, Server: c.nameserver, IsTimeout: true}
+	}
+
+	if errors.Cause(err) == context.Canceled {
+		return err
+	}
+
+	if ne, ok := errors.Cause(err).(net.Error); ok {
+		return &net.DNSError{Err: ne.Error(), Name: host, Server: c.nameserver, IsTimeout: ne.Timeout(), IsTemporary: true}
+	}
+
+	return &net.DNSError{Err: err.Error(), Name: host, Server: c.nameserver}
+}
+
+// negativeTTL is how long a name that doesn't exist may be cached for, the lower of the SOA record's TTL and its
+// minimum field
+func negativeTTL(resp dnsmessage.Message) time.Duration {
+	for _, a := range resp.Authorities {
+		soa, ok := a.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+
+		ttl := a.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+
+		return time.Duration(ttl) * time.Second
+	}
+
+	return 0
+}
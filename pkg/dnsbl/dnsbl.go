@@ -0,0 +1,198 @@
+package dnsbl
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrIPv6Unsupported is returned when an IPv6 address is queried against a zone that only lists IPv4 addresses
+var ErrIPv6Unsupported = errors.New("provider does not support ipv6 addresses")
+
+// Category is the broad kind of listing a code stands for
+type Category string
+
+// The categories a code can fall into, codes a provider doesn't describe are CategoryOther
+const (
+	CategorySpam      Category = "SPAM"
+	CategoryExploited Category = "EXPLOITED"
+	CategoryPolicy    Category = "POLICY"
+	CategoryHijacked  Category = "HIJACKED"
+	CategoryPhish     Category = "PHISH"
+	CategoryMalware   Category = "MALWARE"
+	CategoryBotnet    Category = "BOTNET"
+	CategoryNewDomain Category = "NEW_DOMAIN"
+	CategoryOther     Category = "OTHER"
+)
+
+// Code describes the meaning of a single return code a DNSBL zone may answer with
+type Code struct {
+	Code string `json:"code"`
+	// List is the name of the list within the zone the code comes from, ex "SBL" or "PBL" for spamhaus zen
+	List        string   `json:"list"`
+	Description string   `json:"description"`
+	Category    Category `json:"category"`
+}
+
+// Provider is a DNS based blocklist that IP addresses can be checked against
+type Provider interface {
+	// Name is the unique key a provider is registered and stored under, ex "spamhaus"
+	Name() string
+	// DisplayName is the human readable name of the provider, ex "Spamhaus ZEN"
+	DisplayName() string
+	// Zone is the dns zone queries are made against, ex "zen.spamhaus.org"
+	Zone() string
+	// Codes is the table of return codes the provider may answer with, keyed by the code
+	Codes() map[string]Code
+	// IPv6 reports whether the zone answers queries for IPv6 addresses
+	IPv6() bool
+}
+
+// ErrorCoder is implemented by providers that answer some queries with codes signalling the query failed rather
+// than the address being listed, ex spamhaus answers 127.255.255.254 to queries made through public resolvers
+type ErrorCoder interface {
+	// CodeErr returns the error a code stands for, or nil when the code is a listing
+	CodeErr(code string) error
+}
+
+// Redactor is implemented by providers whose zone contains a secret, ex a spamhaus DQS key, that must never be
+// reported in errors or logs
+type Redactor interface {
+	// RedactedZone returns the zone with any secret removed
+	RedactedZone() string
+}
+
+// RateLimitReporter is implemented by providers whose zone reports when it's receiving too many queries, ex spamhaus
+// answers 127.255.255.255. A Resolver with a Limiter slows its queries to the provider down when it does
+type RateLimitReporter interface {
+	// RateLimited reports whether err, as returned by CodeErr, means queries are being rate limited
+	RateLimited(err error) bool
+}
+
+// ListConfig describes a List provider
+type ListConfig struct {
+	Name        string
+	DisplayName string
+	Zone        string
+	IPv6        bool
+	Codes       []Code
+}
+
+// List is a Provider whose zone and code table are fully described by its fields. It covers the
+// common case of a blocklist that only needs to be configured, not coded against
+type List struct {
+	name        string
+	displayName string
+	zone        string
+	ipv6        bool
+	codes       map[string]Code
+}
+
+// NewList constructs a List provider
+func NewList(cfg ListConfig) List {
+	l := List{
+		name:        cfg.Name,
+		displayName: cfg.DisplayName,
+		zone:        cfg.Zone,
+		ipv6:        cfg.IPv6,
+		codes:       make(map[string]Code, len(cfg.Codes)),
+	}
+
+	for _, c := range cfg.Codes {
+		if c.Category == "" {
+			c.Category = CategoryOther
+		}
+		l.codes[c.Code] = c
+	}
+
+	return l
+}
+
+// Name implements Provider
+func (l List) Name() string { return l.name }
+
+// DisplayName implements Provider
+func (l List) DisplayName() string { return l.displayName }
+
+// Zone implements Provider
+func (l List) Zone() string { return l.zone }
+
+// Codes implements Provider
+func (l List) Codes() map[string]Code { return l.codes }
+
+// IPv6 implements Provider
+func (l List) IPv6() bool { return l.ipv6 }
+
+// Decode looks up the meaning of a code in the provider's table. Codes the provider doesn't describe are still
+// returned, as CategoryOther, so a listing is never lost just because the table is out of date
+func Decode(p Provider, code string) Code {
+	if c, ok := p.Codes()[code]; ok {
+		return c
+	}
+
+	return Code{
+		Code:        code,
+		Description: "unknown code",
+		Category:    CategoryOther,
+	}
+}
+
+// ReverseIP formats an address the way dnsbl zones expect it to be queried, see https://tools.ietf.org/html/rfc5782#section-2.4.
+// IPv4 addresses have their octets reversed, 127.0.0.1 -> 1.0.0.127, and IPv6 addresses are expanded to all 32 nibbles
+// which are then reversed, 2001:db8::1 -> 1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2
+func ReverseIP(addr net.IP) string {
+	// To4() gives us the nice benifit of removing the v4InV6Prefix _and_ validating that we have an IPv4
+	// address, not an IPv6 address
+	if ipv4 := addr.To4(); ipv4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ipv4[3], ipv4[2], ipv4[1], ipv4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+
+	ipv6 := addr.To16()
+
+	// each of the 16 bytes is two nibbles, each nibble written as a hex digit followed by a dot
+	buf := make([]byte, 0, 64)
+	for i := len(ipv6) - 1; i >= 0; i-- {
+		b := ipv6[i]
+		buf = append(buf, hexDigits[b&0x0f], '.', hexDigits[b>>4], '.')
+	}
+
+	return string(buf[:len(buf)-1])
+}
+
+// CanonicalDomain validates a domain name and returns it in the form it's queried and stored under, lower case
+// without a trailing dot. IP addresses are rejected, blocklists for domains refuse to answer for them
+func CanonicalDomain(domain string) (string, error) {
+	d := strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if net.ParseIP(d) != nil {
+		return "", errors.Errorf("ip address %s is not a domain", domain)
+	}
+
+	// see https://tools.ietf.org/html/rfc1035#section-2.3.4 for the size limits
+	if len(d) == 0 || len(d) > 253 {
+		return "", errors.Errorf("invalid domain %s", domain)
+	}
+
+	labels := strings.Split(d, ".")
+	if len(labels) < 2 {
+		return "", errors.Errorf("domain %s is not fully qualified", domain)
+	}
+
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return "", errors.Errorf("invalid domain %s", domain)
+		}
+
+		for _, c := range l {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", errors.Errorf("invalid domain %s", domain)
+			}
+		}
+	}
+
+	return d, nil
+}
@@ -0,0 +1,80 @@
+package dnsbl_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+)
+
+func TestReverseIP(t *testing.T) {
+	t.Log("Given the need to format addresses as dnsbl query names")
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"127.0.0.2", "2.0.0.127"},
+		{"::ffff:192.0.2.1", "1.2.0.192"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+		{"2001:DB8:1234:5678:9ABC:DEF0:0:FF", "f.f.0.0.0.0.0.0.0.f.e.d.c.b.a.9.8.7.6.5.4.3.2.1.8.b.d.0.1.0.0.2"},
+	}
+
+	for i, tt := range tests {
+		t.Logf("\tTest %d:\tWhen reversing %s.", i, tt.ip)
+
+		got := dnsbl.ReverseIP(net.ParseIP(tt.ip))
+		if got != tt.want {
+			t.Fatalf("\t%s\tTest %d:\tShould get back %s : %s", failure, i, tt.want, got)
+		}
+		t.Logf("\t%s\tTest %d:\tShould get back %s.", success, i, tt.want)
+	}
+}
+
+func TestQueryIPv6Unsupported(t *testing.T) {
+	t.Log("Given the need to only query zones for the address families they list")
+
+	p := dnsbl.NewList(dnsbl.ListConfig{Name: "ipv4only", Zone: "ipv4only.invalid"})
+
+	r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{})
+	if err != nil {
+		t.Fatalf("unable to create resolver %v", err)
+	}
+
+	t.Logf("\tTest %d:\tWhen querying an IPv6 address against an IPv4 only zone.", 0)
+
+	if _, err := r.Query(context.Background(), p, "2001:db8::1"); err != dnsbl.ErrIPv6Unsupported {
+		t.Fatalf("\t%s\tTest %d:\tShould return ErrIPv6Unsupported : %v", failure, 0, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould return ErrIPv6Unsupported.", success, 0)
+}
+
+func TestCanonicalDomain(t *testing.T) {
+	t.Log("Given the need to validate domains before querying domain zones")
+
+	tests := []struct {
+		domain string
+		want   string
+		valid  bool
+	}{
+		{"example.com", "example.com", true},
+		{"Mail.Example.COM.", "mail.example.com", true},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", true},
+		{"localhost", "", false},
+		{"127.0.0.1", "", false},
+		{"-bad.example.com", "", false},
+		{"bad..example.com", "", false},
+		{"spaces are.example.com", "", false},
+	}
+
+	for i, tt := range tests {
+		t.Logf("\tTest %d:\tWhen validating %q.", i, tt.domain)
+
+		got, err := dnsbl.CanonicalDomain(tt.domain)
+		if (err == nil) != tt.valid || got != tt.want {
+			t.Fatalf("\t%s\tTest %d:\tShould get back %q valid %v : %q %v", failure, i, tt.want, tt.valid, got, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould get back %q valid %v.", success, i, tt.want, tt.valid)
+	}
+}
@@ -0,0 +1,148 @@
+package dnsbl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minRateFraction is how far a provider's rate can be cut when it reports rate limiting, a provider configured
+// for 16 queries per second won't be cut below 1
+const minRateFraction = 16
+
+// defaultCooldown is how long a provider's rate stays cut before it's raised again
+const defaultCooldown = time.Minute
+
+// Limit is the rate queries are sent to a provider at, a token bucket that holds Burst queries and refills at QPS
+// queries per second. A QPS of zero or less doesn't limit queries at all
+type Limit struct {
+	QPS   float64
+	Burst int
+}
+
+// LimiterConfig describes the limits of each provider
+type LimiterConfig struct {
+	// Default applies to any provider without a limit of its own in Providers
+	Default Limit
+	// Providers are the limits of individual providers, keyed by provider name
+	Providers map[string]Limit
+	// Cooldown is how long a provider's rate stays cut after it reports rate limiting before it's doubled, and again
+	// every Cooldown until it's back at its limit. Defaults to a minute
+	Cooldown time.Duration
+}
+
+// Limiter limits the rate of queries to each provider. It's meant to be shared by everything querying a provider
+// so the limit holds for the whole process, construct one with NewLimiter
+type Limiter struct {
+	cfg     LimiterConfig
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket is the token bucket of a single provider
+type bucket struct {
+	limiter *rate.Limiter
+	// max is the configured rate, the bucket's rate is below it while the provider is throttled
+	max       rate.Limit
+	throttled time.Time
+}
+
+// NewLimiter constructs a Limiter
+func NewLimiter(cfg LimiterConfig) *Limiter {
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = defaultCooldown
+	}
+
+	return &Limiter{
+		cfg:     cfg,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Wait blocks until a query can be sent to the provider or ctx is done
+func (l *Limiter) Wait(ctx context.Context, provider string) error {
+	return l.bucket(provider).limiter.Wait(ctx)
+}
+
+// Throttle halves the provider's rate, down to a sixteenth of its limit, for when the provider reports it's
+// receiving too many queries. It's raised again once the cooldown passes, see LimiterConfig
+func (l *Limiter) Throttle(provider string) {
+	b := l.bucket(provider)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// an unlimited provider has no rate to cut
+	if b.max == rate.Inf {
+		return
+	}
+
+	r := b.limiter.Limit() / 2
+	if floor := b.max / minRateFraction; r < floor {
+		r = floor
+	}
+
+	b.limiter.SetLimit(r)
+	b.throttled = time.Now()
+}
+
+// QPS returns the rate queries are currently sent to the provider at, zero when it's unlimited
+func (l *Limiter) QPS(provider string) float64 {
+	b := l.bucket(provider)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b.limiter.Limit() == rate.Inf {
+		return 0
+	}
+
+	return float64(b.limiter.Limit())
+}
+
+// bucket returns the provider's bucket, creating it on first use and raising its rate if it's been throttled for
+// longer than the cooldown
+func (l *Limiter) bucket(provider string) *bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[provider]
+	if !ok {
+		limit, ok := l.cfg.Providers[provider]
+		if !ok {
+			limit = l.cfg.Default
+		}
+
+		max := rate.Inf
+		if limit.QPS > 0 {
+			max = rate.Limit(limit.QPS)
+		}
+
+		burst := limit.Burst
+		if burst < 1 {
+			burst = 1
+		}
+
+		b = &bucket{
+			limiter: rate.NewLimiter(max, burst),
+			max:     max,
+		}
+		l.buckets[provider] = b
+
+		return b
+	}
+
+	if r := b.limiter.Limit(); r < b.max && time.Since(b.throttled) >= l.cfg.Cooldown {
+		r *= 2
+		if r > b.max {
+			r = b.max
+		}
+
+		b.limiter.SetLimit(r)
+		b.throttled = time.Now()
+	}
+
+	return b
+}
@@ -0,0 +1,113 @@
+package dnsbl_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+)
+
+// errSlowDown is the rate limiting error of rateLimitedList
+var errSlowDown = errors.New("slow down")
+
+// rateLimitedList is a provider that answers 127.0.0.255 when it's rate limiting
+type rateLimitedList struct {
+	dnsbl.List
+}
+
+func (rateLimitedList) CodeErr(code string) error {
+	if code == "127.0.0.255" {
+		return errors.Wrap(errSlowDown, "responded 127.0.0.255")
+	}
+	return nil
+}
+
+func (rateLimitedList) RateLimited(err error) bool {
+	return errors.Cause(err) == errSlowDown
+}
+
+func TestLimiter(t *testing.T) {
+	t.Log("Given the need to limit the rate of queries to a provider.")
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen queries are sent faster than the limit.", testID)
+	{
+		l := dnsbl.NewLimiter(dnsbl.LimiterConfig{
+			Default:   dnsbl.Limit{QPS: 1000, Burst: 1},
+			Providers: map[string]dnsbl.Limit{"slow": {QPS: 50, Burst: 1}},
+		})
+
+		start := time.Now()
+		for i := 0; i < 6; i++ {
+			if err := l.Wait(context.Background(), "slow"); err != nil {
+				t.Fatalf("\t%s\tTest %d:\tShould be able to wait : %v", failure, testID, err)
+			}
+		}
+
+		// a burst of 1 at 50 per second makes the five queries after the first wait 20ms each
+		if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+			t.Fatalf("\t%s\tTest %d:\tShould hold queries to the provider's limit : %s", failure, testID, elapsed)
+		}
+		t.Logf("\t%s\tTest %d:\tShould hold queries to the provider's limit.", success, testID)
+
+		if l.QPS("other") != 1000 {
+			t.Fatalf("\t%s\tTest %d:\tShould apply the default to other providers : %v", failure, testID, l.QPS("other"))
+		}
+		t.Logf("\t%s\tTest %d:\tShould apply the default to other providers.", success, testID)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := l.Wait(ctx, "slow"); err == nil {
+			t.Fatalf("\t%s\tTest %d:\tShould stop waiting once the context is done.", failure, testID)
+		}
+		t.Logf("\t%s\tTest %d:\tShould stop waiting once the context is done.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen a provider reports rate limiting.", testID)
+	{
+		l := dnsbl.NewLimiter(dnsbl.LimiterConfig{
+			Default:  dnsbl.Limit{QPS: 160, Burst: 10},
+			Cooldown: 20 * time.Millisecond,
+		})
+
+		r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+			Limiter: l,
+			Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+				return []string{"127.0.0.255"}, nil
+			}),
+		})
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to create a resolver : %v", failure, testID, err)
+		}
+
+		p := rateLimitedList{dnsbl.NewList(dnsbl.ListConfig{Name: "test", Zone: "dnsbl.test"})}
+
+		if _, err := r.Query(context.Background(), p, "127.0.0.2"); errors.Cause(err) != errSlowDown {
+			t.Fatalf("\t%s\tTest %d:\tShould return the rate limiting error : %v", failure, testID, err)
+		}
+
+		if got := l.QPS("test"); got != 80 {
+			t.Fatalf("\t%s\tTest %d:\tShould halve the provider's rate : %v", failure, testID, got)
+		}
+		t.Logf("\t%s\tTest %d:\tShould halve the provider's rate.", success, testID)
+
+		for i := 0; i < 10; i++ {
+			l.Throttle("test")
+		}
+
+		if got := l.QPS("test"); got != 10 {
+			t.Fatalf("\t%s\tTest %d:\tShould not cut the rate below a sixteenth : %v", failure, testID, got)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not cut the rate below a sixteenth.", success, testID)
+
+		time.Sleep(25 * time.Millisecond)
+
+		if got := l.QPS("test"); got != 20 {
+			t.Fatalf("\t%s\tTest %d:\tShould double the rate once the cooldown passes : %v", failure, testID, got)
+		}
+		t.Logf("\t%s\tTest %d:\tShould double the rate once the cooldown passes.", success, testID)
+	}
+}
@@ -0,0 +1,55 @@
+package dnsbl
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Registry holds the set of providers enabled for the app. The first provider registered is the default,
+// used whenever a caller doesn't ask for a specific provider
+type Registry struct {
+	providers []Provider
+	byName    map[string]Provider
+}
+
+// NewRegistry constructs a Registry from the given providers. Provider names are used as storage keys
+// so they must be unique and non empty
+func NewRegistry(providers ...Provider) (Registry, error) {
+	if len(providers) == 0 {
+		return Registry{}, errors.New("at least one provider is required")
+	}
+
+	r := Registry{
+		byName: make(map[string]Provider, len(providers)),
+	}
+
+	for _, p := range providers {
+		if p.Name() == "" {
+			return Registry{}, errors.Errorf("provider for zone %q has no name", p.Zone())
+		}
+
+		if _, exists := r.byName[p.Name()]; exists {
+			return Registry{}, errors.Errorf("duplicate provider %q", p.Name())
+		}
+
+		r.byName[p.Name()] = p
+		r.providers = append(r.providers, p)
+	}
+
+	return r, nil
+}
+
+// Providers returns every registered provider in the order they were registered
+func (r Registry) Providers() []Provider {
+	return r.providers
+}
+
+// Provider finds a registered provider by name
+func (r Registry) Provider(name string) (Provider, bool) {
+	p, ok := r.byName[name]
+	return p, ok
+}
+
+// Default returns the first registered provider
+func (r Registry) Default() Provider {
+	return r.providers[0]
+}
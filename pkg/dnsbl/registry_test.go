@@ -0,0 +1,70 @@
+package dnsbl_test
+
+import (
+	"testing"
+
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+)
+
+// Success/Failure chars for nicer go test -v output
+const (
+	success = "\u2713"
+	failure = "\u2717"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Log("Given the need to manage the set of enabled dnsbl providers")
+
+	spamhaus := dnsbl.NewList(dnsbl.ListConfig{
+		Name:        "spamhaus",
+		DisplayName: "Spamhaus ZEN",
+		Zone:        "zen.spamhaus.org",
+		Codes:       []dnsbl.Code{{Code: "127.0.0.2", Description: "SBL - Spamhaus SBL Data"}},
+	})
+	spamcop := dnsbl.NewList(dnsbl.ListConfig{
+		Name:        "spamcop",
+		DisplayName: "SpamCop Blocking List",
+		Zone:        "bl.spamcop.net",
+	})
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen registering uniquely named providers.", testID)
+
+	r, err := dnsbl.NewRegistry(spamhaus, spamcop)
+	if err != nil {
+		t.Fatalf("\t%s\tTest %d:\tShould be able to create a registry : %v", failure, testID, err)
+	}
+	t.Logf("\t%s\tTest %d:\tShould be able to create a registry.", success, testID)
+
+	if r.Default().Name() != "spamhaus" {
+		t.Fatalf("\t%s\tTest %d:\tShould use the first provider as the default : %s", failure, testID, r.Default().Name())
+	}
+	t.Logf("\t%s\tTest %d:\tShould use the first provider as the default.", success, testID)
+
+	p, ok := r.Provider("spamcop")
+	if !ok || p.Zone() != "bl.spamcop.net" {
+		t.Fatalf("\t%s\tTest %d:\tShould find a provider by name : %v", failure, testID, p)
+	}
+	t.Logf("\t%s\tTest %d:\tShould find a provider by name.", success, testID)
+
+	if c, ok := r.Default().Codes()["127.0.0.2"]; !ok || c.Description != "SBL - Spamhaus SBL Data" {
+		t.Fatalf("\t%s\tTest %d:\tShould look up a code's meaning : %v", failure, testID, c)
+	}
+	t.Logf("\t%s\tTest %d:\tShould look up a code's meaning.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen registering providers with the same name.", testID)
+
+	if _, err := dnsbl.NewRegistry(spamhaus, spamhaus); err == nil {
+		t.Fatalf("\t%s\tTest %d:\tShould reject duplicate provider names.", failure, testID)
+	}
+	t.Logf("\t%s\tTest %d:\tShould reject duplicate provider names.", success, testID)
+
+	testID++
+	t.Logf("\tTest %d:\tWhen registering no providers.", testID)
+
+	if _, err := dnsbl.NewRegistry(); err == nil {
+		t.Fatalf("\t%s\tTest %d:\tShould require at least one provider.", failure, testID)
+	}
+	t.Logf("\t%s\tTest %d:\tShould require at least one provider.", success, testID)
+}
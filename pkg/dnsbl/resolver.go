@@ -0,0 +1,227 @@
+package dnsbl
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HostLookup is the subset of *net.Resolver used to make queries, it allows tests to stand in for the network
+type HostLookup interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// ResolverConfig describes how dnsbl queries are sent. Spamhaus, among others, refuses queries that arrive
+// through large public resolvers such as 8.8.8.8 so most deployments will want to point Nameserver at their
+// own recursive resolver
+type ResolverConfig struct {
+	// Nameserver is the host:port of the nameserver to query, when empty the system resolver is used
+	Nameserver string
+	// Protocol is the protocol used to reach Nameserver, either udp or tcp. Defaults to udp
+	Protocol string
+	// Timeout bounds each individual query attempt, zero means attempts are only bound by the caller's context
+	Timeout time.Duration
+	// Retries is the number of times a query that timed out or failed temporarily is attempted again
+	Retries int
+	// Lookup overrides the resolver built from the fields above, it's intended for tests
+	Lookup HostLookup
+	// Limiter limits the rate of queries to each provider, including retries. Nil doesn't limit queries
+	Limiter *Limiter
+}
+
+// Resolver performs dnsbl queries
+type Resolver struct {
+	lookup  HostLookup
+	timeout time.Duration
+	retries int
+	limiter *Limiter
+}
+
+// NewResolver constructs a Resolver
+func NewResolver(cfg ResolverConfig) (Resolver, error) {
+	r := Resolver{
+		lookup:  cfg.Lookup,
+		timeout: cfg.Timeout,
+		retries: cfg.Retries,
+		limiter: cfg.Limiter,
+	}
+
+	if r.retries < 0 {
+		return Resolver{}, errors.Errorf("invalid retries %d", cfg.Retries)
+	}
+
+	if r.lookup != nil {
+		return r, nil
+	}
+
+	if cfg.Nameserver == "" {
+		r.lookup = net.DefaultResolver
+		return r, nil
+	}
+
+	protocol := cfg.Protocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+
+	if protocol != "udp" && protocol != "tcp" {
+		return Resolver{}, errors.Errorf("unsupported protocol %q", cfg.Protocol)
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Nameserver); err != nil {
+		return Resolver{}, errors.Wrapf(err, "invalid nameserver %q", cfg.Nameserver)
+	}
+
+	// queries are sent straight to our nameserver, rather than through *net.Resolver, so we learn the TTL of
+	// each answer regardless of what /etc/resolv.conf says
+	r.lookup = client{
+		nameserver: cfg.Nameserver,
+		protocol:   protocol,
+	}
+
+	return r, nil
+}
+
+// Answer is the outcome of a dnsbl query
+type Answer struct {
+	// Codes are the codes the provider listed the query under, nil when it isn't listed
+	Codes []string
+	// TTL is how long the answer may be cached for, zero when the lookup doesn't report it, such as with the system
+	// resolver
+	TTL time.Duration
+}
+
+// Query queries the provider's zone and returns any codes found for a given ip.
+// Because it is possible for an ip address to not be listed Query does not treat an
+// IsNotFound error as an error to be reported, we instead return nil to indicate there were no codes found
+func (r Resolver) Query(ctx context.Context, p Provider, ip string) ([]string, error) {
+	a, err := r.Lookup(ctx, p, ip)
+	return a.Codes, err
+}
+
+// Lookup is Query, also returning how long the answer may be cached for
+func (r Resolver) Lookup(ctx context.Context, p Provider, ip string) (Answer, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return Answer{}, errors.Errorf("invalid ip %s", ip)
+	}
+
+	if addr.To4() == nil && !p.IPv6() {
+		return Answer{}, ErrIPv6Unsupported
+	}
+
+	// append the dnsbl zone to the reversed address
+	// ex. 127.0.0.1 -> 1.0.0.127.zen.spamhaus.org
+	return r.query(ctx, p, ReverseIP(addr))
+}
+
+// QueryDomain queries the provider's zone and returns any codes found for a given domain. Like Query, a domain
+// that isn't listed returns no codes and no error
+func (r Resolver) QueryDomain(ctx context.Context, p Provider, domain string) ([]string, error) {
+	d, err := CanonicalDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// domains are queried as is with the zone appended
+	// ex. example.com -> example.com.dbl.spamhaus.org
+	a, err := r.query(ctx, p, d)
+	return a.Codes, err
+}
+
+// query looks up name in the provider's zone, reporting any codes the provider reserves for failures as errors
+func (r Resolver) query(ctx context.Context, p Provider, name string) (Answer, error) {
+	host := name + "." + p.Zone()
+
+	names, ttl, err := r.lookupHost(ctx, p.Name(), host)
+	if err != nil {
+		if v, ok := err.(*net.DNSError); ok {
+			if v.IsNotFound {
+				return Answer{TTL: ttl}, nil
+			}
+
+			// the query name is reported in the error, swap out the zone if it holds a secret
+			if rd, ok := p.(Redactor); ok {
+				redacted := *v
+				redacted.Name = strings.Replace(v.Name, p.Zone(), rd.RedactedZone(), 1)
+				return Answer{}, &redacted
+			}
+		}
+
+		return Answer{}, err
+	}
+
+	if ec, ok := p.(ErrorCoder); ok {
+		for _, code := range names {
+			if err := ec.CodeErr(code); err != nil {
+				// slow down before the provider starts refusing us outright
+				if rl, ok := p.(RateLimitReporter); ok && r.limiter != nil && rl.RateLimited(err) {
+					r.limiter.Throttle(p.Name())
+				}
+
+				return Answer{}, err
+			}
+		}
+	}
+
+	return Answer{Codes: names, TTL: ttl}, nil
+}
+
+// lookupHost makes up to retries+1 attempts to resolve host, only trying again when the previous attempt
+// timed out or failed temporarily and the caller's context is still live. Each attempt waits its turn with the
+// provider's limiter, and none is made once the caller's context is done
+func (r Resolver) lookupHost(ctx context.Context, provider string, host string) ([]string, time.Duration, error) {
+	var err error
+
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		if r.limiter != nil {
+			if err := r.limiter.Wait(ctx, provider); err != nil {
+				return nil, 0, errors.Wrap(err, "waiting on rate limit")
+			}
+		}
+
+		var names []string
+		var ttl time.Duration
+		if names, ttl, err = r.lookupOnce(ctx, host); err == nil {
+			return names, ttl, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, 0, err
+		}
+
+		v, ok := err.(*net.DNSError)
+		if ok && v.IsNotFound {
+			// the TTL of a name that doesn't exist is still worth keeping
+			return nil, ttl, err
+		}
+
+		if !ok || !(v.IsTimeout || v.IsTemporary) {
+			return nil, 0, err
+		}
+	}
+
+	return nil, 0, err
+}
+
+func (r Resolver) lookupOnce(ctx context.Context, host string) ([]string, time.Duration, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	if l, ok := r.lookup.(TTLLookup); ok {
+		return l.LookupHostTTL(ctx, host)
+	}
+
+	names, err := r.lookup.LookupHost(ctx, host)
+	return names, 0, err
+}
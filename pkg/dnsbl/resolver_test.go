@@ -0,0 +1,244 @@
+package dnsbl_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shaneu/indahaus/pkg/dnsbl"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// lookupFunc lets a plain function stand in for the network
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f lookupFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+func TestResolver(t *testing.T) {
+	t.Log("Given the need to control how dnsbl queries are sent")
+
+	p := dnsbl.NewList(dnsbl.ListConfig{Name: "test", Zone: "dnsbl.test"})
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen queries time out.", testID)
+	{
+		var attempts int
+		r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+			Retries: 2,
+			Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+				attempts++
+				if attempts < 3 {
+					return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+				}
+				return []string{"127.0.0.2"}, nil
+			}),
+		})
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to create a resolver : %v", failure, testID, err)
+		}
+
+		codes, err := r.Query(context.Background(), p, "127.0.0.2")
+		if err != nil || len(codes) != 1 || attempts != 3 {
+			t.Fatalf("\t%s\tTest %d:\tShould retry until the query succeeds : %v %v %d", failure, testID, codes, err, attempts)
+		}
+		t.Logf("\t%s\tTest %d:\tShould retry until the query succeeds.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen an address is not listed.", testID)
+	{
+		var attempts int
+		r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+			Retries: 2,
+			Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+				attempts++
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}),
+		})
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to create a resolver : %v", failure, testID, err)
+		}
+
+		codes, err := r.Query(context.Background(), p, "127.0.0.1")
+		if err != nil || codes != nil || attempts != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould return no codes without retrying : %v %v %d", failure, testID, codes, err, attempts)
+		}
+		t.Logf("\t%s\tTest %d:\tShould return no codes without retrying.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen a query is slower than the per query timeout.", testID)
+	{
+		r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+			Timeout: 10 * time.Millisecond,
+			Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}),
+		})
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to create a resolver : %v", failure, testID, err)
+		}
+
+		if _, err := r.Query(context.Background(), p, "127.0.0.2"); err != context.DeadlineExceeded {
+			t.Fatalf("\t%s\tTest %d:\tShould give up once the timeout passes : %v", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould give up once the timeout passes.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen the caller cancels the context.", testID)
+	{
+		// the caller gives up while the first attempt is in flight
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var attempts int
+		r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+			Retries: 5,
+			Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+				attempts++
+				cancel()
+				return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+			}),
+		})
+		if err != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould be able to create a resolver : %v", failure, testID, err)
+		}
+
+		if _, err := r.Query(ctx, p, "127.0.0.2"); err == nil || attempts != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould stop retrying : %v %d", failure, testID, err, attempts)
+		}
+		t.Logf("\t%s\tTest %d:\tShould stop retrying.", success, testID)
+
+		attempts = 0
+		if _, err := r.Query(ctx, p, "127.0.0.2"); err != context.Canceled || attempts != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould not query once cancelled : %v %d", failure, testID, err, attempts)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not query once cancelled.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen configured with an unsupported protocol.", testID)
+	{
+		if _, err := dnsbl.NewResolver(dnsbl.ResolverConfig{Nameserver: "10.0.0.53:53", Protocol: "quic"}); err == nil {
+			t.Fatalf("\t%s\tTest %d:\tShould reject the configuration.", failure, testID)
+		}
+		t.Logf("\t%s\tTest %d:\tShould reject the configuration.", success, testID)
+	}
+}
+
+// serveDNS answers queries sent to a udp nameserver on localhost until the test ends. 2.0.0.127 is listed for five
+// minutes, 3.0.0.127 fails with SERVFAIL and every other name doesn't exist, which the zone caches for a minute
+func serveDNS(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	zone := dnsmessage.MustNewName("dnsbl.test.")
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			q := msg.Questions[0]
+
+			msg.Header.Response = true
+			switch q.Name.String() {
+			case "2.0.0.127.dnsbl.test.":
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+					Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 2}},
+				}}
+			case "3.0.0.127.dnsbl.test.":
+				msg.Header.RCode = dnsmessage.RCodeServerFailure
+			default:
+				msg.Header.RCode = dnsmessage.RCodeNameError
+				msg.Authorities = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 900},
+					Body:   &dnsmessage.SOAResource{NS: zone, MBox: zone, MinTTL: 60},
+				}}
+			}
+
+			resp, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestNameserver(t *testing.T) {
+	t.Log("Given the need to know how long an answer stays fresh")
+
+	p := dnsbl.NewList(dnsbl.ListConfig{Name: "test", Zone: "dnsbl.test"})
+
+	r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+		Nameserver: serveDNS(t),
+		Timeout:    time.Second,
+		Retries:    1,
+	})
+	if err != nil {
+		t.Fatalf("unable to create a resolver : %v", err)
+	}
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen an address is listed.", testID)
+	{
+		a, err := r.Lookup(context.Background(), p, "127.0.0.2")
+		if err != nil || len(a.Codes) != 1 || a.Codes[0] != "127.0.0.2" || a.TTL != 5*time.Minute {
+			t.Fatalf("\t%s\tTest %d:\tShould return the codes with the answer's TTL : %+v %v", failure, testID, a, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould return the codes with the answer's TTL.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen an address is not listed.", testID)
+	{
+		a, err := r.Lookup(context.Background(), p, "127.0.0.1")
+		if err != nil || a.Codes != nil || a.TTL != time.Minute {
+			t.Fatalf("\t%s\tTest %d:\tShould return no codes with the zone's negative TTL : %+v %v", failure, testID, a, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould return no codes with the zone's negative TTL.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen the nameserver fails.", testID)
+	{
+		_, err := r.Lookup(context.Background(), p, "127.0.0.3")
+		if v, ok := err.(*net.DNSError); !ok || !v.IsTemporary {
+			t.Fatalf("\t%s\tTest %d:\tShould report a temporary failure : %v", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould report a temporary failure.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen the query name is too long to ask about.", testID)
+	{
+		long := dnsbl.NewList(dnsbl.ListConfig{Name: "long", Zone: strings.Repeat(strings.Repeat("a", 60)+".", 4) + "test"})
+
+		a, err := r.Lookup(context.Background(), long, "127.0.0.2")
+		if v, ok := err.(*net.DNSError); !ok || v.IsNotFound || a.Codes != nil {
+			t.Fatalf("\t%s\tTest %d:\tShould fail the lookup rather than report the address as not listed : %+v %v",
+				failure, testID, a, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould fail the lookup rather than report the address as not listed.", success, testID)
+	}
+}
@@ -1,48 +1,192 @@
 package spamhaus
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
 )
 
-const dnsZone = "zen.spamhaus.org"
+const (
+	// Name is the key the spamhaus zen provider is registered and stored under
+	Name = "spamhaus"
+	// DBLName is the key the spamhaus domain blocklist provider is registered and stored under
+	DBLName = "spamhaus-dbl"
+	// ZRDName is the key the spamhaus zero reputation domain provider is registered and stored under
+	ZRDName = "spamhaus-zrd"
+	// dqsSuffix is appended to a zone's name to get its Data Query Service zone, queried as
+	// <reversed-ip>.<key>.zen.dq.spamhaus.net
+	dqsSuffix = ".dq.spamhaus.net"
+)
 
-// QueryDNSBL queries the spamhaus dns blacklist and returns any codes found for a given ip.
-// Because it is possible for an ip address to not be listed with spamhaus QueryDNSBL
-// we do not treat an IsNotFound error as an error to be reported, we instead return nil
-// to indicate there were no codes found
-func QueryDNSBL(ip string) ([]string, error) {
-	// ParseIP returns nil in the case of an ivalid IP and a 16 byte slice in the case of a valid
-	// The first 12 bytes are the v4InV6Prefix defined in ip.go, the last 4 bytes are the IPv4 octets
-	bs := net.ParseIP(ip)
-
-	if bs == nil {
-		return nil, errors.Errorf("invalid ip %s", ip)
+// Spamhaus answers queries it refuses to serve with a code in the 127.255.255.0/24 network rather than a listing,
+// see https://www.spamhaus.org/faq/section/DNSBL%20Usage#200
+var (
+	ErrDQSKey           = errors.New("dqs key is not valid")
+	ErrTypo             = errors.New("typing error in dnsbl name")
+	ErrOpenResolver     = errors.New("query made through a public/open resolver")
+	ErrExcessiveQueries = errors.New("excessive number of queries")
+	ErrUnknown          = errors.New("unknown error response")
+	// ErrIPQuery is answered by the domain zones, 127.0.1.255, when they're queried with an IP address
+	ErrIPQuery = errors.New("ip queries are prohibited")
+)
+
+var errCodes = map[string]error{
+	"127.0.1.255":     ErrIPQuery,
+	"127.255.255.250": ErrDQSKey,
+	"127.255.255.252": ErrTypo,
+	"127.255.255.254": ErrOpenResolver,
+	"127.255.255.255": ErrExcessiveQueries,
+}
+
+// the 127.255.255.0/24 network spamhaus reserves for errors
+var errIPNet = net.IPNet{IP: net.IPv4(127, 255, 255, 0), Mask: net.CIDRMask(24, 32)}
+
+// Codes are the return codes of the zen zone, see https://www.spamhaus.org/faq/section/DNSBL%20Usage#200
+var Codes = []dnsbl.Code{
+	{Code: "127.0.0.2", List: "SBL", Description: "Spamhaus SBL Data", Category: dnsbl.CategorySpam},
+	{Code: "127.0.0.3", List: "CSS", Description: "Spamhaus SBL CSS Data", Category: dnsbl.CategorySpam},
+	{Code: "127.0.0.4", List: "XBL", Description: "CBL Data", Category: dnsbl.CategoryExploited},
+	{Code: "127.0.0.9", List: "DROP", Description: "Spamhaus DROP/EDROP Data", Category: dnsbl.CategoryHijacked},
+	{Code: "127.0.0.10", List: "PBL", Description: "ISP Maintained", Category: dnsbl.CategoryPolicy},
+	{Code: "127.0.0.11", List: "PBL", Description: "Spamhaus Maintained", Category: dnsbl.CategoryPolicy},
+}
+
+// DBLCodes are the return codes of the domain blocklist, see https://www.spamhaus.org/faq/section/Spamhaus%20DBL#291
+var DBLCodes = []dnsbl.Code{
+	{Code: "127.0.1.2", List: "DBL", Description: "Spam domain", Category: dnsbl.CategorySpam},
+	{Code: "127.0.1.4", List: "DBL", Description: "Phish domain", Category: dnsbl.CategoryPhish},
+	{Code: "127.0.1.5", List: "DBL", Description: "Malware domain", Category: dnsbl.CategoryMalware},
+	{Code: "127.0.1.6", List: "DBL", Description: "Botnet C&C domain", Category: dnsbl.CategoryBotnet},
+	{Code: "127.0.1.102", List: "DBL", Description: "Abused legit spam", Category: dnsbl.CategorySpam},
+	{Code: "127.0.1.103", List: "DBL", Description: "Abused spammed redirector domain", Category: dnsbl.CategorySpam},
+	{Code: "127.0.1.104", List: "DBL", Description: "Abused legit phish", Category: dnsbl.CategoryPhish},
+	{Code: "127.0.1.105", List: "DBL", Description: "Abused legit malware", Category: dnsbl.CategoryMalware},
+	{Code: "127.0.1.106", List: "DBL", Description: "Abused legit botnet C&C", Category: dnsbl.CategoryBotnet},
+}
+
+// ZRDCodes are the return codes of the zero reputation domain list, the last octet is the number of hours since
+// the domain was first seen, see https://www.spamhaus.com/product/zero-reputation-domain-zrd/
+var ZRDCodes = func() []dnsbl.Code {
+	var codes []dnsbl.Code
+	for h := 2; h <= 24; h++ {
+		codes = append(codes, dnsbl.Code{
+			Code:        fmt.Sprintf("127.0.2.%d", h),
+			List:        "ZRD",
+			Description: fmt.Sprintf("Domain first seen %d hours ago", h),
+			Category:    dnsbl.CategoryNewDomain,
+		})
+	}
+	return codes
+}()
+
+// Provider is a spamhaus dnsbl provider, queried either through the public mirrors or the Data Query Service
+type Provider struct {
+	dnsbl.List
+	// dqsZone is set when the provider is queried through the Data Query Service, it's the zone without the key
+	dqsZone string
+}
+
+// newProvider builds a provider for the zone, through the Data Query Service when a key is given
+func newProvider(cfg dnsbl.ListConfig, key string) Provider {
+	if key == "" {
+		return Provider{List: dnsbl.NewList(cfg)}
+	}
+
+	dqsZone := strings.TrimSuffix(cfg.Zone, ".spamhaus.org") + dqsSuffix
+	cfg.DisplayName += " (DQS)"
+	cfg.Zone = key + "." + dqsZone
+
+	return Provider{
+		List:    dnsbl.NewList(cfg),
+		dqsZone: dqsZone,
+	}
+}
+
+// Zen returns the spamhaus zen provider, the combination of the SBL, XBL and PBL lists, queried
+// through the public mirrors
+func Zen() Provider {
+	return DQS("")
+}
+
+// DQS returns the spamhaus zen provider queried through the Data Query Service with the given key. The
+// key is part of the zone so it's redacted from errors, see RedactedZone. An empty key queries the public mirrors
+func DQS(key string) Provider {
+	return newProvider(dnsbl.ListConfig{
+		Name:        Name,
+		DisplayName: "Spamhaus ZEN",
+		Zone:        "zen.spamhaus.org",
+		IPv6:        true,
+		Codes:       Codes,
+	}, key)
+}
+
+// DBL returns the spamhaus domain blocklist provider, queried through the Data Query Service when key isn't empty
+func DBL(key string) Provider {
+	return newProvider(dnsbl.ListConfig{
+		Name:        DBLName,
+		DisplayName: "Spamhaus DBL",
+		Zone:        "dbl.spamhaus.org",
+		Codes:       DBLCodes,
+	}, key)
+}
+
+// ZRD returns the spamhaus zero reputation domain provider. ZRD is only served through the Data Query Service
+// so unlike the other zones it requires a key
+func ZRD(key string) (Provider, error) {
+	if key == "" {
+		return Provider{}, errors.New("zrd requires a dqs key")
 	}
 
-	// To4() gives us the nice benifit of removing the v4InV6Prefix _and_ validating that we have an IPv4
-	// address, not an IPv6 address
-	ipv4 := bs.To4()
-	if ipv4 == nil {
-		return nil, errors.Errorf("non ipv4 address %v", ip)
+	return newProvider(dnsbl.ListConfig{
+		Name:        ZRDName,
+		DisplayName: "Spamhaus ZRD",
+		Zone:        "zrd.spamhaus.org",
+		Codes:       ZRDCodes,
+	}, key), nil
+}
+
+// CodeErr implements dnsbl.ErrorCoder. Codes in the 127.255.255.0/24 network, and 127.0.1.255 from the
+// domain zones, are reported as errors, any other code is a listing
+func (p Provider) CodeErr(code string) error {
+	if err, ok := errCodes[code]; ok {
+		return errors.Wrapf(err, "spamhaus responded %s", code)
 	}
 
-	// format the host string with the IP address in reverse order with the dnsbl zone appended to the end
-	// ex. 127.0.0.1 -> 1.0.0.127.zen.spamhaus.org
-	host := fmt.Sprintf("%d.%d.%d.%d.%s", ipv4[3], ipv4[2], ipv4[1], ipv4[0], dnsZone)
+	if errIPNet.Contains(net.ParseIP(code)) {
+		return errors.Wrapf(ErrUnknown, "spamhaus responded %s", code)
+	}
 
-	names, err := net.LookupHost(host)
-	if err != nil {
-		if v, ok := err.(*net.DNSError); ok {
-			if v.IsNotFound {
-				return nil, nil
-			}
-		}
+	return nil
+}
+
+// RateLimited implements dnsbl.RateLimitReporter, spamhaus answers 127.255.255.255 when it's receiving an
+// excessive number of queries
+func (p Provider) RateLimited(err error) bool {
+	return errors.Cause(err) == ErrExcessiveQueries
+}
 
-		return nil, err
+// RedactedZone implements dnsbl.Redactor, it hides the DQS key
+func (p Provider) RedactedZone() string {
+	if p.dqsZone != "" {
+		return "<key>." + p.dqsZone
 	}
 
-	return names, nil
+	return p.Zone()
+}
+
+// String keeps the DQS key out of anything that formats the provider with %v
+func (p Provider) String() string {
+	return p.DisplayName()
+}
+
+// QueryDNSBL queries the spamhaus dns blacklist and returns any codes found for a given ip.
+// Because it is possible for an ip address to not be listed with spamhaus QueryDNSBL
+// we do not treat an IsNotFound error as an error to be reported, we instead return nil
+// to indicate there were no codes found. No query is made once ctx is done, its error is returned instead
+func QueryDNSBL(ctx context.Context, r dnsbl.Resolver, ip string) ([]string, error) {
+	return r.Query(ctx, Zen(), ip)
 }
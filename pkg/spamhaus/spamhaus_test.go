@@ -1,8 +1,15 @@
 package spamhaus_test
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
+	"github.com/shaneu/indahaus/pkg/dnsbl"
 	"github.com/shaneu/indahaus/pkg/spamhaus"
 )
 
@@ -41,15 +48,20 @@ func TestQueryDNSBL(t *testing.T) {
 		},
 		{
 			"\tTest %d:\tWhen the address is IPv6.",
-			"\t%s\tTest %d:\tShould return error for unsupported IPv6 lookup : %v",
-			true,
+			"\t%s\tTest %d:\tShould be able to look up IPv6 addresses : %v",
+			false,
 			"2001:0db8:85a3:0000:0000:8a2e:0370:7334",
 		},
 	}
 
+	r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("unable to create resolver %v", err)
+	}
+
 	for i, tt := range tests {
 		t.Logf(tt.when, i)
-		response, err := spamhaus.QueryDNSBL(tt.ip)
+		response, err := spamhaus.QueryDNSBL(context.Background(), r, tt.ip)
 
 		if tt.shouldErr && err != nil {
 			t.Logf(tt.should, success, i, err)
@@ -69,3 +81,145 @@ func TestQueryDNSBL(t *testing.T) {
 		}
 	}
 }
+
+// lookupFunc lets a plain function stand in for the network
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f lookupFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+func TestDQS(t *testing.T) {
+	t.Log("Given the need to query spamhaus through the Data Query Service")
+
+	const key = "abcdefghijklmnopqrstuvwxyz"
+	p := spamhaus.DQS(key)
+
+	testID := 0
+	t.Logf("\tTest %d:\tWhen looking up an address.", testID)
+	{
+		var queried string
+		r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+			Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+				queried = host
+				return []string{"127.0.0.2"}, nil
+			}),
+		})
+		if err != nil {
+			t.Fatalf("unable to create resolver %v", err)
+		}
+
+		codes, err := r.Query(context.Background(), p, "127.0.0.2")
+		if err != nil || len(codes) != 1 {
+			t.Fatalf("\t%s\tTest %d:\tShould return the listing : %v %v", failure, testID, codes, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould return the listing.", success, testID)
+
+		if want := "2.0.0.127." + key + ".zen.dq.spamhaus.net"; queried != want {
+			t.Fatalf("\t%s\tTest %d:\tShould query %s : %s", failure, testID, want, queried)
+		}
+		t.Logf("\t%s\tTest %d:\tShould query the DQS zone with the key.", success, testID)
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen spamhaus answers with an error code.", testID)
+	{
+		tests := []struct {
+			code string
+			err  error
+		}{
+			{"127.255.255.250", spamhaus.ErrDQSKey},
+			{"127.255.255.252", spamhaus.ErrTypo},
+			{"127.255.255.254", spamhaus.ErrOpenResolver},
+			{"127.255.255.255", spamhaus.ErrExcessiveQueries},
+			{"127.255.255.1", spamhaus.ErrUnknown},
+		}
+
+		for _, tt := range tests {
+			r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+				Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+					return []string{tt.code}, nil
+				}),
+			})
+			if err != nil {
+				t.Fatalf("unable to create resolver %v", err)
+			}
+
+			_, err = r.Query(context.Background(), p, "127.0.0.2")
+			if errors.Cause(err) != tt.err {
+				t.Fatalf("\t%s\tTest %d:\tShould report %s as %q : %v", failure, testID, tt.code, tt.err, err)
+			}
+			t.Logf("\t%s\tTest %d:\tShould report %s as %q.", success, testID, tt.code, tt.err)
+		}
+	}
+
+	testID++
+	t.Logf("\tTest %d:\tWhen a query fails.", testID)
+	{
+		r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+			Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+				return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+			}),
+		})
+		if err != nil {
+			t.Fatalf("unable to create resolver %v", err)
+		}
+
+		_, err = r.Query(context.Background(), p, "127.0.0.2")
+		if err == nil || strings.Contains(err.Error(), key) {
+			t.Fatalf("\t%s\tTest %d:\tShould not report the key in the error : %v", failure, testID, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not report the key in the error : %v", success, testID, err)
+
+		if s := fmt.Sprintf("%v %+v", p, p); strings.Contains(s, key) {
+			t.Fatalf("\t%s\tTest %d:\tShould not format the key : %s", failure, testID, s)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not format the key.", success, testID)
+	}
+}
+
+func TestQueryDNSBLCancelled(t *testing.T) {
+	t.Log("Given the need to stop querying once the caller has given up")
+
+	var queries int
+	r, err := dnsbl.NewResolver(dnsbl.ResolverConfig{
+		Lookup: lookupFunc(func(ctx context.Context, host string) ([]string, error) {
+			queries++
+			return []string{"127.0.0.2"}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("unable to create resolver %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	tests := []struct {
+		when string
+		ctx  context.Context
+		err  error
+	}{
+		{"\tTest %d:\tWhen the context is cancelled.", cancelled, context.Canceled},
+		{"\tTest %d:\tWhen the context's deadline has passed.", expired, context.DeadlineExceeded},
+	}
+
+	for i, tt := range tests {
+		t.Logf(tt.when, i)
+
+		queries = 0
+		codes, err := spamhaus.QueryDNSBL(tt.ctx, r, "127.0.0.2")
+		if errors.Cause(err) != tt.err {
+			t.Fatalf("\t%s\tTest %d:\tShould return %v : %v %v", failure, i, tt.err, codes, err)
+		}
+		t.Logf("\t%s\tTest %d:\tShould return %v.", success, i, tt.err)
+
+		if queries != 0 {
+			t.Fatalf("\t%s\tTest %d:\tShould not make a query : made %d.", failure, i, queries)
+		}
+		t.Logf("\t%s\tTest %d:\tShould not make a query.", success, i)
+	}
+}